@@ -1,10 +1,14 @@
 package main
 
-// columnize takes a binary SAS (SAS7BDAT) or Stata (dta) file and
-// saves the data from each column into a separate file.  Character
+// columnize takes a binary SAS (SAS7BDAT), SAS transport (xpt) or
+// Stata (dta) file and saves the data from each column into a
+// separate file.  Character
 // data is stored in raw format, with values separated by newline
 // characters.  Numeric data can be stored either in text or binary
 // format.  A text file containing the column names is also generated.
+//
+// The strings of a SAS7BDAT file are decoded using the encoding in its
+// header, or the SAS encoding given by the -encoding flag.
 
 import (
 	"bytes"
@@ -120,14 +124,15 @@ func doSplit(rdr datareader.StatfileReader, colDir string, mode string) {
 
 func main() {
 
-	if len(os.Args) != 4 {
-		os.Stderr.WriteString(fmt.Sprintf("usage: %s -in=file -out=directory -mode=[text|binary]\n", os.Args[0]))
+	if len(os.Args) != 4 && len(os.Args) != 5 {
+		os.Stderr.WriteString(fmt.Sprintf("usage: %s -in=file -out=directory -mode=[text|binary] [-encoding=name]\n", os.Args[0]))
 		return
 	}
 
-	infile := flag.String("in", "", "A SAS7BDAT or Stata dta file name")
+	infile := flag.String("in", "", "A SAS7BDAT, SAS transport or Stata dta file name")
 	colDir := flag.String("out", "", "A directory for writing the columns")
 	mode := flag.String("mode", "text", "Write numeric data as 'text' or 'binary'")
+	encoding := flag.String("encoding", "", "The SAS encoding of the strings, overriding the file header")
 
 	flag.Parse()
 
@@ -142,6 +147,8 @@ func main() {
 		filetype = "sas"
 	} else if strings.HasSuffix(fl, "dta") {
 		filetype = "stata"
+	} else if strings.HasSuffix(fl, "xpt") {
+		filetype = "xport"
 	} else {
 		os.Stderr.WriteString(fmt.Sprintf("%s file cannot be read", *infile))
 		return
@@ -155,17 +162,30 @@ func main() {
 
 	var rdr datareader.StatfileReader
 	if filetype == "sas" {
-		rdr, err = datareader.NewSAS7BDATReader(r)
+		sas, err := datareader.NewSAS7BDATReader(r)
 		if err != nil {
 			os.Stderr.WriteString(fmt.Sprintf("unable to open SAS file: %v\n", err))
 			return
 		}
+		if *encoding != "" {
+			if err := sas.SetEncoding(*encoding); err != nil {
+				os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+				return
+			}
+		}
+		rdr = sas
 	} else if filetype == "stata" {
 		rdr, err = datareader.NewStataReader(r)
 		if err != nil {
 			os.Stderr.WriteString(fmt.Sprintf("unable to open Stata file: %v\n", err))
 			return
 		}
+	} else if filetype == "xport" {
+		rdr, err = datareader.NewXPORTReader(r)
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("unable to open SAS transport file: %v\n", err))
+			return
+		}
 	}
 
 	doSplit(rdr, *colDir, *mode)
@@ -0,0 +1,216 @@
+package main
+
+// sasdump prints the structure of a SAS7BDAT file: the header
+// properties, the column metadata, and the header and subheader
+// pointers of each page.  It is intended for bug reports about files
+// that are not read correctly.  The data values are never printed,
+// and the data set name and the column names and labels are only
+// printed if -names is given.  If the metadata of the file cannot be
+// read, the error is printed, and the file is opened in recovery mode
+// or, failing that, only the file header and the pages are printed.
+//
+// With -hex, hex dumps of the file header, the page headers with
+// their subheader pointers, and the metadata subheaders are also
+// printed.  The file header holds the data set name and label, so
+// they appear in its hex dump even without -names.  The data
+// subheaders and the column text subheader (which holds the column
+// names and labels) are not dumped.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kshedden/datareader"
+)
+
+// Subheaders that are not included in the hex dumps
+var noDump = map[string]bool{
+	"data":        true,
+	"column text": true,
+	"truncated":   true,
+	"empty":       true,
+	"unknown":     true,
+}
+
+// hexDump writes a hex dump of b to w, in the format of hex.Dump
+// except that repeated lines are replaced by a single "*", as the
+// headers and pages are mostly zero.
+func hexDump(w io.Writer, b []byte) {
+
+	var last []byte
+	var skipped bool
+	for i := 0; i < len(b); i += 16 {
+		line := b[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		if last != nil && bytes.Equal(line, last) && i+16 < len(b) {
+			if !skipped {
+				fmt.Fprintf(w, "*\n")
+				skipped = true
+			}
+			continue
+		}
+		skipped = false
+		last = line
+
+		fmt.Fprintf(w, "%08x%s", i, hex.Dump(line)[8:])
+	}
+}
+
+func dumpHeader(w io.Writer, sas *datareader.SAS7BDAT, names, dump bool) error {
+
+	p := sas.Properties()
+	if names {
+		fmt.Fprintf(w, "Name:                     %s\n", sas.Name)
+	}
+	fmt.Fprintf(w, "File type:                %s\n", sas.FileType)
+	fmt.Fprintf(w, "Created:                  %v\n", sas.DateCreated)
+	fmt.Fprintf(w, "Modified:                 %v\n", sas.DateModified)
+	fmt.Fprintf(w, "SAS release:              %s\n", sas.SASRelease)
+	fmt.Fprintf(w, "Server type:              %s\n", sas.ServerType)
+	fmt.Fprintf(w, "OS:                       %s %s\n", sas.OSType, sas.OSName)
+	fmt.Fprintf(w, "Platform:                 %s\n", sas.Platform)
+	fmt.Fprintf(w, "Encoding:                 %s\n", sas.FileEncoding)
+	fmt.Fprintf(w, "Creator procedure:        %s\n", p.CreatorProc)
+	fmt.Fprintf(w, "64 bit:                   %v\n", p.U64)
+	fmt.Fprintf(w, "Big endian:               %v\n", p.BigEndian)
+	fmt.Fprintf(w, "Compression:              %s\n", p.Compression)
+	fmt.Fprintf(w, "Header length:            %d\n", p.HeaderLength)
+	fmt.Fprintf(w, "Page length:              %d\n", p.PageLength)
+	fmt.Fprintf(w, "Page count:               %d\n", p.PageCount)
+	fmt.Fprintf(w, "Page bit offset:          %d\n", p.PageBitOffset)
+	fmt.Fprintf(w, "Subheader pointer length: %d\n", p.SubheaderPointerLength)
+	fmt.Fprintf(w, "Row length:               %d\n", p.RowLength)
+	fmt.Fprintf(w, "Row count:                %d\n", p.RowCount)
+	fmt.Fprintf(w, "Mix page row count:       %d\n", p.MixPageRowCount)
+	fmt.Fprintf(w, "Column count:             %d (%d + %d)\n", p.ColumnCount, p.ColCountP1, p.ColCountP2)
+	fmt.Fprintf(w, "LCS, LCP:                 %d, %d\n", p.LCS, p.LCP)
+	fmt.Fprintf(w, "No align correction:      %v\n", p.NoAlignCorrection)
+
+	if dump {
+		b, err := sas.HeaderBytes()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\n")
+		hexDump(w, b)
+	}
+
+	fmt.Fprintf(w, "\nColumns:\n")
+	for _, c := range sas.Columns() {
+		name := ""
+		if names {
+			name = fmt.Sprintf(" name=%q label=%q", c.Name, c.Label)
+		}
+		fmt.Fprintf(w, "  %4d type=%d offset=%d length=%d format=%s%d.%d informat=%s%d.%d%s\n",
+			c.Index, c.Type, c.Offset, c.Length, c.Format, c.FormatWidth, c.FormatDecimals,
+			c.Informat, c.InformatWidth, c.InformatDecimals, name)
+	}
+
+	return nil
+}
+
+func dumpPage(w io.Writer, sas *datareader.SAS7BDAT, p int, dump bool) error {
+
+	info, err := sas.InspectPage(p)
+	if info == nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nPage %d at offset %d: type=%d (%s) blocks=%d subheaders=%d rows=%d",
+		info.Index, info.Offset, info.Type, info.TypeName, info.BlockCount, info.SubheaderCount, info.RowCount)
+	if info.DeletedRowCount > 0 {
+		fmt.Fprintf(w, " deleted=%d", info.DeletedRowCount)
+	}
+	if info.DataOffset >= 0 {
+		fmt.Fprintf(w, " data offset=%d padding=%d", info.DataOffset, info.AlignPadding)
+	}
+	fmt.Fprintf(w, "\n")
+	for i, sh := range info.Subheaders {
+		fmt.Fprintf(w, "  %4d offset=%d length=%d compression=%d type=%d signature=%x %s\n",
+			i, sh.Offset, sh.Length, sh.Compression, sh.Type, sh.Signature, sh.Kind)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "  error: %v\n", err)
+	}
+
+	if !dump {
+		return nil
+	}
+	page, err := sas.PageBytes(p)
+	if err != nil {
+		return err
+	}
+	prop := sas.Properties()
+	end := prop.PageBitOffset + 8 + len(info.Subheaders)*prop.SubheaderPointerLength
+	if end > len(page) {
+		end = len(page)
+	}
+	fmt.Fprintf(w, "\n  Page header and subheader pointers:\n")
+	hexDump(w, page[:end])
+	for i, sh := range info.Subheaders {
+		if noDump[sh.Kind] || sh.Offset < 0 || sh.Offset+sh.Length > len(page) {
+			continue
+		}
+		fmt.Fprintf(w, "\n  Subheader %d (%s):\n", i, sh.Kind)
+		hexDump(w, page[sh.Offset:sh.Offset+sh.Length])
+	}
+
+	return nil
+}
+
+func main() {
+
+	dump := flag.Bool("hex", false, "Include hex dumps of the file header, page headers and metadata subheaders")
+	names := flag.Bool("names", false, "Include the column names and labels")
+	first := flag.Int("first", 0, "The first page to print")
+	npage := flag.Int("pages", -1, "The number of pages to print, all pages if negative")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Printf("usage: %s [-hex] [-names] [-first=N] [-pages=N] file.sas7bdat\n", os.Args[0])
+		return
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	sas, err := datareader.NewSAS7BDATReader(f)
+	if err != nil {
+		// Print what can still be read
+		fmt.Printf("Open error:               %v\n", err)
+		sas, err = datareader.NewSAS7BDATReaderWithRecovery(f)
+		if err != nil {
+			sas, err = datareader.NewSAS7BDATInspector(f)
+		}
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+			os.Exit(1)
+		}
+	}
+
+	if err := dumpHeader(os.Stdout, sas, *names, *dump); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(1)
+	}
+
+	last := sas.Properties().PageCount
+	if *npage >= 0 && *first+*npage < last {
+		last = *first + *npage
+	}
+	for p := *first; p < last; p++ {
+		if err := dumpPage(os.Stdout, sas, p, *dump); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+			os.Exit(1)
+		}
+	}
+}
@@ -1,12 +1,23 @@
 package main
 
-// Convert a binary SAS7BDAT or Stata dta file to a CSV file.  The CSV
-// contents are sent to standard output.  Date variables are returned
-// as numeric values with interpretation depending on the date format
-// (e.g. it may be the number of days since January 1, 1960).
+// Convert a binary SAS7BDAT, SAS transport (xpt) or Stata dta file to
+// a CSV file.  The CSV contents are sent to standard output.  Date
+// variables are returned as numeric values with interpretation
+// depending on the date format (e.g. it may be the number of days
+// since January 1, 1960).
+//
+// If the -missingcodes flag is given, special missing values are
+// written using their codes (e.g. .R for the SAS missing value .R, or
+// .a for the Stata missing value .a).
+// Otherwise all missing values are written as empty fields.
+//
+// The strings of a SAS7BDAT file are decoded using the encoding in its
+// header.  The -encoding flag gives a SAS encoding name (e.g. utf-8)
+// to use instead, for files whose header gives the wrong encoding.
 
 import (
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"io"
 	"os"
@@ -16,7 +27,16 @@ import (
 	"github.com/kshedden/datareader"
 )
 
-func doConversion(rdr datareader.StatfileReader) {
+// missingString returns the text written for the missing value in
+// position i.
+func missingString(codes []byte, i int, writeCodes bool) string {
+	if !writeCodes || codes == nil || codes[i] == 0 {
+		return ""
+	}
+	return "." + string(codes[i])
+}
+
+func doConversion(rdr datareader.StatfileReader, writeCodes bool) {
 
 	w := csv.NewWriter(os.Stdout)
 
@@ -44,15 +64,20 @@ func doConversion(rdr datareader.StatfileReader) {
 		numbercols := make([][]float64, ncol)
 		stringcols := make([][]string, ncol)
 		timecols := make([][]time.Time, ncol)
+		durationcols := make([][]time.Duration, ncol)
 
 		missing := make([][]bool, ncol)
+		codes := make([][]byte, ncol)
 
 		for j := 0; j < ncol; j++ {
 			missing[j] = chunk[j].Missing()
+			codes[j] = chunk[j].MissingCodes()
 			dcol := chunk[j].Data()
 			switch dcol.(type) {
 			case []time.Time:
 				timecols[j] = dcol.([]time.Time)
+			case []time.Duration:
+				durationcols[j] = dcol.([]time.Duration)
 			case []float64:
 				numbercols[j] = dcol.([]float64)
 			case []string:
@@ -68,7 +93,7 @@ func doConversion(rdr datareader.StatfileReader) {
 					if missing[j] == nil || !missing[j][i] {
 						row[j] = fmt.Sprintf("%f", numbercols[j][i])
 					} else {
-						row[j] = ""
+						row[j] = missingString(codes[j], i, writeCodes)
 					}
 				} else if stringcols[j] != nil {
 					if missing[j] == nil || !missing[j][i] {
@@ -80,7 +105,13 @@ func doConversion(rdr datareader.StatfileReader) {
 					if missing[j] == nil || !missing[j][i] {
 						row[j] = fmt.Sprintf("%v", timecols[j][i])
 					} else {
-						row[j] = ""
+						row[j] = missingString(codes[j], i, writeCodes)
+					}
+				} else if durationcols[j] != nil {
+					if missing[j] == nil || !missing[j][i] {
+						row[j] = fmt.Sprintf("%v", durationcols[j][i])
+					} else {
+						row[j] = missingString(codes[j], i, writeCodes)
 					}
 				}
 			}
@@ -95,12 +126,16 @@ func doConversion(rdr datareader.StatfileReader) {
 
 func main() {
 
-	if len(os.Args) == 1 {
-		fmt.Printf("usage: %s filename\n", os.Args[0])
+	writeCodes := flag.Bool("missingcodes", false, "Write special missing values using their codes")
+	encoding := flag.String("encoding", "", "The SAS encoding of the strings, overriding the file header")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Printf("usage: %s [-missingcodes] [-encoding name] filename\n", os.Args[0])
 		return
 	}
 
-	fname := os.Args[1]
+	fname := flag.Arg(0)
 	f, err := os.Open(fname)
 	if err != nil {
 		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
@@ -115,18 +150,25 @@ func main() {
 		filetype = "sas"
 	} else if strings.HasSuffix(fl, "dta") {
 		filetype = "stata"
+	} else if strings.HasSuffix(fl, "xpt") {
+		filetype = "xport"
 	} else {
 		os.Stderr.WriteString(fmt.Sprintf("%s file cannot be read", fname))
 		return
 	}
 
-	// Get a reader for either a Stata or SAS file
+	// Get a reader for a Stata, SAS or SAS transport file
 	var rdr datareader.StatfileReader
 	if filetype == "sas" {
 		sas, err := datareader.NewSAS7BDATReader(f)
 		if err != nil {
 			panic(err)
 		}
+		if *encoding != "" {
+			if err := sas.SetEncoding(*encoding); err != nil {
+				panic(err)
+			}
+		}
 		sas.ConvertDates = true
 		sas.TrimStrings = true
 		rdr = sas
@@ -139,7 +181,15 @@ func main() {
 		stata.InsertCategoryLabels = true
 		stata.InsertStrls = true
 		rdr = stata
+	} else if filetype == "xport" {
+		xport, err := datareader.NewXPORTReader(f)
+		if err != nil {
+			panic(err)
+		}
+		xport.ConvertDates = true
+		xport.TrimStrings = true
+		rdr = xport
 	}
 
-	doConversion(rdr)
+	doConversion(rdr, *writeCodes)
 }
@@ -0,0 +1,288 @@
+package main
+
+// Convert a binary SAS7BDAT, SAS transport (xpt) or Stata dta file
+// to a version 5 SAS transport file.  The input is read twice,
+// first to determine the column types and string widths, then to
+// write the data.
+//
+// Column names, labels and formats are carried over from the input
+// file.  Stata date variables are written with the DATE9. or
+// DATETIME20. formats.  The transport format only allows column names
+// of at most 8 characters, labels of at most 40 characters and
+// strings of at most 200 bytes, an error is reported if the input
+// data do not fit within these limits.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kshedden/datareader"
+)
+
+// The number of rows read and written at a time
+const chunkSize = 10000
+
+// source is an open input file with the column metadata that is
+// carried over to the transport file.
+type source struct {
+	rdr     datareader.StatfileReader
+	labels  []string
+	formats []string
+	file    *os.File
+}
+
+// openSource opens the named file, choosing the reader from the file
+// name suffix.
+func openSource(fname string) (*source, error) {
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &source{file: f}
+	fl := strings.ToLower(fname)
+	switch {
+	case strings.HasSuffix(fl, "sas7bdat"):
+		sas, err := datareader.NewSAS7BDATReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		sas.TrimStrings = true
+		src.rdr = sas
+		src.labels = sas.ColumnLabels()
+		src.formats = sas.ColumnFormats
+	case strings.HasSuffix(fl, "dta"):
+		stata, err := datareader.NewStataReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		stata.ConvertDates = true
+		stata.InsertStrls = true
+		src.rdr = stata
+		src.labels = stata.ColumnNamesLong
+		src.formats = make([]string, len(stata.Formats))
+		for j, format := range stata.Formats {
+			switch {
+			case strings.HasPrefix(format, "%td"), strings.HasPrefix(format, "%d"):
+				src.formats[j] = "DATE9."
+			case strings.HasPrefix(format, "%tc"), strings.HasPrefix(format, "%tC"):
+				src.formats[j] = "DATETIME20."
+			}
+		}
+	case strings.HasSuffix(fl, "xpt"):
+		xport, err := datareader.NewXPORTReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		xport.TrimStrings = true
+		src.rdr = xport
+		src.labels = xport.ColumnLabels()
+		src.formats = xport.ColumnFormats
+	default:
+		f.Close()
+		return nil, fmt.Errorf("%s file cannot be read", fname)
+	}
+
+	return src, nil
+}
+
+// readChunk reads the next chunk of rows, returning nil at the end of
+// the data.
+func (src *source) readChunk() ([]*datareader.Series, error) {
+
+	chunk, err := src.rdr.Read(chunkSize)
+	if err == io.EOF || (err == nil && (len(chunk) == 0 || chunk[0].Length() == 0)) {
+		return nil, nil
+	}
+	return chunk, err
+}
+
+// isString returns true if the data type of a column read from the
+// file is string, and false if it is one of the numeric types that
+// can be written to a transport file.
+func isString(s *datareader.Series) (bool, error) {
+
+	switch s.Data().(type) {
+	case []string:
+		return true, nil
+	case []float64, []float32, []int64, []int32, []int16, []int8, []time.Time, []time.Duration:
+		return false, nil
+	default:
+		return false, fmt.Errorf("column %s has type %T, which cannot be written to a transport file", s.Name, s.Data())
+	}
+}
+
+// scanColumns reads all of the data to determine the type, string
+// width and format of each column.
+func scanColumns(src *source) ([]datareader.XPORTColumn, error) {
+
+	var columns []datareader.XPORTColumn
+	for {
+		chunk, err := src.readChunk()
+		if err != nil {
+			return nil, err
+		} else if chunk == nil {
+			break
+		}
+
+		if columns == nil {
+			columns = make([]datareader.XPORTColumn, len(chunk))
+			for j, s := range chunk {
+				columns[j].Name = s.Name
+				columns[j].Type = datareader.SASNumericType
+				if str, err := isString(s); err != nil {
+					return nil, err
+				} else if str {
+					columns[j].Type = datareader.SASStringType
+					columns[j].Length = 1
+				}
+				switch s.Data().(type) {
+				case []time.Time:
+					columns[j].Format = "DATETIME20."
+				case []time.Duration:
+					columns[j].Format = "TIME8."
+				}
+			}
+		}
+
+		for j, s := range chunk {
+			str, err := isString(s)
+			if err != nil {
+				return nil, err
+			}
+			if str != (columns[j].Type == datareader.SASStringType) {
+				return nil, fmt.Errorf("column %s changes type between chunks", s.Name)
+			}
+			if !str {
+				continue
+			}
+			for _, v := range s.Data().([]string) {
+				if len(v) > columns[j].Length {
+					columns[j].Length = len(v)
+				}
+			}
+		}
+	}
+
+	// With no rows the types are taken from the column metadata
+	if columns == nil {
+		names := src.rdr.ColumnNames()
+		types := src.rdr.ColumnTypes()
+		columns = make([]datareader.XPORTColumn, len(names))
+		for j := range names {
+			columns[j].Name = names[j]
+			columns[j].Type = datareader.SASNumericType
+			// SAS string columns have type 1, Stata string
+			// columns have their width as the type
+			t := types[j]
+			if t == datareader.StataStrlType || (t > 0 && t <= 2045) {
+				columns[j].Type = datareader.SASStringType
+				columns[j].Length = 1
+			}
+		}
+	}
+
+	for j := range columns {
+		if j < len(src.labels) {
+			columns[j].Label = src.labels[j]
+		}
+		if j < len(src.formats) && src.formats[j] != "" {
+			columns[j].Format = src.formats[j]
+		}
+	}
+
+	return columns, nil
+}
+
+func convert(infile, outfile, name, label string) error {
+
+	src, err := openSource(infile)
+	if err != nil {
+		return err
+	}
+	columns, err := scanColumns(src)
+	src.file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Check the columns before creating the output file
+	if _, err := datareader.NewXPORTWriter(nil, columns); err != nil {
+		return err
+	}
+
+	// Reopen the input to write the data
+	src, err = openSource(infile)
+	if err != nil {
+		return err
+	}
+	defer src.file.Close()
+
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	xw, _ := datareader.NewXPORTWriter(out, columns)
+	xw.Name = name
+	xw.Label = label
+
+	if err := writeData(src, xw); err != nil {
+		out.Close()
+		os.Remove(outfile)
+		return err
+	}
+	return out.Close()
+}
+
+// writeData copies all the rows from src to xw.
+func writeData(src *source, xw *datareader.XPORTWriter) error {
+
+	for {
+		chunk, err := src.readChunk()
+		if err != nil {
+			return err
+		} else if chunk == nil {
+			break
+		}
+		if err := xw.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return xw.Close()
+}
+
+func main() {
+
+	name := flag.String("name", "", "The data set name, by default the first 8 characters of the input file name")
+	label := flag.String("label", "", "The data set label")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		fmt.Printf("usage: %s [-name=NAME] [-label=LABEL] infile outfile.xpt\n", os.Args[0])
+		return
+	}
+	infile, outfile := flag.Arg(0), flag.Arg(1)
+
+	if *name == "" {
+		base := filepath.Base(infile)
+		*name = strings.ToUpper(strings.TrimSuffix(base, filepath.Ext(base)))
+		if len(*name) > 8 {
+			*name = (*name)[:8]
+		}
+	}
+
+	if err := convert(infile, outfile, *name, *label); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(1)
+	}
+}
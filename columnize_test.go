@@ -73,6 +73,9 @@ func columnizeBase(fname, mode string) [16]byte {
 		fmt.Sprintf("-out=%s", outpath),
 		fmt.Sprintf("-mode=%s", mode),
 	}
+	if utf8TestFiles[fname] {
+		args = append(args, "-encoding=utf-8")
+	}
 	cmd := exec.Command(cmdName, args...)
 	cmd.Stderr = os.Stderr
 	if _, err := cmd.Output(); err != nil {
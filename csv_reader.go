@@ -31,6 +31,10 @@ type CSVReader struct {
 	// The data type for each column.
 	DataTypes []string
 
+	// If not nil, Read returns an error instead of allocating more
+	// than the limit for the data that it returns.
+	Limits *ReadLimits
+
 	// Has the init method been run yet?
 	initRun bool
 
@@ -102,7 +106,8 @@ func (rdr *CSVReader) sniffTypes() {
 		if t != "infer" {
 			rdr.DataTypes[j] = t
 		} else {
-			if (nFloats[j] == nObs[j]) && (nObs[j] > 0) {
+			// The header may be wider than the data
+			if j < len(nFloats) && (nFloats[j] == nObs[j]) && (nObs[j] > 0) {
 				rdr.DataTypes[j] = "float64"
 			} else {
 				rdr.DataTypes[j] = "string"
@@ -224,6 +229,9 @@ func (rdr *CSVReader) Read(lines int) ([]*Series, error) {
 		rdr.miss[j] = make([]bool, 0, 100)
 	}
 
+	// The approximate number of bytes used for the data
+	var size int64
+
 	for {
 		if lines > 0 && rdr.numRows >= lines {
 			break
@@ -244,6 +252,14 @@ func (rdr *CSVReader) Read(lines int) ([]*Series, error) {
 			rdr.ensureWidth(len(line))
 		}
 
+		size += 17 * int64(len(rdr.ColumnNames))
+		for _, v := range line {
+			size += int64(len(v))
+		}
+		if rdr.Limits != nil && size > rdr.Limits.maxAlloc() {
+			return nil, fmt.Errorf("CSV data would use more than %d bytes", rdr.Limits.maxAlloc())
+		}
+
 		for j := range rdr.ColumnNames {
 			switch rdr.DataTypes[j] {
 			case "float64":
@@ -284,7 +300,7 @@ func (rdr *CSVReader) Read(lines int) ([]*Series, error) {
 		var err error
 		dataSeries[j], err = NewSeries(name, rdr.dataArray[j], rdr.miss[j])
 		if err != nil {
-			panic(fmt.Sprintf("%v", err))
+			return nil, err
 		}
 	}
 	return dataSeries, nil
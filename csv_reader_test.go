@@ -1,7 +1,9 @@
 package datareader
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -154,3 +156,25 @@ func TestRaggedCSV(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func FuzzCSV(f *testing.F) {
+
+	fnames, err := filepath.Glob(filepath.Join("test_files", "data", "*.csv"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fname := range fnames {
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte("a,b,c\n1\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		rdr := NewCSVReader(bytes.NewReader(b))
+		rdr.Limits = &ReadLimits{MaxAlloc: 1 << 24}
+		rdr.Read(-1)
+	})
+}
@@ -8,7 +8,8 @@ package datareader
 
 Package datareader reads binary datasets from the SAS and Stata
 commercial statistical packages.  The Stata dta file format is
-well-documented, and this code reads dta formats 115, 116, and 117.
+well-documented, and this code reads dta formats 102 to 105, 108,
+110 to 115, and 117 to 119.
 There is no official documentation of the SAS7BDAT format.  This code
 is based on previous efforts to reverse-engineer the format.
 
@@ -19,6 +20,10 @@ objects.  The SAS and Stata readers return the data as an array of
 Series objects, corresponding to the columns of the SAS or Stata
 dataset.
 
+SAS transport (XPORT) files, in the version 5 and version 8 formats,
+are read with an XPORTReader, and version 5 transport files are written
+with an XPORTWriter.
+
 The SAS and Stata objects behave similarly, and both satisfy the
 Statfilereader interface.  Both readers can read a file by chunks
 (ranges of consecutive records) to facilitate processing of extremely
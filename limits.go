@@ -0,0 +1,87 @@
+package datareader
+
+import (
+	"fmt"
+	"io"
+)
+
+// DefaultMaxAlloc is the allocation limit used by a hardened reader
+// if ReadLimits.MaxAlloc is zero.
+const DefaultMaxAlloc = 1 << 30
+
+// ReadLimits configures the hardened mode of the readers, which is
+// intended for reading files from untrusted sources.  In hardened
+// mode, every size that is read from a file (page sizes, column and
+// row counts, string lengths and so on) is checked against the size
+// of the file and against MaxAlloc before any memory is allocated
+// based on it, and an error is returned for sizes that are out of
+// range.
+type ReadLimits struct {
+
+	// The largest number of bytes that may be allocated for a
+	// single buffer, DefaultMaxAlloc if zero.  This includes the
+	// buffers allocated by each call to Read, so it also limits
+	// the number of rows that can be read at once.
+	MaxAlloc int64
+}
+
+// maxAlloc returns the allocation limit.
+func (limits *ReadLimits) maxAlloc() int64 {
+	if limits.MaxAlloc > 0 {
+		return limits.MaxAlloc
+	}
+	return DefaultMaxAlloc
+}
+
+// checkAlloc returns an error if count items of the given size in
+// bytes cannot be allocated within the limits.  A nil receiver
+// imposes no limit.
+func (limits *ReadLimits) checkAlloc(what string, count, size int64) error {
+
+	if count < 0 {
+		return fmt.Errorf("invalid %s count %d", what, count)
+	}
+	if limits == nil {
+		return nil
+	}
+	if size > 0 && count > limits.maxAlloc()/size {
+		return fmt.Errorf("%d %s would use more than %d bytes", count, what, limits.maxAlloc())
+	}
+	return nil
+}
+
+// checkSize returns an error if a region of the given size in bytes,
+// read from a file of size fileSize, cannot be present in the file or
+// allocated within the limits.  A nil receiver only rejects negative
+// sizes.
+func (limits *ReadLimits) checkSize(what string, size, fileSize int64) error {
+
+	if size < 0 {
+		return fmt.Errorf("invalid %s size %d", what, size)
+	}
+	if limits == nil {
+		return nil
+	}
+	if size > fileSize {
+		return fmt.Errorf("%s size %d is larger than the file (%d bytes)", what, size, fileSize)
+	}
+	return limits.checkAlloc(what, size, 1)
+}
+
+// streamSize returns the size of the data in r, leaving the position
+// of r unchanged.
+func streamSize(r io.Seeker) (int64, error) {
+
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,121 @@
+package datareader
+
+// Split a SAS7BDAT or Stata file into partitions that can be read
+// concurrently.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// NewSAS7BDATPartitions returns up to n readers for a SAS7BDAT file of
+// the given size, each of which reads a disjoint range of the rows.
+// The ranges consist of whole pages with roughly equal numbers of
+// rows, and are returned in file order, so concatenating the results
+// of reading each partition in turn gives the same data as reading
+// the file with a single reader.  Each reader reads from r
+// independently, so the readers can be used concurrently from
+// different goroutines.  Fewer than n readers are returned if the
+// file does not have enough pages.
+//
+// The page headers of the whole file are read to find the partition
+// boundaries.  The configuration fields must be set on each reader
+// before reading, and RowRange gives the rows read by each reader,
+// numbered by their position in the file including deleted rows, as
+// for SeekRow.
+func NewSAS7BDATPartitions(r io.ReaderAt, size int64, n int) ([]*SAS7BDAT, error) {
+
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of partitions %d", n)
+	}
+
+	first, err := NewSAS7BDATReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	// Index all the pages, then start each partition at the first
+	// page boundary after an equal share of the rows
+	bounds := []int{0}
+	if first.rowCount > 0 {
+		if _, err := first.findPage(first.rowCount - 1); err != nil {
+			return nil, first.decodeError(err, first.rowCount-1, "")
+		}
+		index := first.pageFirstRow
+		for k := 1; k < n; k++ {
+			target := k * first.rowCount / n
+			p := sort.Search(len(index), func(p int) bool { return index[p] >= target })
+			if p < len(index) && index[p] > bounds[len(bounds)-1] && index[p] < first.rowCount {
+				bounds = append(bounds, index[p])
+			}
+		}
+	}
+	bounds = append(bounds, first.rowCount)
+
+	parts := make([]*SAS7BDAT, len(bounds)-1)
+	for k := range parts {
+		sas := first
+		if k > 0 {
+			sas, err = NewSAS7BDATReader(io.NewSectionReader(r, 0, size))
+			if err != nil {
+				return nil, err
+			}
+			sas.pageFirstRow = append([]int(nil), first.pageFirstRow...)
+		}
+		if err := sas.SeekRow(bounds[k]); err != nil {
+			return nil, err
+		}
+		sas.firstRow, sas.endRow = bounds[k], bounds[k+1]
+		parts[k] = sas
+	}
+
+	return parts, nil
+}
+
+// NewStataPartitions returns up to n readers for a Stata dta file of
+// the given size, each of which reads a disjoint range of the rows.
+// The ranges have equal numbers of rows (up to rounding), and are
+// returned in file order, so concatenating the results of reading
+// each partition in turn gives the same data as reading the file
+// with a single reader.  Each reader reads from r independently, so
+// the readers can be used concurrently from different goroutines.
+// Fewer than n readers are returned if the file has fewer than n
+// rows.
+//
+// The configuration fields must be set on each reader before
+// reading, and RowRange gives the rows read by each reader.
+func NewStataPartitions(r io.ReaderAt, size int64, n int) ([]*StataReader, error) {
+
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of partitions %d", n)
+	}
+
+	first, err := NewStataReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+
+	nrow := first.rowCount
+	if n > nrow {
+		n = nrow
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	parts := make([]*StataReader, n)
+	for k := range parts {
+		rdr := first
+		if k > 0 {
+			rdr, err = NewStataReader(io.NewSectionReader(r, 0, size))
+			if err != nil {
+				return nil, err
+			}
+		}
+		rdr.firstRow, rdr.endRow = k*nrow/n, (k+1)*nrow/n
+		parts[k] = rdr
+	}
+
+	return parts, nil
+}
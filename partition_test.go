@@ -0,0 +1,168 @@
+package datareader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// readPartitions reads each partition concurrently, and checks that
+// the rows of each partition match the corresponding rows of all.
+func readPartitions(t *testing.T, name string, parts []StatfileReader, ranges [][2]int, all []*Series) {
+
+	results := make([][]*Series, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for k, rdr := range parts {
+		wg.Add(1)
+		go func(k int, rdr StatfileReader) {
+			defer wg.Done()
+			results[k], errs[k] = rdr.Read(-1)
+		}(k, rdr)
+	}
+	wg.Wait()
+
+	nrow := all[0].Length()
+	var next int
+	for k, ds := range results {
+		if errs[k] != nil {
+			t.Fatalf("%s: partition %d: %v", name, k, errs[k])
+		}
+		first, end := ranges[k][0], ranges[k][1]
+		if first != next || end <= first {
+			t.Fatalf("%s: partition %d has rows %d to %d, expected to start at %d", name, k, first, end, next)
+		}
+		next = end
+		for j := range ds {
+			expected := sliceTestSeries(all[j].UpcastNumeric(), first, end)
+			if f, i := ds[j].UpcastNumeric().AllEqual(expected); !f {
+				t.Errorf("%s: partition %d, column %d differs at row %d", name, k, j, first+i)
+			}
+		}
+		// Nothing is read past the end of the partition
+		if ds, err := parts[k].Read(1); err != io.EOF && (err != nil || len(ds) > 0) {
+			t.Errorf("%s: partition %d: read past the end, %v", name, k, err)
+		}
+	}
+	if next != nrow {
+		t.Errorf("%s: partitions end at row %d, expected %d", name, next, nrow)
+	}
+}
+
+func TestSASPartitions(t *testing.T) {
+
+	// A file with many pages
+	const n = 5000
+	x := make([]float64, n)
+	s := make([]string, n)
+	for i := range x {
+		x[i] = float64(i)
+		s[i] = fmt.Sprintf("row %d", i)
+	}
+	xs, _ := NewSeries("X", x, nil)
+	ss, _ := NewSeries("S", s, nil)
+	f := writeTestSAS(t, []SAS7BDATColumn{{Name: "X", Type: SASNumericType}, {Name: "S", Type: SASStringType, Length: 10}},
+		[]*Series{xs, ss}, 1000, func(sw *SAS7BDATWriter) { sw.PageLength = 4096 })
+	defer f.Close()
+	generated, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{"generated": generated}
+	for _, fname := range []string{"test1.sas7bdat", "test2.sas7bdat", "test16.sas7bdat"} {
+		files[fname], err = ioutil.ReadFile(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, b := range files {
+		sas, err := NewSAS7BDATReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.TrimStrings = true
+		all, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, np := range []int{1, 3, 7} {
+			parts, err := NewSAS7BDATPartitions(bytes.NewReader(b), int64(len(b)), np)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) > np || (name == "generated" && len(parts) != np) {
+				t.Errorf("%s: %d partitions, expected %d", name, len(parts), np)
+			}
+			readers := make([]StatfileReader, len(parts))
+			ranges := make([][2]int, len(parts))
+			for k, p := range parts {
+				p.TrimStrings = true
+				p.Workers = k % 2 * 2
+				readers[k] = p
+				ranges[k][0], ranges[k][1] = p.RowRange()
+			}
+			readPartitions(t, fmt.Sprintf("%s/%d", name, np), readers, ranges, all)
+		}
+	}
+
+	if _, err := NewSAS7BDATPartitions(bytes.NewReader(generated), int64(len(generated)), 0); err == nil {
+		t.Errorf("No error with zero partitions")
+	}
+}
+
+func TestStataPartitions(t *testing.T) {
+
+	fnames, err := filepath.Glob(filepath.Join("test_files", "data", "*.dta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fname := range fnames {
+		r, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		fi, err := r.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stata, err := NewStataReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := stata.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) == 0 || all[0].Length() == 0 {
+			continue
+		}
+
+		for _, np := range []int{1, 3, 100} {
+			parts, err := NewStataPartitions(r, fi.Size(), np)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) > np || len(parts) > all[0].Length() {
+				t.Errorf("%s: %d partitions", fname, len(parts))
+			}
+			readers := make([]StatfileReader, len(parts))
+			ranges := make([][2]int, len(parts))
+			for k, p := range parts {
+				readers[k] = p
+				ranges[k][0], ranges[k][1] = p.RowRange()
+			}
+			readPartitions(t, fmt.Sprintf("%s/%d", filepath.Base(fname), np), readers, ranges, all)
+		}
+	}
+}
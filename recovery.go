@@ -0,0 +1,74 @@
+package datareader
+
+// Recover the intact rows from truncated or damaged SAS7BDAT and
+// Stata files.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ByteRange is a range of positions in a file, from Start up to but
+// not including End.
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// RecoveryReport describes the data that have been recovered from a
+// damaged file, by a reader created with NewSAS7BDATReaderWithRecovery
+// or NewStataReaderWithRecovery.
+type RecoveryReport struct {
+
+	// The number of rows in the data set, as given by RowCount
+	RowCount int
+
+	// The number of intact rows that have been returned by Read
+	RowsRecovered int
+
+	// The parts of the file that could not be read, in the order
+	// they were found.  This includes the missing end of a
+	// truncated file, which extends to the file size given in the
+	// file header.
+	Unreadable []ByteRange
+}
+
+// addRange records an unreadable range, merging it with the previous
+// range if they overlap or are adjacent.
+func (report *RecoveryReport) addRange(start, end int64) {
+
+	if end <= start {
+		return
+	}
+	if n := len(report.Unreadable); n > 0 {
+		last := &report.Unreadable[n-1]
+		if start <= last.End && end >= last.Start {
+			if start < last.Start {
+				last.Start = start
+			}
+			if end > last.End {
+				last.End = end
+			}
+			return
+		}
+	}
+	report.Unreadable = append(report.Unreadable, ByteRange{start, end})
+}
+
+// String returns a summary of the report.
+func (report RecoveryReport) String() string {
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("recovered %d of %d rows", report.RowsRecovered, report.RowCount))
+	if len(report.Unreadable) == 0 {
+		return b.String()
+	}
+	b.WriteString(", unreadable bytes")
+	for k, r := range report.Unreadable {
+		if k > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(fmt.Sprintf(" %d-%d", r.Start, r.End))
+	}
+	return b.String()
+}
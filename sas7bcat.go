@@ -0,0 +1,466 @@
+package datareader
+
+// Read SAS format catalogs (sas7bcat files) with go.
+//
+// The layout of the catalog files follows the ReadStat library:
+// https://github.com/WizardMac/ReadStat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	xencoding "golang.org/x/text/encoding"
+)
+
+// SAS7BCAT represents a SAS format catalog in sas7bcat format,
+// holding the user-defined formats created by PROC FORMAT.
+type SAS7BCAT struct {
+
+	// The formats defined in the catalog, keyed by upper case
+	// format name.  The names of character formats begin with '$'.
+	Formats map[string]*SASFormat
+
+	// The encoding name, as stored in the file header
+	FileEncoding string
+
+	// Byte order of the file
+	ByteOrder binary.ByteOrder
+
+	// If true, the catalog has 64 bit layout
+	U64 bool
+
+	file         io.ReadSeeker
+	decoder      *xencoding.Decoder
+	headerLength int
+	pageLength   int
+	pageCount    int
+	pad1         int
+}
+
+// SASFormat is a user-defined SAS format, mapping values to labels.
+type SASFormat struct {
+
+	// The format name, beginning with '$' for character formats
+	Name string
+
+	// True for character formats, false for numeric formats
+	Character bool
+
+	// The entries of the format, in the order stored in the catalog
+	Ranges []SASFormatRange
+}
+
+// SASFormatRange is a single entry of a user-defined SAS format.  As
+// in the ReadStat library, only the start of the range of each entry
+// is read from the catalog, so an entry covers a single value.  The
+// end of a range and the LOW, HIGH and OTHER keywords are not read.
+type SASFormatRange struct {
+
+	// The numeric value covered by the entry, which is the start of
+	// the range if the entry was defined with a range
+	Start float64
+
+	// If true, the entry applies to a missing value, identified by
+	// MissingCode ('A'-'Z' or '_', or zero for the standard missing
+	// value).
+	Missing     bool
+	MissingCode byte
+
+	// The value covered by the entry of a character format
+	Value string
+
+	// The formatted value
+	Label string
+}
+
+// Label returns the label for a numeric value, and false if no
+// entry of the format covers the value.
+func (f *SASFormat) Label(x float64) (string, bool) {
+
+	if math.IsNaN(x) {
+		code := sasMissingCode(x)
+		for _, r := range f.Ranges {
+			if r.Missing && r.MissingCode == code {
+				return r.Label, true
+			}
+		}
+		return "", false
+	}
+
+	for _, r := range f.Ranges {
+		if !r.Missing && r.Start == x {
+			return r.Label, true
+		}
+	}
+	return "", false
+}
+
+// StringLabel returns the label for a character value, and false if
+// no entry of the format covers the value.  Trailing whitespace is
+// ignored.
+func (f *SASFormat) StringLabel(s string) (string, bool) {
+
+	s = strings.TrimRight(s, " \000")
+	for _, r := range f.Ranges {
+		if r.Value == s {
+			return r.Label, true
+		}
+	}
+	return "", false
+}
+
+// Format returns the format with the given name, or nil if the
+// catalog does not define the format.  The name is not case
+// sensitive, and any width and decimal specification (e.g. the "8."
+// in "SEXFMT8.") is ignored, so the values of
+// SAS7BDAT.ColumnFormats can be used directly.
+func (cat *SAS7BCAT) Format(name string) *SASFormat {
+	name = baseFormatName(name, func(name string) bool {
+		_, ok := cat.Formats[name]
+		return ok
+	})
+	return cat.Formats[name]
+}
+
+// NewSAS7BCATReader reads all the formats from a SAS format catalog.
+func NewSAS7BCATReader(r io.ReadSeeker) (*SAS7BCAT, error) {
+
+	// The catalog header has the same layout as the SAS7BDAT
+	// header.
+	hdr := new(SAS7BDAT)
+	hdr.file = r
+	if err := hdr.getProperties(); err != nil {
+		return nil, err
+	}
+
+	cat := &SAS7BCAT{
+		Formats:      make(map[string]*SASFormat),
+		FileEncoding: hdr.FileEncoding,
+		ByteOrder:    hdr.ByteOrder,
+		U64:          hdr.U64,
+		file:         r,
+		decoder:      hdr.fileDecoder,
+		headerLength: hdr.properties.headerLength,
+		pageLength:   hdr.properties.pageLength,
+		pageCount:    hdr.properties.pageCount,
+	}
+	if cat.U64 {
+		cat.pad1 = 4
+	}
+
+	pointers, err := cat.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pointers {
+		block, err := cat.readBlock(p.page, p.pos)
+		if err != nil {
+			return nil, err
+		}
+		f, err := cat.parseBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			cat.Formats[strings.ToUpper(f.Name)] = f
+		}
+	}
+
+	return cat, nil
+}
+
+// catalogPointer gives the position of a block in the catalog, where
+// the pages are numbered from 1.
+type catalogPointer struct {
+	page, pos int
+}
+
+// readIndex returns the positions of the format blocks, which are
+// listed in the XLSR records on the first page and on any later page
+// that starts with XLSR records.
+func (cat *SAS7BCAT) readIndex() ([]catalogPointer, error) {
+
+	xlsrSize := 212 + cat.pad1
+	xlsrOffset := 856 + 2*cat.pad1
+	xlsrOOffset := 50 + cat.pad1
+	if cat.U64 {
+		xlsrSize += 72
+		xlsrOffset += 144
+		xlsrOOffset += 24
+	}
+
+	if cat.pageLength < xlsrOffset {
+		return nil, fmt.Errorf("catalog page length %d is too small", cat.pageLength)
+	}
+
+	var pointers []catalogPointer
+	page := make([]byte, cat.pageLength)
+	for i := 0; i < cat.pageCount; i++ {
+		if err := cat.readAt(page, cat.headerLength+i*cat.pageLength); err != nil {
+			return nil, err
+		}
+		var index []byte
+		if i == 0 {
+			index = page[xlsrOffset:]
+		} else if bytes.HasPrefix(page[16:], []byte("XLSR")) {
+			index = page[16:]
+		} else {
+			continue
+		}
+
+		for len(index) >= xlsrSize {
+			if !bytes.HasPrefix(index, []byte("XLSR")) {
+				// Some records are preceded by 8 bytes of padding
+				index = index[8:]
+				if len(index) < xlsrSize || !bytes.HasPrefix(index, []byte("XLSR")) {
+					break
+				}
+			}
+			if index[xlsrOOffset] == 'O' {
+				var p catalogPointer
+				if cat.U64 {
+					p.page = cat.readUint(index[4:12])
+					p.pos = cat.readUint(index[12:14])
+				} else {
+					p.page = cat.readUint(index[4:8])
+					p.pos = cat.readUint(index[8:10])
+				}
+				pointers = append(pointers, p)
+			}
+			index = index[xlsrSize:]
+		}
+	}
+
+	sort.Slice(pointers, func(i, j int) bool {
+		if pointers[i].page != pointers[j].page {
+			return pointers[i].page < pointers[j].page
+		}
+		return pointers[i].pos < pointers[j].pos
+	})
+
+	// Remove duplicates
+	var rslt []catalogPointer
+	for i, p := range pointers {
+		if i == 0 || p != pointers[i-1] {
+			rslt = append(rslt, p)
+		}
+	}
+
+	return rslt, nil
+}
+
+// readBlock returns the data of a block, which is stored as a chain
+// of links that may span several pages.  Each link has a header
+// giving the position of the next link and the length of the data
+// in the current link.
+func (cat *SAS7BCAT) readBlock(page, pos int) ([]byte, error) {
+
+	headerLength := 16
+	if cat.U64 {
+		headerLength = 32
+	}
+
+	var block []byte
+	header := make([]byte, headerLength)
+	for links := 0; page > 0 && pos > 0; links++ {
+		if page > cat.pageCount || pos+headerLength > cat.pageLength || links >= cat.pageCount {
+			return nil, fmt.Errorf("invalid catalog block position (page %d, offset %d)", page, pos)
+		}
+		offset := cat.headerLength + (page-1)*cat.pageLength + pos
+		if err := cat.readAt(header, offset); err != nil {
+			return nil, err
+		}
+
+		var length int
+		if cat.U64 {
+			page = cat.readUint(header[0:4])
+			pos = cat.readUint(header[8:10])
+			length = cat.readUint(header[10:12])
+		} else {
+			page = cat.readUint(header[0:4])
+			pos = cat.readUint(header[4:6])
+			length = cat.readUint(header[6:8])
+		}
+
+		data := make([]byte, length)
+		if err := cat.readAt(data, offset+headerLength); err != nil {
+			return nil, err
+		}
+		block = append(block, data...)
+	}
+
+	return block, nil
+}
+
+// parseBlock returns the format stored in a block, or nil if the
+// format has no entries.
+func (cat *SAS7BCAT) parseBlock(block []byte) (*SASFormat, error) {
+
+	payloadOffset := 106
+	if cat.U64 {
+		payloadOffset += 32
+	}
+	if len(block) < payloadOffset {
+		return nil, nil
+	}
+
+	flags := cat.readUint(block[2:4])
+	pad := 0
+	if flags&0x08 != 0 {
+		pad = 4
+	}
+
+	var capacity, used int
+	if cat.U64 {
+		capacity = cat.readUint(block[42+pad : 50+pad])
+		used = cat.readUint(block[50+pad : 58+pad])
+	} else {
+		capacity = cat.readUint(block[38+pad : 42+pad])
+		used = cat.readUint(block[42+pad : 46+pad])
+	}
+
+	name := cat.decode(block[8:16])
+	if pad != 0 {
+		pad += 16
+	}
+	if (!cat.U64 && flags&0x80 != 0) || (cat.U64 && flags&0x20 != 0) {
+		// The format has a long name
+		if len(block) < payloadOffset+pad+32 {
+			return nil, fmt.Errorf("catalog block for format %s is truncated", name)
+		}
+		name = cat.decode(block[payloadOffset+pad : payloadOffset+pad+32])
+		pad += 32
+	}
+
+	if used == 0 || len(block) < payloadOffset+pad {
+		return nil, nil
+	}
+	if used > capacity {
+		return nil, fmt.Errorf("format %s has %d entries but room for only %d", name, used, capacity)
+	}
+	values := block[payloadOffset+pad:]
+
+	// Each entry has a value of at least 30 bytes and a label of at
+	// least 10 bytes
+	if used > len(values)/40 {
+		return nil, fmt.Errorf("format %s has %d entries, more than fit in the %d byte block", name, used, len(block))
+	}
+
+	f := &SASFormat{
+		Name:      name,
+		Character: strings.HasPrefix(name, "$"),
+		Ranges:    make([]SASFormatRange, used),
+	}
+
+	// The value entries are followed by the labels.  Each value
+	// entry gives the position of its label.
+	entries := make([][]byte, used)
+	p := 0
+	for i := 0; i < capacity; i++ {
+		if p+4 > len(values) {
+			return nil, fmt.Errorf("format %s: value entry %d is truncated", name, i)
+		}
+		n := 6 + cat.readUint(values[p+2:p+4])
+		if p+n > len(values) {
+			return nil, fmt.Errorf("format %s: value entry %d is truncated", name, i)
+		}
+		if i < used {
+			if n < 30 {
+				return nil, fmt.Errorf("format %s: value entry %d is too short", name, i)
+			}
+			j := cat.readUint(values[p+10+cat.pad1 : p+14+cat.pad1])
+			if j >= used || entries[j] != nil {
+				return nil, fmt.Errorf("format %s: invalid label position %d", name, j)
+			}
+			entries[j] = values[p : p+n]
+		}
+		p += n
+	}
+
+	labels := values[p:]
+	for j, entry := range entries {
+		if entry == nil {
+			return nil, fmt.Errorf("format %s: no value for label %d", name, j)
+		}
+		if len(labels) < 10 {
+			return nil, fmt.Errorf("format %s: label %d is truncated", name, j)
+		}
+		n := cat.readUint(labels[8:10])
+		if len(labels) < 10+n {
+			return nil, fmt.Errorf("format %s: label %d is truncated", name, j)
+		}
+
+		r := &f.Ranges[j]
+		r.Label = cat.decode(labels[10 : 10+n])
+		if f.Character {
+			r.Value = cat.decode(entry[len(entry)-16:])
+		} else {
+			// The values are always big endian
+			r.Start, r.Missing, r.MissingCode = catalogValue(entry[22:30])
+		}
+
+		labels = labels[min(len(labels), 11+n):]
+	}
+
+	return f, nil
+}
+
+// catalogValue decodes a numeric value from a format catalog.  The
+// value is stored negated and in big endian order.  Missing values
+// are stored with the tag in the sixth byte and the lower five bytes
+// set to 0xFF.  Unlike the data files, the tag is zero for the
+// standard missing value and the letter itself ('A' to 'Z', or '_')
+// for a special missing value.
+func catalogValue(b []byte) (float64, bool, byte) {
+
+	u := binary.BigEndian.Uint64(b)
+	if u|0xFF0000000000 == 0xFFFFFFFFFFFF {
+		return math.NaN(), true, byte(u >> 40)
+	}
+	return -math.Float64frombits(u), false, 0
+}
+
+// readAt fills buf with the file contents starting at offset.
+func (cat *SAS7BCAT) readAt(buf []byte, offset int) error {
+
+	if _, err := cat.file.Seek(int64(offset), 0); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(cat.file, buf); err != nil {
+		return fmt.Errorf("unable to read %d bytes from catalog position %d: %v", len(buf), offset, err)
+	}
+	return nil
+}
+
+// readUint reads an unsigned integer of width 2, 4 or 8 bytes.
+func (cat *SAS7BCAT) readUint(b []byte) int {
+
+	switch len(b) {
+	case 2:
+		return int(cat.ByteOrder.Uint16(b))
+	case 4:
+		return int(cat.ByteOrder.Uint32(b))
+	case 8:
+		return int(cat.ByteOrder.Uint64(b))
+	default:
+		panic(fmt.Sprintf("invalid integer width %d", len(b)))
+	}
+}
+
+// decode converts a padded string from the catalog to UTF-8.
+func (cat *SAS7BCAT) decode(b []byte) string {
+
+	b = bytes.TrimRight(b, " \000")
+	if cat.decoder != nil {
+		if d, err := cat.decoder.Bytes(b); err == nil {
+			b = d
+		}
+	}
+	return string(b)
+}
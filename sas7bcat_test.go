@@ -0,0 +1,417 @@
+package datareader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// buildTestCatalog returns a format catalog holding the given
+// formats.  The file header is taken from a SAS7BDAT test file, which
+// has the same layout.  Each format block is split into two links on
+// consecutive pages.
+func buildTestCatalog(t *testing.T, u64 bool, formats []*SASFormat) []byte {
+
+	fname := "test1.sas7bdat"
+	if u64 {
+		fname = "test7.sas7bdat"
+	}
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", fname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sas.U64 != u64 {
+		t.Fatalf("%s has unexpected layout", fname)
+	}
+	bo := binary.LittleEndian
+	if sas.ByteOrder != bo {
+		t.Fatalf("%s is not little endian", fname)
+	}
+
+	var align1, pad1 int
+	if raw[align_2_offset] == align_1_checker_value {
+		align1 = 4
+	}
+	xlsrSize, xlsrOffset, xlsrOOffset := 212, 856, 50
+	chainHeader, payloadOffset, longNameFlag := 16, 106, 0x80
+	if u64 {
+		pad1 = 4
+		xlsrSize, xlsrOffset, xlsrOOffset = 288, 1008, 78
+		chainHeader, payloadOffset, longNameFlag = 32, 138, 0x20
+	}
+
+	const pageLength = 4096
+	pageCount := 1 + 2*len(formats)
+	header := make([]byte, sas.properties.headerLength)
+	copy(header, raw)
+	bo.PutUint32(header[page_size_offset+align1:], pageLength)
+	if u64 {
+		bo.PutUint64(header[page_count_offset+align1:], uint64(pageCount))
+	} else {
+		bo.PutUint32(header[page_count_offset+align1:], uint32(pageCount))
+	}
+	pages := make([]byte, pageCount*pageLength)
+
+	// A missing value is stored with its letter as the tag, or zero
+	// for the standard missing value
+	putValue := func(b []byte, x float64, missing bool, code byte) {
+		if !missing {
+			binary.BigEndian.PutUint64(b, math.Float64bits(-x))
+			return
+		}
+		binary.BigEndian.PutUint64(b, uint64(code)<<40|0xFFFFFFFFFF)
+	}
+
+	for i, f := range formats {
+
+		// The value entries are stored in reverse order, followed
+		// by an unused entry, then the labels.
+		var entries, labels []byte
+		for j := len(f.Ranges) - 1; j >= 0; j-- {
+			r := f.Ranges[j]
+			n := 30
+			if f.Character {
+				n = 14 + pad1 + 16
+			}
+			entry := make([]byte, n)
+			bo.PutUint16(entry[2:], uint16(n-6))
+			bo.PutUint32(entry[10+pad1:], uint32(j))
+			if f.Character {
+				copy(entry[n-16:], []byte(r.Value+"                "))
+			} else {
+				putValue(entry[22:30], r.Start, r.Missing, r.MissingCode)
+			}
+			entries = append(entries, entry...)
+		}
+		unused := make([]byte, 30)
+		bo.PutUint16(unused[2:], 24)
+		entries = append(entries, unused...)
+		for _, r := range f.Ranges {
+			lbl := make([]byte, 11+len(r.Label))
+			bo.PutUint16(lbl[8:], uint16(len(r.Label)))
+			copy(lbl[10:], r.Label)
+			labels = append(labels, lbl...)
+		}
+
+		block := make([]byte, payloadOffset)
+		copy(block[8:16], []byte(f.Name+"        "))
+		if len(f.Name) > 8 {
+			bo.PutUint16(block[2:], uint16(longNameFlag))
+			name := make([]byte, 32)
+			copy(name, []byte(f.Name+"                                "))
+			block = append(block, name...)
+		}
+		if u64 {
+			bo.PutUint64(block[42:], uint64(len(f.Ranges)+1))
+			bo.PutUint64(block[50:], uint64(len(f.Ranges)))
+		} else {
+			bo.PutUint32(block[38:], uint32(len(f.Ranges)+1))
+			bo.PutUint32(block[42:], uint32(len(f.Ranges)))
+		}
+		block = append(block, entries...)
+		block = append(block, labels...)
+
+		// Write the two links, at offset 64 of pages 2+2i and 3+2i
+		// (numbered from 1).
+		page := 2 + 2*i
+		m := len(block) / 2
+		for k, link := range [][]byte{block[0:m], block[m:]} {
+			p := pages[(page-1+k)*pageLength+64:]
+			if k == 0 {
+				bo.PutUint32(p[0:], uint32(page+1))
+				if u64 {
+					bo.PutUint16(p[8:], 64)
+				} else {
+					bo.PutUint16(p[4:], 64)
+				}
+			}
+			if u64 {
+				bo.PutUint16(p[10:], uint16(len(link)))
+			} else {
+				bo.PutUint16(p[6:], uint16(len(link)))
+			}
+			copy(p[chainHeader:], link)
+		}
+
+		// The index record on the first page
+		xlsr := pages[xlsrOffset+i*xlsrSize:]
+		copy(xlsr, "XLSR")
+		if u64 {
+			bo.PutUint64(xlsr[4:], uint64(page))
+			bo.PutUint16(xlsr[12:], 64)
+		} else {
+			bo.PutUint32(xlsr[4:], uint32(page))
+			bo.PutUint16(xlsr[8:], 64)
+		}
+		xlsr[xlsrOOffset] = 'O'
+	}
+
+	return append(header, pages...)
+}
+
+// testCatalogFormats returns the formats used to test the catalog
+// reader.
+func testCatalogFormats() []*SASFormat {
+
+	return []*SASFormat{
+		{
+			Name: "SIZEFMT",
+			Ranges: []SASFormatRange{
+				{Start: 15, Label: "small"},
+				{Start: 49, Label: "medium"},
+				{Start: 84, Label: "large"},
+				{Start: -1, Label: "negative one"},
+				{Missing: true, Label: "not measured"},
+				{Missing: true, MissingCode: 'R', Label: "refused"},
+			},
+		},
+		{
+			Name:      "$FRUITFMT",
+			Character: true,
+			Ranges: []SASFormatRange{
+				{Value: "pear", Label: "Pear"},
+				{Value: "apple", Label: "Apple"},
+			},
+		},
+		{
+			Name: "ANSWERFMT",
+			Ranges: []SASFormatRange{
+				{Start: 1, Label: "Yes"},
+				{Start: 2, Label: "No"},
+			},
+		},
+		{
+			Name: "ANSWER2",
+			Ranges: []SASFormatRange{
+				{Start: 1, Label: "Y"},
+				{Start: 2, Label: "N"},
+			},
+		},
+	}
+}
+
+func TestSAS7BCAT(t *testing.T) {
+
+	for _, u64 := range []bool{false, true} {
+
+		formats := testCatalogFormats()
+		buf := buildTestCatalog(t, u64, formats)
+		cat, err := NewSAS7BCATReader(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cat.U64 != u64 {
+			t.Errorf("U64 is %v, expected %v", cat.U64, u64)
+		}
+		if len(cat.Formats) != len(formats) {
+			t.Fatalf("Read %d formats, expected %d", len(cat.Formats), len(formats))
+		}
+
+		for _, f := range formats {
+			g := cat.Format(f.Name)
+			if g == nil {
+				t.Errorf("Format %s not found", f.Name)
+				continue
+			}
+			if g.Name != f.Name || g.Character != f.Character || len(g.Ranges) != len(f.Ranges) {
+				t.Errorf("Format %s read incorrectly", f.Name)
+				continue
+			}
+			for j, r := range f.Ranges {
+				s := g.Ranges[j]
+				if r.Missing {
+					if !s.Missing || !math.IsNaN(s.Start) || s.MissingCode != r.MissingCode || s.Label != r.Label {
+						t.Errorf("Format %s entry %d read incorrectly", f.Name, j)
+					}
+				} else if s != r {
+					t.Errorf("Format %s entry %d is %+v, expected %+v", f.Name, j, s, r)
+				}
+			}
+		}
+
+		if cat.Format("sizefmt8.") == nil || cat.Format("$fruitfmt") == nil {
+			t.Errorf("Format names should not be case sensitive")
+		}
+		if cat.Format("NOSUCHFMT") != nil || cat.Format("ANSWER") != nil {
+			t.Errorf("Unknown format found")
+		}
+		if f := cat.Format("ANSWER25."); f == nil || f.Name != "ANSWER2" {
+			t.Errorf("Format ANSWER25. should be ANSWER2 with width 5")
+		}
+
+		f := cat.Format("SIZEFMT")
+		for _, tc := range []struct {
+			x     float64
+			label string
+			ok    bool
+		}{
+			{15, "small", true},
+			{49, "medium", true},
+			{49.5, "", false},
+			{84, "large", true},
+			{-1, "negative one", true},
+			{-2, "", false},
+			{math.NaN(), "not measured", true},
+			{math.Float64frombits(0xFFFFAD0000000000), "refused", true},
+			{math.Float64frombits(0xFFFFBE0000000000), "", false},
+		} {
+			label, ok := f.Label(tc.x)
+			if label != tc.label || ok != tc.ok {
+				t.Errorf("Label for %v is %q, %v; expected %q, %v", tc.x, label, ok, tc.label, tc.ok)
+			}
+		}
+
+		g := cat.Format("$FRUITFMT")
+		if v, ok := g.StringLabel("apple   "); !ok || v != "Apple" {
+			t.Errorf("Incorrect label for character value")
+		}
+		if _, ok := g.StringLabel("dog"); ok {
+			t.Errorf("Unexpected label for character value")
+		}
+	}
+}
+
+// TestSAS7BCATErrors checks that a catalog with an invalid page length
+// or entry count is rejected.
+func TestSAS7BCATErrors(t *testing.T) {
+
+	formats := testCatalogFormats()
+	buf := buildTestCatalog(t, false, formats)
+	headerLength := len(buf) - (1+2*len(formats))*4096
+
+	// The entry counts of the first block, which starts after the
+	// 16 byte link header at offset 64 of the second page
+	bad := append([]byte(nil), buf...)
+	block := bad[headerLength+4096+64+16:]
+	binary.LittleEndian.PutUint32(block[38:], 1<<30)
+	binary.LittleEndian.PutUint32(block[42:], 1<<30)
+	if _, err := NewSAS7BCATReader(bytes.NewReader(bad)); err == nil {
+		t.Errorf("No error reading a format with too many entries")
+	}
+
+	bad = append([]byte(nil), buf...)
+	binary.LittleEndian.PutUint32(bad[page_size_offset:], 8)
+	if _, err := NewSAS7BCATReader(bytes.NewReader(bad)); err == nil {
+		t.Errorf("No error reading a catalog with 8 byte pages")
+	}
+}
+
+// TestCatalogValue checks the decoding of numeric values stored in a
+// format catalog, which have a different layout for missing values
+// than the data files.
+func TestCatalogValue(t *testing.T) {
+
+	for _, tc := range []struct {
+		b       []byte
+		x       float64
+		missing bool
+		code    byte
+	}{
+		{[]byte{0xBF, 0xF0, 0, 0, 0, 0, 0, 0}, 1, false, 0},
+		{[]byte{0x40, 0x59, 0, 0, 0, 0, 0, 0}, -100, false, 0},
+		{[]byte{0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 0, true, 0},
+		{[]byte{0, 0, 'A', 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 0, true, 'A'},
+		{[]byte{0, 0, 'Z', 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 0, true, 'Z'},
+		{[]byte{0, 0, '_', 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 0, true, '_'},
+	} {
+		x, missing, code := catalogValue(tc.b)
+		if missing != tc.missing || code != tc.code || (!missing && x != tc.x) || (missing && !math.IsNaN(x)) {
+			t.Errorf("Value % X read as %v, %v, %q", tc.b, x, missing, code)
+		}
+	}
+}
+
+func TestSASFormatCatalog(t *testing.T) {
+
+	cat, err := NewSAS7BCATReader(bytes.NewReader(buildTestCatalog(t, false, testCatalogFormats())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas.TrimStrings = true
+	plain, err := sas.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, factorize := range []bool{false, true} {
+		sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.TrimStrings = true
+		sas.FactorizeStrings = factorize
+		sas.FormatCatalog = cat
+
+		// Column 2 holds strings and column 3 holds integers.
+		sas.ColumnFormats[1] = "$FRUITFMT."
+		sas.ColumnFormats[2] = "SIZEFMT3."
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, xmiss := plain[2].Data().([]float64), plain[2].Missing()
+		labels, ok := ds[2].Data().([]string)
+		if !ok {
+			t.Fatalf("Formatted numeric column has type %T", ds[2].Data())
+		}
+		for i := range x {
+			var expected string
+			switch {
+			case xmiss[i]:
+				expected = "not measured"
+			case x[i] == 15:
+				expected = "small"
+			case x[i] == 49:
+				expected = "medium"
+			case x[i] == 84:
+				expected = "large"
+			default:
+				expected = fmt.Sprintf("%v", x[i])
+			}
+			if labels[i] != expected || ds[2].Missing()[i] {
+				t.Errorf("Label in row %d is %q, expected %q", i, labels[i], expected)
+			}
+		}
+
+		s := plain[1].Data().([]string)
+		labels, ok = ds[1].Data().([]string)
+		if !ok {
+			t.Fatalf("Formatted string column has type %T", ds[1].Data())
+		}
+		for i := range s {
+			expected := s[i]
+			switch s[i] {
+			case "pear":
+				expected = "Pear"
+			case "apple":
+				expected = "Apple"
+			}
+			if labels[i] != expected {
+				t.Errorf("Label in row %d is %q, expected %q", i, labels[i], expected)
+			}
+		}
+
+		// Columns without a format in the catalog are not changed
+		if f, _ := ds[0].AllEqual(plain[0]); !f {
+			t.Errorf("Column without user-defined format was changed")
+		}
+	}
+}
@@ -18,24 +18,33 @@ import (
 	"io"
 	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	xencoding "golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
 )
 
 // SAS7BDAT represents a SAS data file in SAS7BDAT format.
 type SAS7BDAT struct {
 
-	// Formats for the columns
+	// Formats for the columns (only the selected columns if
+	// SelectColumns has been called)
 	ColumnFormats []string
 
 	// If true, trim whitespace from right of each string variable
 	// (SAS7BDAT strings are fixed width)
 	TrimStrings bool
 
-	// If true, converts some date formats to Go date values (does
-	// not work for all SAS date formats)
+	// If true, columns with SAS date and datetime formats are
+	// converted to Go time.Time values, and columns with SAS time
+	// formats are converted to time.Duration values.  Additional
+	// format names can be registered with RegisterSASDateFormat.
 	ConvertDates bool
 
 	// If true, strings are represented as uint64 values.  Call
@@ -43,11 +52,49 @@ type SAS7BDAT struct {
 	// coded values to the actual strings that they represent.
 	FactorizeStrings bool
 
+	// If true, the string codes produced when FactorizeStrings is
+	// set are kept for the whole file, instead of being reassigned
+	// by each call to Read.  The map returned by StringFactorMap
+	// then grows as new strings are read.
+	StableStringFactors bool
+
+	// If true, the strings in each column are coded separately,
+	// and the codes are obtained by calling ColumnStringFactorMap.
+	FactorizePerColumn bool
+
+	// If positive and StableStringFactors is set, limits the
+	// number of distinct strings in a dictionary.  When a call to
+	// Read takes a dictionary over this limit, the dictionary is
+	// no longer extended, and the columns using it are returned as
+	// strings instead of codes from that call on.  Codes that have
+	// already been returned remain valid.
+	MaxStringFactors int
+
+	// If true, string columns are returned as [][]byte values
+	// holding the bytes stored in the file, without decoding the
+	// text or factorizing.  The values of a column returned by
+	// one call to Read share a single buffer.  TrimStrings still
+	// applies, and columns with a user-defined format in
+	// FormatCatalog are returned as formatted strings.
+	RawStrings bool
+
+	// If true, rows that have been deleted from the data set are
+	// returned, and a numeric column named _DELETED_ is appended,
+	// holding 1 for deleted rows and 0 for other rows.  By default,
+	// deleted rows are skipped.
+	IncludeDeleted bool
+
+	// If not nil, the values of columns with a user-defined format
+	// in this catalog are replaced with their formatted labels, and
+	// these columns are returned as strings.
+	FormatCatalog *SAS7BCAT
+
 	// If true, turns off alignment correction when reading mix-type pages.
-	// In general this should be set to false.  However some files
-	// are read incorrectly and need this flag set to true.  At present,
-	// we do not know how to automatically detect the correct setting, so
-	// we leave this as a configurable option.
+	// SAS aligns the rows on mix-type pages to 8 byte boundaries, but
+	// some files written by other software do not.  The correct
+	// setting is detected when the file is opened, and can be
+	// overridden by setting this field before calling Read.  The
+	// detected value is also returned by DetectedNoAlignCorrection.
 	NoAlignCorrection bool
 
 	// The creation date of the file
@@ -89,9 +136,21 @@ type SAS7BDAT struct {
 	// The compression mode of the file
 	Compression string
 
-	// A decoder for decoding text to unicode
+	// If greater than 1, rows are decompressed and decoded
+	// concurrently using this number of goroutines.  This mainly
+	// benefits compressed files.  The results do not depend on
+	// the number of workers.
+	Workers int
+
+	// A decoder for decoding text to unicode.  If nil, a decoder
+	// is selected based on the encoding in the file header.  Call
+	// SetEncoding to select a decoder by SAS encoding name.
 	TextDecoder *xencoding.Decoder
 
+	// If true, strings are not decoded using the encoding in the
+	// file header (TextDecoder is still used if it is set).
+	NoTextDecoding bool
+
 	// The number of rows in the file
 	rowCount int
 
@@ -104,9 +163,14 @@ type SAS7BDAT struct {
 	// Names of the columns
 	columnNames []string
 
+	// Positions of the columns that are read, in the order that
+	// they are returned
+	selected []int
+
 	buf                              []byte
 	file                             io.ReadSeeker
 	cachedPage                       []byte
+	currentPage                      int
 	currentPageType                  int
 	currentPageBlockCount            int
 	currentPageSubheadersCount       int
@@ -114,6 +178,8 @@ type SAS7BDAT struct {
 	currentRowOnPageIndex            int
 	currentPageDataSubheaderPointers []*subheaderPointer
 	stringchunk                      [][]uint64
+	rawchunk                         [][][]byte
+	rawarena                         [][]byte
 	bytechunk                        [][]byte
 	currentRowInChunkIndex           int
 	columnNamesStrings               []string
@@ -121,10 +187,58 @@ type SAS7BDAT struct {
 	columnDataLengths                []int
 	columns                          []*column
 	properties                       *sasProperties
-	stringPool                       map[uint64]string
-	stringPoolR                      map[string]uint64
+	stringDict                       *stringDict
+	columnDicts                      []*stringDict
+	fileDecoder                      *xencoding.Decoder
+	detectedNoAlign                  bool
+
+	// The limits applied in hardened mode (nil otherwise), and the
+	// size of the file
+	limits   *ReadLimits
+	fileSize int64
+
+	// Bitmap of deleted rows on the current page, nil if the page
+	// has no deleted rows
+	currentPageDeleted []byte
+
+	// The deleted row indicators for the current chunk, if
+	// IncludeDeleted is set
+	deletedchunk []float64
+
+	// The number of deleted rows, once counted
+	deletedRowCount   int
+	deletedRowCounted bool
+
+	// In concurrent mode, rows are queued in rowBatch to be
+	// decoded by the workers
+	queueRows bool
+	rowBatch  []rowJob
+
+	// pageFirstRow[p] is the index of the first row on page p, for
+	// the pages that have been indexed.  The final element is the
+	// index of the first row following the indexed pages.
+	pageFirstRow []int
+
+	// The range of rows that are read, all rows in the file unless
+	// the reader was created by NewSAS7BDATPartitions
+	firstRow int
+	endRow   int
+
+	// Set when there are no more pages to read
+	eof bool
+
+	// In recovery mode, damaged pages and rows are skipped and
+	// recorded in the report.  truncated is set when the current
+	// page is incomplete because the file is truncated.
+	recover   bool
+	recovery  RecoveryReport
+	truncated bool
 }
 
+// The name of the column holding the deleted row indicators when
+// IncludeDeleted is set.
+const deletedColumnName = "_DELETED_"
+
 // These values don't change after the header is read.
 type sasProperties struct {
 	intLength              int
@@ -144,12 +258,82 @@ type sasProperties struct {
 }
 
 type column struct {
-	colId  int
-	name   string
-	label  string
-	format string
-	ctype  ColumnTypeT
-	length int
+	colId            int
+	name             string
+	label            string
+	format           string
+	formatWidth      int
+	formatDecimals   int
+	informat         string
+	informatWidth    int
+	informatDecimals int
+	ctype            ColumnTypeT
+	offset           int
+	length           int
+}
+
+// SASDecodeError is the error returned when a SAS7BDAT file cannot
+// be decoded.  It records where in the file the problem was found, so
+// that a caller can report or skip the file.
+type SASDecodeError struct {
+
+	// The page being read, numbered from zero, or -1 if the
+	// error occurred while reading the file header
+	Page int
+
+	// The row being read, numbered from zero and counting deleted
+	// rows, or -1 if the error did not occur while reading a row
+	Row int
+
+	// The name of the column being decoded, empty if the error
+	// does not concern a single column
+	Column string
+
+	// The underlying error
+	Err error
+}
+
+func (e *SASDecodeError) Error() string {
+
+	msg := "sas7bdat"
+	if e.Page >= 0 {
+		msg += fmt.Sprintf(": page %d", e.Page)
+	} else {
+		msg += ": header"
+	}
+	if e.Row >= 0 {
+		msg += fmt.Sprintf(", row %d", e.Row)
+	}
+	if e.Column != "" {
+		msg += fmt.Sprintf(", column %s", e.Column)
+	}
+
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *SASDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// decodeError returns err annotated with the current page, the given
+// row and column.  Errors that are already annotated, and io.EOF, are
+// returned unchanged.
+func (sas *SAS7BDAT) decodeError(err error, row int, column string) error {
+
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if _, ok := err.(*SASDecodeError); ok {
+		return err
+	}
+
+	return &SASDecodeError{
+		Page:   sas.currentPage,
+		Row:    row,
+		Column: column,
+		Err:    err,
+	}
 }
 
 type subheaderPointer struct {
@@ -265,6 +449,10 @@ const (
 	subheader_count_length                    = 2
 	page_meta_type                            = 0
 	page_data_type                            = 256
+	page_deleted_flag                         = 128
+	page_deleted_pointer_offset_x86           = 12
+	page_deleted_pointer_offset_x64           = 24
+	page_deleted_pointer_length               = 4
 	page_amd_type                             = 1024
 	subheader_pointers_offset                 = 8
 	truncated_subheader_id                    = 1
@@ -288,6 +476,14 @@ const (
 	column_data_length_length                 = 4
 	column_type_offset                        = 14
 	column_type_length                        = 1
+	column_format_width_offset                = 0
+	column_format_decimals_offset             = 2
+	column_informat_width_offset              = 4
+	column_informat_decimals_offset           = 6
+	column_format_width_length                = 2
+	column_informat_text_subheader_offset     = 16
+	column_informat_offset_offset             = 18
+	column_informat_length_offset             = 20
 	column_format_text_subheader_index_offset = 22
 	column_format_text_subheader_index_length = 2
 	column_format_offset_offset               = 24
@@ -306,14 +502,292 @@ const (
 
 // StringFactorMap returns a map that associates integer codes
 // with the string value that each code represents.  This is only
-// relevant if FactorizeStrings is set to True.
+// relevant if FactorizeStrings is set to True.  Returns nil if
+// FactorizePerColumn is set.
 func (sas *SAS7BDAT) StringFactorMap() map[uint64]string {
-	return sas.stringPool
+	if sas.FactorizePerColumn || sas.stringDict == nil {
+		return nil
+	}
+	return sas.stringDict.values
+}
+
+// ColumnStringFactorMap returns the map from integer codes to string
+// values for selected column k.  Unless FactorizePerColumn is set,
+// all columns share the map returned by StringFactorMap.
+func (sas *SAS7BDAT) ColumnStringFactorMap(k int) map[uint64]string {
+	if d := sas.dict(k); d != nil {
+		return d.values
+	}
+	return nil
+}
+
+// stringDict assigns integer codes to strings.
+type stringDict struct {
+	values map[uint64]string
+	codes  map[string]uint64
+
+	// If true, the dictionary has grown beyond MaxStringFactors.
+	// It is no longer extended, and new strings are added to
+	// chunk, which is reset for each call to Read.
+	overflow bool
+	chunk    *stringDict
+}
+
+func newStringDict() *stringDict {
+	d := new(stringDict)
+	d.reset()
+	return d
+}
+
+func (d *stringDict) reset() {
+	d.values = make(map[uint64]string)
+	d.codes = make(map[string]uint64)
+}
+
+// code returns the code for a string, adding the string to the
+// dictionary if needed.
+func (d *stringDict) code(s []byte) uint64 {
+	code, ok := d.codes[string(s)]
+	if ok {
+		return code
+	}
+	if d.overflow {
+		return uint64(len(d.values)) + d.chunk.code(s)
+	}
+	code = uint64(len(d.values))
+	d.values[code] = string(s)
+	d.codes[string(s)] = code
+	return code
+}
+
+// value returns the string with the given code.
+func (d *stringDict) value(code uint64) string {
+	if n := uint64(len(d.values)); d.overflow && code >= n {
+		return d.chunk.values[code-n]
+	}
+	return d.values[code]
+}
+
+// dict returns the string dictionary used by selected column k, or
+// nil if there is none yet.
+func (sas *SAS7BDAT) dict(k int) *stringDict {
+	if sas.FactorizePerColumn {
+		if sas.columnDicts == nil {
+			return nil
+		}
+		return sas.columnDicts[sas.selected[k]]
+	}
+	return sas.stringDict
+}
+
+// prepareStringDicts resets the string dictionaries at the start of a
+// call to Read, except for those that are kept for the whole file.
+func (sas *SAS7BDAT) prepareStringDicts() {
+
+	stable := sas.FactorizeStrings && sas.StableStringFactors
+	prepare := func(d *stringDict) *stringDict {
+		switch {
+		case d == nil || !stable:
+			return newStringDict()
+		case d.overflow:
+			d.chunk = newStringDict()
+		}
+		return d
+	}
+
+	if sas.FactorizePerColumn {
+		if sas.columnDicts == nil {
+			sas.columnDicts = make([]*stringDict, sas.properties.columnCount)
+		}
+		for _, j := range sas.selected {
+			if sas.columnTypes[j] == SASStringType {
+				sas.columnDicts[j] = prepare(sas.columnDicts[j])
+			}
+		}
+	} else {
+		sas.stringDict = prepare(sas.stringDict)
+	}
 }
 
-// Incomplete list of encodings
-var encoding_names = map[int]string{29: "latin1", 20: "utf-8", 33: "cyrillic", 60: "wlatin2",
-	61: "wcyrillic", 62: "wlatin1", 90: "ebcdic870"}
+// checkStringDicts marks the dictionaries that have grown beyond
+// MaxStringFactors.
+func (sas *SAS7BDAT) checkStringDicts() {
+
+	if !sas.FactorizeStrings || !sas.StableStringFactors || sas.MaxStringFactors <= 0 {
+		return
+	}
+
+	for k, j := range sas.selected {
+		d := sas.dict(k)
+		if sas.columnTypes[j] != SASStringType || d.overflow || len(d.values) <= sas.MaxStringFactors {
+			continue
+		}
+		d.overflow = true
+		d.chunk = newStringDict()
+		msg := fmt.Sprintf("Warning: more than %d distinct strings, column %s is returned as strings\n",
+			sas.MaxStringFactors, sas.columnNames[j])
+		if !sas.FactorizePerColumn {
+			msg = fmt.Sprintf("Warning: more than %d distinct strings, string columns are returned as strings\n",
+				sas.MaxStringFactors)
+		}
+		os.Stderr.WriteString(msg)
+	}
+}
+
+// SAS encoding codes (stored at encoding_offset in the file header)
+// and the corresponding SAS encoding names.
+var encoding_names = map[int]string{
+	20:  "utf-8",
+	28:  "us-ascii",
+	29:  "latin1",
+	30:  "latin2",
+	31:  "latin3",
+	32:  "latin4",
+	33:  "cyrillic",
+	34:  "arabic",
+	35:  "greek",
+	36:  "hebrew",
+	37:  "latin5",
+	38:  "latin6",
+	39:  "thai",
+	40:  "latin9",
+	41:  "pcoem437",
+	42:  "pcoem850",
+	43:  "pcoem852",
+	44:  "pcoem857",
+	45:  "pcoem858",
+	46:  "pcoem862",
+	47:  "pcoem864",
+	48:  "pcoem865",
+	49:  "pcoem866",
+	50:  "pcoem869",
+	51:  "pcoem874",
+	52:  "pcoem921",
+	53:  "pcoem922",
+	54:  "pcoem1129",
+	55:  "pcoem720",
+	56:  "pcoem737",
+	57:  "pcoem775",
+	58:  "pcoem860",
+	59:  "pcoem863",
+	60:  "wlatin2",
+	61:  "wcyrillic",
+	62:  "wlatin1",
+	63:  "wgreek",
+	64:  "wturkish",
+	65:  "whebrew",
+	66:  "warabic",
+	67:  "wbaltic",
+	68:  "wvietnamese",
+	69:  "macroman",
+	70:  "macarabic",
+	71:  "machebrew",
+	72:  "macgreek",
+	73:  "macthai",
+	75:  "macturkish",
+	76:  "macukraine",
+	90:  "ebcdic870",
+	118: "ms-950",
+	119: "euc-tw",
+	123: "big5",
+	125: "euc-cn",
+	126: "ms-936",
+	128: "ibm-1381",
+	134: "euc-jp",
+	136: "ms-949",
+	137: "ibm-942",
+	138: "shift-jis",
+	140: "euc-kr",
+	141: "ibm-949",
+	142: "kpce",
+	163: "maciceland",
+	167: "iso-2022-jp",
+	168: "iso-2022-kr",
+	169: "iso-2022-cn",
+	172: "iso-2022-cn-ext",
+	204: "any",
+	205: "gb18030",
+	227: "latin8",
+	242: "latin7",
+	245: "maccroatian",
+	246: "maccyrillic",
+	247: "macromania",
+	248: "shift-jisx0213",
+}
+
+// Text encodings corresponding to the SAS encoding names.  Encodings
+// that are compatible with UTF-8 (utf-8, us-ascii, any) map to nil.
+// Encodings that are not listed here cannot be decoded.
+var encoding_decoders = map[string]xencoding.Encoding{
+	"utf-8":          nil,
+	"us-ascii":       nil,
+	"any":            nil,
+	"latin1":         charmap.ISO8859_1,
+	"latin2":         charmap.ISO8859_2,
+	"latin3":         charmap.ISO8859_3,
+	"latin4":         charmap.ISO8859_4,
+	"cyrillic":       charmap.ISO8859_5,
+	"arabic":         charmap.ISO8859_6,
+	"greek":          charmap.ISO8859_7,
+	"hebrew":         charmap.ISO8859_8,
+	"latin5":         charmap.ISO8859_9,
+	"latin6":         charmap.ISO8859_10,
+	"thai":           charmap.Windows874,
+	"latin9":         charmap.ISO8859_15,
+	"latin7":         charmap.ISO8859_13,
+	"latin8":         charmap.ISO8859_14,
+	"pcoem437":       charmap.CodePage437,
+	"pcoem850":       charmap.CodePage850,
+	"pcoem852":       charmap.CodePage852,
+	"pcoem858":       charmap.CodePage858,
+	"pcoem860":       charmap.CodePage860,
+	"pcoem862":       charmap.CodePage862,
+	"pcoem863":       charmap.CodePage863,
+	"pcoem865":       charmap.CodePage865,
+	"pcoem866":       charmap.CodePage866,
+	"pcoem874":       charmap.Windows874,
+	"wlatin2":        charmap.Windows1250,
+	"wcyrillic":      charmap.Windows1251,
+	"wlatin1":        charmap.Windows1252,
+	"wgreek":         charmap.Windows1253,
+	"wturkish":       charmap.Windows1254,
+	"whebrew":        charmap.Windows1255,
+	"warabic":        charmap.Windows1256,
+	"wbaltic":        charmap.Windows1257,
+	"wvietnamese":    charmap.Windows1258,
+	"macroman":       charmap.Macintosh,
+	"maccyrillic":    charmap.MacintoshCyrillic,
+	"macukraine":     charmap.MacintoshCyrillic,
+	"ms-950":         traditionalchinese.Big5,
+	"big5":           traditionalchinese.Big5,
+	"euc-cn":         simplifiedchinese.GBK,
+	"ms-936":         simplifiedchinese.GBK,
+	"gb18030":        simplifiedchinese.GB18030,
+	"euc-jp":         japanese.EUCJP,
+	"shift-jis":      japanese.ShiftJIS,
+	"shift-jisx0213": japanese.ShiftJIS,
+	"iso-2022-jp":    japanese.ISO2022JP,
+	"ms-949":         korean.EUCKR,
+	"ibm-949":        korean.EUCKR,
+	"kpce":           korean.EUCKR,
+	"euc-kr":         korean.EUCKR,
+}
+
+// SetEncoding sets TextDecoder to a decoder for the given SAS
+// encoding name (e.g. "wlatin1" or "shift-jis"), overriding the
+// encoding recorded in the file header.
+func (sas *SAS7BDAT) SetEncoding(name string) error {
+
+	enc, ok := encoding_decoders[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unsupported SAS encoding: %s", name)
+	}
+	if enc == nil {
+		enc = xencoding.Nop
+	}
+	sas.TextDecoder = enc.NewDecoder()
+	return nil
+}
 
 var compression_literals = []string{rle_compression, rdc_compression}
 
@@ -338,63 +812,76 @@ func min(x, y int) int {
 // https://cran.r-project.org/web/packages/sas7bdat/vignettes/sas7bdat.pdf
 func rle_decompress(result_length int, inbuff []byte) ([]byte, error) {
 
+	// need returns an error if fewer than n bytes of input remain
+	need := func(n int) error {
+		if len(inbuff) < n {
+			return fmt.Errorf("RLE: compressed data is truncated")
+		}
+		return nil
+	}
+
 	result := make([]byte, 0, result_length)
 	for len(inbuff) > 0 {
 		control_byte := inbuff[0] & 0xF0
 		end_of_first_byte := int(inbuff[0] & 0x0F)
 
 		inbuff = inbuff[1:]
+		var err error
 		if control_byte == 0x00 {
 			if end_of_first_byte != 0 {
 				os.Stderr.WriteString("Unexpected non-zero end_of_first_byte\n")
 			}
-			nbytes := int(inbuff[0]) + 64
-			inbuff = inbuff[1:]
-			result = append(result, inbuff[0:nbytes]...)
-			inbuff = inbuff[nbytes:]
+			if err = need(1); err == nil {
+				nbytes := int(inbuff[0]) + 64
+				inbuff = inbuff[1:]
+				if err = need(nbytes); err == nil {
+					result = append(result, inbuff[0:nbytes]...)
+					inbuff = inbuff[nbytes:]
+				}
+			}
 		} else if control_byte == 0x40 {
 			// not documented
-			nbytes := end_of_first_byte * 16
-			nbytes += int(inbuff[0])
-			inbuff = inbuff[1:]
-			for k := 0; k < nbytes; k++ {
-				result = append(result, inbuff[0])
+			if err = need(2); err == nil {
+				nbytes := end_of_first_byte * 16
+				nbytes += int(inbuff[0])
+				inbuff = inbuff[1:]
+				for k := 0; k < nbytes; k++ {
+					result = append(result, inbuff[0])
+				}
+				inbuff = inbuff[1:]
 			}
-			inbuff = inbuff[1:]
 		} else if control_byte == 0x60 {
-			nbytes := end_of_first_byte*256 + int(inbuff[0]) + 17
-			inbuff = inbuff[1:]
-			for k := 0; k < nbytes; k++ {
-				result = append(result, 0x20)
+			if err = need(1); err == nil {
+				nbytes := end_of_first_byte*256 + int(inbuff[0]) + 17
+				inbuff = inbuff[1:]
+				for k := 0; k < nbytes; k++ {
+					result = append(result, 0x20)
+				}
 			}
 		} else if control_byte == 0x70 {
-			nbytes := end_of_first_byte*256 + int(inbuff[0]) + 17
-			inbuff = inbuff[1:]
-			for k := 0; k < nbytes; k++ {
-				result = append(result, 0x00)
+			if err = need(1); err == nil {
+				nbytes := end_of_first_byte*256 + int(inbuff[0]) + 17
+				inbuff = inbuff[1:]
+				for k := 0; k < nbytes; k++ {
+					result = append(result, 0x00)
+				}
+			}
+		} else if control_byte >= 0x80 && control_byte <= 0xB0 {
+			// 0x80: 1, 0x90: 17, 0xA0: 33 and 0xB0: 49 bytes plus
+			// end_of_first_byte are copied
+			nbytes := end_of_first_byte + 1 + 16*int((control_byte-0x80)>>4)
+			if err = need(nbytes); err == nil {
+				result = append(result, inbuff[0:nbytes]...)
+				inbuff = inbuff[nbytes:]
 			}
-		} else if control_byte == 0x80 {
-			nbytes := end_of_first_byte + 1
-			result = append(result, inbuff[0:nbytes]...)
-			inbuff = inbuff[nbytes:]
-		} else if control_byte == 0x90 {
-			nbytes := end_of_first_byte + 17
-			result = append(result, inbuff[0:nbytes]...)
-			inbuff = inbuff[nbytes:]
-		} else if control_byte == 0xA0 {
-			nbytes := end_of_first_byte + 33
-			result = append(result, inbuff[0:nbytes]...)
-			inbuff = inbuff[nbytes:]
-		} else if control_byte == 0xB0 {
-			nbytes := end_of_first_byte + 49
-			result = append(result, inbuff[0:nbytes]...)
-			inbuff = inbuff[nbytes:]
 		} else if control_byte == 0xC0 {
-			nbytes := end_of_first_byte + 3
-			x := inbuff[0]
-			inbuff = inbuff[1:]
-			for k := 0; k < nbytes; k++ {
-				result = append(result, x)
+			if err = need(1); err == nil {
+				nbytes := end_of_first_byte + 3
+				x := inbuff[0]
+				inbuff = inbuff[1:]
+				for k := 0; k < nbytes; k++ {
+					result = append(result, x)
+				}
 			}
 		} else if control_byte == 0xD0 {
 			nbytes := end_of_first_byte + 2
@@ -414,10 +901,16 @@ func rle_decompress(result_length int, inbuff []byte) ([]byte, error) {
 		} else {
 			return nil, fmt.Errorf("unknown control byte: %v", control_byte)
 		}
+		if err != nil {
+			return nil, err
+		}
+		if len(result) > result_length {
+			return nil, fmt.Errorf("RLE: decompressed data is longer than %d bytes", result_length)
+		}
 	}
 
 	if len(result) != result_length {
-		os.Stderr.WriteString(fmt.Sprintf("RLE: %v != %v\n", len(result), result_length))
+		return nil, fmt.Errorf("RLE: decompressed data has %d bytes, expected %d", len(result), result_length)
 	}
 
 	return result, nil
@@ -436,13 +929,34 @@ func rdc_decompress(result_length int, inbuff []byte) ([]byte, error) {
 	var inbuff_pos int
 	outbuff := make([]byte, 0, result_length)
 
+	truncated := fmt.Errorf("RDC: compressed data is truncated")
+
+	// pattern appends n bytes to the output, copied starting ofs
+	// bytes before the end of the output.
+	pattern := func(ofs, n int) error {
+		if ofs > len(outbuff) {
+			return fmt.Errorf("RDC: invalid pattern offset %d", ofs)
+		}
+		start := len(outbuff) - ofs
+		for k := 0; k < n; k++ {
+			outbuff = append(outbuff, outbuff[start+k])
+		}
+		return nil
+	}
+
 	for inbuff_pos < len(inbuff) {
 		ctrl_mask = ctrl_mask >> 1
 		if ctrl_mask == 0 {
+			if inbuff_pos+2 > len(inbuff) {
+				return nil, truncated
+			}
 			ctrl_bits = uint16(inbuff[inbuff_pos])<<8 + uint16(inbuff[inbuff_pos+1])
 			inbuff_pos += 2
 			ctrl_mask = 0x8000
 		}
+		if inbuff_pos >= len(inbuff) {
+			return nil, truncated
+		}
 
 		if (ctrl_bits & ctrl_mask) == 0 {
 			outbuff = append(outbuff, inbuff[inbuff_pos])
@@ -454,6 +968,12 @@ func rdc_decompress(result_length int, inbuff []byte) ([]byte, error) {
 		cnt = uint16(inbuff[inbuff_pos] & 0x0F)
 		inbuff_pos++
 
+		// The short commands use one more byte, and the long
+		// commands two more bytes
+		if (cmd == 0 || cmd >= 3) && inbuff_pos+1 > len(inbuff) || inbuff_pos+2 > len(inbuff) && (cmd == 1 || cmd == 2) {
+			return nil, truncated
+		}
+
 		switch {
 		case cmd == 0: /* short rle */
 			cnt += 3
@@ -476,21 +996,26 @@ func rdc_decompress(result_length int, inbuff []byte) ([]byte, error) {
 			cnt = uint16(inbuff[inbuff_pos])
 			inbuff_pos++
 			cnt += 16
-			tmp := outbuff[len(outbuff)-int(ofs) : len(outbuff)-int(ofs)+int(cnt)]
-			outbuff = append(outbuff, tmp...)
+			if err := pattern(int(ofs), int(cnt)); err != nil {
+				return nil, err
+			}
 		case (cmd >= 3) && (cmd <= 15): /* short pattern */
 			ofs = cnt + 3
 			ofs += uint16(inbuff[inbuff_pos]) << 4
 			inbuff_pos++
-			tmp := outbuff[len(outbuff)-int(ofs) : len(outbuff)-int(ofs)+int(cmd)]
-			outbuff = append(outbuff, tmp...)
+			if err := pattern(int(ofs), int(cmd)); err != nil {
+				return nil, err
+			}
 		default:
 			return nil, fmt.Errorf("unknown RDC command")
 		}
+		if len(outbuff) > result_length {
+			return nil, fmt.Errorf("RDC: decompressed data is longer than %d bytes", result_length)
+		}
 	}
 
 	if len(outbuff) != result_length {
-		os.Stderr.WriteString(fmt.Sprintf("RDC: %v != %v\n", len(outbuff), result_length))
+		return nil, fmt.Errorf("RDC: decompressed data has %d bytes, expected %d", len(outbuff), result_length)
 	}
 
 	return outbuff, nil
@@ -510,37 +1035,193 @@ func (sas *SAS7BDAT) getDecompressor() func(int, []byte) ([]byte, error) {
 // NewSAS7BDATReader returns a new reader object for SAS7BDAT files.
 // Call the Read method to obtain the data.
 func NewSAS7BDATReader(r io.ReadSeeker) (*SAS7BDAT, error) {
+	return NewSAS7BDATReaderWithLimits(r, nil)
+}
+
+// NewSAS7BDATReaderWithLimits returns a new reader object for
+// SAS7BDAT files that reads the file in hardened mode, checking all
+// sizes read from the file against the file size and the given
+// limits.  Use this to read files from untrusted sources.  If limits
+// is nil, this is equivalent to NewSAS7BDATReader.
+func NewSAS7BDATReaderWithLimits(r io.ReadSeeker, limits *ReadLimits) (*SAS7BDAT, error) {
+	return newSAS7BDATReader(r, limits, false)
+}
+
+// NewSAS7BDATReaderWithRecovery returns a new reader object for
+// SAS7BDAT files that may be truncated or partially corrupt.  Instead
+// of returning an error, Read skips pages and rows that cannot be
+// read, and stops at the end of a truncated file, so that all the
+// intact rows are returned.  Recovery returns a report of the rows
+// recovered and the parts of the file that could not be read.
+//
+// The file header and the metadata describing the columns must be
+// intact.  Rows on a truncated page are returned even if they were
+// marked as deleted in the missing part of the page.  The Workers
+// field is ignored in recovery mode.
+func NewSAS7BDATReaderWithRecovery(r io.ReadSeeker) (*SAS7BDAT, error) {
+	return newSAS7BDATReader(r, nil, true)
+}
+
+func newSAS7BDATReader(r io.ReadSeeker, limits *ReadLimits, recover bool) (*SAS7BDAT, error) {
 
 	sas := new(SAS7BDAT)
 	sas.file = r
+	sas.currentPage = -1
+	sas.limits = limits
+	sas.recover = recover
+	if limits != nil {
+		var err error
+		sas.fileSize, err = streamSize(r)
+		if err != nil {
+			return nil, sas.decodeError(err, -1, "")
+		}
+	}
+
 	err := sas.getProperties()
 	if err != nil {
-		return nil, err
+		return nil, sas.decodeError(err, -1, "")
 	}
 
 	sas.cachedPage = make([]byte, sas.properties.pageLength)
 	err = sas.parseMetadata()
 	if err != nil {
-		return nil, err
+		return nil, sas.decodeError(err, -1, "")
+	}
+	if err := sas.checkMetadata(); err != nil {
+		return nil, sas.decodeError(err, -1, "")
+	}
+	sas.endRow = sas.rowCount
+
+	sas.selected = make([]int, sas.properties.columnCount)
+	for j := range sas.selected {
+		sas.selected[j] = j
 	}
 
-	// Default text decoder
-	// leave as nil for now (no decoding)
-	//sas.TextDecoder = charmap.Windows1250.NewDecoder()
+	if sas.isPageMixType(sas.currentPageType) {
+		sas.detectedNoAlign = sas.detectNoAlignCorrection()
+		sas.NoAlignCorrection = sas.detectedNoAlign
+	}
+
+	// The deleted rows on the first data page could not be located
+	// before the metadata was read.
+	if sas.currentPageType&page_deleted_flag != 0 && sas.isPageMixDataType(sas.currentPageType) {
+		if err := sas.readDeletedMap(); err != nil && !(sas.recover && sas.truncated) {
+			return nil, sas.decodeError(err, -1, "")
+		}
+	}
 
 	return sas, nil
 }
 
+// checkMetadata checks that the column and row metadata are
+// consistent, so that the rows can be decoded without going out of
+// range.  In hardened mode, the sizes are also checked against the
+// size of the file and the allocation limit.
+func (sas *SAS7BDAT) checkMetadata() error {
+
+	prop := sas.properties
+	ncol := prop.columnCount
+	if ncol < 0 || len(sas.columnNames) < ncol || len(sas.columnTypes) < ncol || len(sas.columnDataOffsets) < ncol ||
+		len(sas.columnDataLengths) < ncol || len(sas.columns) < ncol {
+		return fmt.Errorf("incomplete metadata for %d columns", ncol)
+	}
+	if sas.rowCount < 0 || prop.rowLength < 0 || prop.mixPageRowCount < 0 {
+		return fmt.Errorf("invalid row count %d, row length %d or mix page row count %d",
+			sas.rowCount, prop.rowLength, prop.mixPageRowCount)
+	}
+
+	for j := 0; j < ncol; j++ {
+		offset, length := sas.columnDataOffsets[j], sas.columnDataLengths[j]
+		if offset < 0 || length < 0 || offset+length > prop.rowLength {
+			return fmt.Errorf("column %s at offset %d with length %d is outside of the row (%d bytes)",
+				sas.columnNames[j], offset, length, prop.rowLength)
+		}
+		if sas.columnTypes[j] == SASNumericType && length > 8 {
+			return fmt.Errorf("numeric column %s has length %d", sas.columnNames[j], length)
+		}
+	}
+
+	if sas.limits == nil {
+		return nil
+	}
+
+	if err := sas.limits.checkSize("column", int64(ncol), sas.fileSize/8); err != nil {
+		return err
+	}
+	if err := sas.limits.checkAlloc("row bytes", int64(prop.rowLength), 1); err != nil {
+		return err
+	}
+
+	// Each row takes at least one byte of the file, and the rows of
+	// compressed files are stored in subheaders, with a pointer to
+	// each of them.
+	rowSize := int64(prop.rowLength)
+	if sas.Compression != "" && rowSize > int64(prop.subheaderPointerLength) {
+		rowSize = int64(prop.subheaderPointerLength)
+	}
+	if rowSize < 1 {
+		rowSize = 1
+	}
+	if int64(sas.rowCount) > sas.fileSize/rowSize {
+		return fmt.Errorf("row count %d is too large for the file size %d", sas.rowCount, sas.fileSize)
+	}
+	if int64(min(sas.rowCount, prop.mixPageRowCount))*int64(prop.rowLength) > int64(prop.pageLength) {
+		return fmt.Errorf("%d rows of length %d do not fit on a mix page", prop.mixPageRowCount, prop.rowLength)
+	}
+
+	return nil
+}
+
+// DetectedNoAlignCorrection returns the setting of NoAlignCorrection
+// that was detected from the first mix-type page when the file was
+// opened.  This is false if the file has no mix-type pages.
+func (sas *SAS7BDAT) DetectedNoAlignCorrection() bool {
+	return sas.detectedNoAlign
+}
+
+// detectNoAlignCorrection returns true if the rows on the current
+// page, which must be a mix-type page, directly follow the subheader
+// pointers instead of being aligned to an 8 byte boundary.  As in
+// ReadStat, the rows are taken to be aligned if the padding between
+// the subheader pointers and the first row is blank (zeros or
+// spaces), and the aligned rows fit on the page.
+func (sas *SAS7BDAT) detectNoAlignCorrection() bool {
+
+	start := sas.properties.pageBitOffset + subheader_pointers_offset +
+		sas.currentPageSubheadersCount*sas.properties.subheaderPointerLength
+	pad := start % 8
+	if pad == 0 {
+		// Aligned either way
+		return false
+	}
+
+	nrows := min(sas.rowCount, sas.properties.mixPageRowCount)
+	end := start + nrows*sas.properties.rowLength
+	if end+pad > len(sas.cachedPage) {
+		// The aligned rows would not fit on the page
+		return end <= len(sas.cachedPage)
+	}
+
+	padding := sas.cachedPage[start : start+pad]
+	return !(bytes.Count(padding, []byte{0}) == pad || bytes.Count(padding, []byte{' '}) == pad)
+}
+
 // readBytes read length bytes from the given offset in the current
 // page (or from the beginning of the file if no page has yet been
 // read).
 func (sas *SAS7BDAT) readBytes(offset, length int) error {
 
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid position %d or length %d", offset, length)
+	}
+	if sas.cachedPage != nil && offset+length > len(sas.cachedPage) {
+		return fmt.Errorf("The cached page is too small.")
+	}
 	sas.ensureBufSize(length)
 
 	if sas.cachedPage == nil {
 		if _, err := sas.file.Seek(int64(offset), 0); err != nil {
-			panic(err)
+			return fmt.Errorf("unable to seek to file position %d: %v", offset, err)
 		}
 		n, err := sas.file.Read(sas.buf[0:length])
 		if err != nil {
@@ -549,9 +1230,6 @@ func (sas *SAS7BDAT) readBytes(offset, length int) error {
 			return fmt.Errorf("Unable to read %d bytes from file position %d.", length, offset)
 		}
 	} else {
-		if offset+length > len(sas.cachedPage) {
-			return fmt.Errorf("The cached page is too small.")
-		}
 		copy(sas.buf, sas.cachedPage[offset:offset+length])
 	}
 	return nil
@@ -630,62 +1308,105 @@ func (sas *SAS7BDAT) readInt(offset, width int) (int, error) {
 // Read returns up to num_rows rows of data from the SAS7BDAT file, as
 // an array of Series objects.  The Series data types are either
 // float64 or string.  If num_rows is negative, the remainder of the
-// file is read.  Returns (nil, io.EOF) when no rows remain.
+// file is read.  Returns (nil, io.EOF) when no rows remain.  Other
+// errors are returned as a *SASDecodeError giving the page, row and
+// column where decoding failed.
+//
+// Unless IncludeDeleted is set, deleted rows are skipped and are not
+// counted in num_rows, so fewer than num_rows rows are returned only
+// when the end of the file (or of RowRange) is reached.
 //
 // SAS strings variables have a fixed width and are right-padded with
 // whitespace.  The TrimRight field of the SAS7BDAT struct can be set
 // to true to automatically trim this whitespace.
 func (sas *SAS7BDAT) Read(num_rows int) ([]*Series, error) {
 
-	if num_rows < 0 {
-		num_rows = sas.rowCount - sas.currentRowInFileIndex
+	if num_rows < 0 || num_rows > sas.endRow-sas.currentRowInFileIndex {
+		num_rows = sas.endRow - sas.currentRowInFileIndex
 	}
 
-	if sas.currentRowInFileIndex >= sas.rowCount {
+	if sas.currentRowInFileIndex >= sas.endRow {
 		return nil, io.EOF
 	}
 
-	sas.stringPool = make(map[uint64]string)
-	sas.stringPoolR = make(map[string]uint64)
+	// Each selected column uses 8 bytes per row, except that with
+	// RawStrings a string column uses a slice header and its width
+	rowSize := int64(8 * (len(sas.selected) + 1))
+	for k, j := range sas.selected {
+		if sas.columnTypes[j] == SASStringType && sas.RawStrings && sas.userFormat(k) == nil {
+			rowSize += 16 + int64(sas.columnDataLengths[j])
+		}
+	}
+	if err := sas.limits.checkAlloc("rows", int64(num_rows), rowSize); err != nil {
+		return nil, sas.decodeError(err, sas.currentRowInFileIndex, "")
+	}
+
+	sas.prepareStringDicts()
 
 	// Reallocate each call so the results are backed by
 	// completely independent memory with each call to read (to
 	// support concurrent processing of results while continuing
 	// reading).
-	sas.bytechunk = make([][]byte, sas.properties.columnCount)
-	sas.stringchunk = make([][]uint64, sas.properties.columnCount)
-	for j := 0; j < sas.properties.columnCount; j++ {
+	sas.bytechunk = make([][]byte, len(sas.selected))
+	sas.stringchunk = make([][]uint64, len(sas.selected))
+	sas.rawchunk = make([][][]byte, len(sas.selected))
+	sas.rawarena = make([][]byte, len(sas.selected))
+	for k, j := range sas.selected {
 		switch sas.columnTypes[j] {
 		case SASNumericType:
-			sas.bytechunk[j] = make([]byte, 8*num_rows)
+			sas.bytechunk[k] = make([]byte, 8*num_rows)
 		case SASStringType:
-			sas.stringchunk[j] = make([]uint64, num_rows)
+			if sas.RawStrings && sas.userFormat(k) == nil {
+				// The values are at most as long as the column,
+				// so the arena is never reallocated
+				sas.rawchunk[k] = make([][]byte, num_rows)
+				sas.rawarena[k] = make([]byte, 0, num_rows*sas.columnDataLengths[j])
+				continue
+			}
+			sas.stringchunk[k] = make([]uint64, num_rows)
 		default:
 			return nil, fmt.Errorf("unknown column type")
 		}
 	}
 
+	sas.deletedchunk = nil
+	if sas.IncludeDeleted {
+		sas.deletedchunk = make([]float64, num_rows)
+	}
+
 	sas.currentRowInChunkIndex = 0
-	for i := 0; i < num_rows; i++ {
-		err, done := sas.readline()
-		if err != nil {
-			return nil, err
-		} else if done {
-			break
+	if sas.Workers > 1 && !sas.recover {
+		if err := sas.readConcurrent(num_rows); err != nil {
+			return nil, sas.decodeError(err, sas.currentRowInFileIndex, "")
 		}
+	} else {
+		for i := 0; i < num_rows; i++ {
+			err, done := sas.readline()
+			if err != nil {
+				return nil, sas.decodeError(err, sas.currentRowInFileIndex, "")
+			} else if done {
+				break
+			}
+		}
+	}
+
+	if sas.currentRowInChunkIndex == 0 {
+		// All remaining rows are deleted
+		return nil, io.EOF
 	}
+	sas.recovery.RowsRecovered += sas.currentRowInChunkIndex
 
-	rslt := sas.chunkToSeries()
+	sas.checkStringDicts()
 
-	return rslt, nil
+	return sas.chunkToSeries()
 }
 
-func (sas *SAS7BDAT) chunkToSeries() []*Series {
+func (sas *SAS7BDAT) chunkToSeries() ([]*Series, error) {
 
-	rslt := make([]*Series, sas.properties.columnCount)
+	rslt := make([]*Series, len(sas.selected))
 	n := sas.currentRowInChunkIndex
 
-	for j := 0; j < sas.properties.columnCount; j++ {
+	for k, j := range sas.selected {
 
 		name := sas.columnNames[j]
 		miss := make([]bool, n)
@@ -693,189 +1414,689 @@ func (sas *SAS7BDAT) chunkToSeries() []*Series {
 		switch sas.columnTypes[j] {
 		case SASNumericType:
 			vec := make([]float64, n)
-			buf := bytes.NewReader(sas.bytechunk[j][0 : 8*n])
+			buf := bytes.NewReader(sas.bytechunk[k][0 : 8*n])
 			if err := binary.Read(buf, sas.ByteOrder, &vec); err != nil {
-				panic(err)
+				return nil, sas.decodeError(err, -1, name)
 			}
+			var codes []byte
 			for i := 0; i < n; i++ {
 				if math.IsNaN(vec[i]) {
 					miss[i] = true
+					if c := sasMissingCode(vec[i]); c != 0 {
+						if codes == nil {
+							codes = make([]byte, n)
+						}
+						codes[i] = c
+					}
 				}
 			}
-			if sas.ConvertDates && sas.ColumnFormats[j] == "MMDDYY" || sas.ColumnFormats[j] == "DATE" {
+			if f := sas.userFormat(k); f != nil {
+				rslt[k], _ = NewSeries(name, formatNumeric(f, vec, miss), miss)
+				for i := range codes {
+					if !miss[i] {
+						codes[i] = 0
+					}
+				}
+				rslt[k].missingCodes = codes
+				continue
+			}
+			var kind SASDateFormatKind
+			if sas.ConvertDates {
+				kind = sasDateFormatKind(sas.ColumnFormats[k])
+			}
+			switch kind {
+			case SASDate:
 				tvec := toDate(vec)
-				rslt[j], _ = NewSeries(name, tvec, miss)
-			} else if sas.ConvertDates && sas.ColumnFormats[j] == "DATETIME" {
+				rslt[k], _ = NewSeries(name, tvec, miss)
+			case SASDateTime:
 				tvec := toDateTime(vec)
-				rslt[j], _ = NewSeries(name, tvec, miss)
-			} else {
-				rslt[j], _ = NewSeries(name, vec, miss)
+				rslt[k], _ = NewSeries(name, tvec, miss)
+			case SASTime:
+				dvec := toDuration(vec)
+				rslt[k], _ = NewSeries(name, dvec, miss)
+			default:
+				rslt[k], _ = NewSeries(name, vec, miss)
 			}
+			rslt[k].missingCodes = codes
 		case SASStringType:
-			if sas.FactorizeStrings {
-				rslt[j], _ = NewSeries(name, sas.stringchunk[j], miss)
+			if sas.rawchunk[k] != nil {
+				rslt[k], _ = NewSeries(name, sas.rawchunk[k][0:n], miss)
+				continue
+			}
+			d := sas.dict(k)
+			if f := sas.userFormat(k); f != nil {
+				s := make([]string, n)
+				for i := 0; i < n; i++ {
+					s[i] = d.value(sas.stringchunk[k][i])
+					if v, ok := f.StringLabel(s[i]); ok {
+						s[i] = v
+					}
+				}
+				rslt[k], _ = NewSeries(name, s, miss)
+			} else if sas.FactorizeStrings && !d.overflow {
+				rslt[k], _ = NewSeries(name, sas.stringchunk[k][0:n], miss)
 			} else {
 				s := make([]string, n)
 				for i := 0; i < n; i++ {
-					s[i] = sas.stringPool[sas.stringchunk[j][i]]
+					s[i] = d.value(sas.stringchunk[k][i])
 				}
-				rslt[j], _ = NewSeries(name, s, miss)
+				rslt[k], _ = NewSeries(name, s, miss)
 			}
 		default:
-			panic("Unknown column type")
+			return nil, sas.decodeError(fmt.Errorf("unknown column type %d", sas.columnTypes[j]), -1, name)
+		}
+	}
+
+	if sas.IncludeDeleted {
+		s, _ := NewSeries(deletedColumnName, sas.deletedchunk[0:n], make([]bool, n))
+		rslt = append(rslt, s)
+	}
+
+	return rslt, nil
+}
+
+// userFormat returns the user-defined format from FormatCatalog for
+// selected column k, or nil if there is none.
+func (sas *SAS7BDAT) userFormat(k int) *SASFormat {
+
+	if sas.FormatCatalog == nil || sas.ColumnFormats[k] == "" {
+		return nil
+	}
+	return sas.FormatCatalog.Format(sas.ColumnFormats[k])
+}
+
+// formatNumeric returns the labels of the values in x.  Values that
+// are not covered by the format are converted to strings.  Missing
+// values that have a label are replaced with the label and marked as
+// not missing.
+func formatNumeric(f *SASFormat, x []float64, miss []bool) []string {
+
+	rslt := make([]string, len(x))
+	for i, v := range x {
+		lbl, ok := f.Label(v)
+		switch {
+		case ok:
+			rslt[i] = lbl
+			miss[i] = false
+		case !miss[i]:
+			rslt[i] = fmt.Sprintf("%v", v)
 		}
 	}
 
 	return rslt
 }
 
+// sasMissingCode returns the letter identifying a SAS special missing
+// value ('A'-'Z' or '_'), or zero for the standard missing value.  SAS
+// stores the complement of a tag in the NaN payload.  The tag is
+// either an index (0 for ._, 1 for ., 2-27 for .A-.Z) or the
+// character itself.
+func sasMissingCode(x float64) byte {
+
+	tag := ^byte(math.Float64bits(x) >> 40)
+	switch {
+	case tag == 0:
+		return '_'
+	case tag >= 2 && tag < 28:
+		return 'A' + tag - 2
+	case tag == '_' || (tag >= 'A' && tag <= 'Z'):
+		return tag
+	}
+	return 0
+}
+
 func toDate(x []float64) []time.Time {
 
 	rslt := make([]time.Time, len(x))
 
-	base := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+	for j, v := range x {
+		rslt[j] = sasTime(3600 * math.Trunc(24*v))
+	}
+
+	return rslt
+}
+
+func date_time(x float64) time.Time {
+	// Timestamp is epoch 01/01/1960
+	return sasTime(math.Trunc(x))
+}
+
+// sasTime returns the time that is x seconds after the SAS epoch.  A
+// time.Duration only spans about 292 years, so the time is found from
+// its Unix time.
+func sasTime(x float64) time.Time {
+	s := math.Floor(x)
+	return time.Unix(sasEpoch.Unix()+int64(s), int64(1e9*(x-s))).UTC()
+}
+
+func toDateTime(x []float64) []time.Time {
+	rslt := make([]time.Time, len(x))
+
+	for j, v := range x {
+		rslt[j] = date_time(v)
+	}
+
+	return rslt
+}
+
+// toDuration converts SAS time values (seconds since midnight) to
+// durations.
+func toDuration(x []float64) []time.Duration {
+	rslt := make([]time.Duration, len(x))
 
 	for j, v := range x {
-		rslt[j] = base.Add(time.Hour * time.Duration(24*v))
+		rslt[j] = time.Duration(v * float64(time.Second))
+	}
+
+	return rslt
+}
+
+func (sas *SAS7BDAT) readline() (error, bool) {
+
+	bit_offset := sas.properties.pageBitOffset
+	subheaderPointerLength := sas.properties.subheaderPointerLength
+
+	// If there is no page, go to the end of the header and read a page.
+	if sas.cachedPage == nil {
+		if _, err := sas.file.Seek(int64(sas.properties.headerLength), 0); err != nil {
+			return err, false
+		}
+		sas.currentPage = -1
+		err, done := sas.readNextPage()
+		if err != nil {
+			return err, false
+		} else if done {
+			return nil, true
+		}
+	}
+
+	// Loop until a data row is read
+	for {
+		if sas.eof {
+			return nil, true
+		}
+		if sas.currentRowInFileIndex >= sas.endRow {
+			// Deleted rows were skipped up to the end of the
+			// partition
+			return nil, true
+		}
+		if sas.currentPageType == page_meta_type {
+			if sas.currentRowOnPageIndex >= len(sas.currentPageDataSubheaderPointers) {
+				err, done := sas.readNextPage()
+				if err != nil {
+					return err, false
+				} else if done {
+					return nil, true
+				}
+				sas.currentRowOnPageIndex = 0
+				continue
+			}
+			current_subheader_pointer := sas.currentPageDataSubheaderPointers[sas.currentRowOnPageIndex]
+			err := sas.processByteArrayWithData(current_subheader_pointer.offset, current_subheader_pointer.length)
+			if err != nil {
+				if err, done := sas.skipRow(err, current_subheader_pointer.offset, current_subheader_pointer.length); err != nil || done {
+					return err, done
+				}
+				continue
+			}
+			return nil, false
+		} else if sas.isPageMixType(sas.currentPageType) {
+			offset := bit_offset + subheader_pointers_offset +
+				sas.currentPageSubheadersCount*subheaderPointerLength +
+				sas.currentRowOnPageIndex*sas.properties.rowLength +
+				sas.mixPageAlignCorrection()
+			read, err := sas.processRow(offset)
+			if err != nil {
+				if err, done := sas.skipRow(err, offset, sas.properties.rowLength); err != nil || done {
+					return err, done
+				}
+			}
+			if sas.currentRowOnPageIndex == min(sas.rowCount, sas.properties.mixPageRowCount) {
+				err, done := sas.readNextPage()
+				if err != nil {
+					return err, false
+				} else if done {
+					return nil, true
+				}
+				sas.currentRowOnPageIndex = 0
+			}
+			if read {
+				return nil, false
+			}
+		} else if isPageDataType(sas.currentPageType) {
+			offset := bit_offset + subheader_pointers_offset + sas.currentRowOnPageIndex*sas.properties.rowLength
+			read, err := sas.processRow(offset)
+			if err != nil {
+				if err, done := sas.skipRow(err, offset, sas.properties.rowLength); err != nil || done {
+					return err, done
+				}
+			}
+			if sas.currentRowOnPageIndex == sas.currentPageBlockCount {
+				err, done := sas.readNextPage()
+				if err != nil {
+					return err, false
+				} else if done {
+					return nil, true
+				}
+				sas.currentRowOnPageIndex = 0
+			}
+			if read {
+				return nil, false
+			}
+		} else {
+			err, done := sas.skipPage(fmt.Errorf("unknown page type: %d", sas.currentPageType))
+			if err != nil || done {
+				return err, done
+			}
+			sas.currentRowOnPageIndex = 0
+		}
+	}
+}
+
+// skipRow is called when the row at the given offset of the current
+// page cannot be read.  Outside of recovery mode the error is
+// returned.  In recovery mode the row is skipped and recorded as
+// unreadable, or reading stops if the file is truncated.
+func (sas *SAS7BDAT) skipRow(err error, offset, length int) (error, bool) {
+
+	if !sas.recover {
+		return err, false
+	}
+	if sas.truncated {
+		return nil, true
+	}
+	start := sas.pageOffset(sas.currentPage) + int64(offset)
+	sas.recovery.addRange(start, start+int64(length))
+	sas.currentRowOnPageIndex++
+	sas.currentRowInFileIndex++
+	return nil, false
+}
+
+// skipPage is called when the current page cannot be read.  Outside
+// of recovery mode the error is returned.  In recovery mode the page
+// is recorded as unreadable and the next page is read, or reading
+// stops if the file is truncated.
+func (sas *SAS7BDAT) skipPage(err error) (error, bool) {
+
+	if !sas.recover {
+		return err, false
+	}
+	if sas.truncated {
+		return nil, true
+	}
+	start := sas.pageOffset(sas.currentPage)
+	sas.recovery.addRange(start, start+int64(sas.properties.pageLength))
+	return sas.readNextPage()
+}
+
+// truncatePage is called in recovery mode when only the first n bytes
+// of the current page are present in the file.  The rest of the file
+// is recorded as unreadable, and the page is shortened so that reading
+// stops at the first row that is not complete.
+func (sas *SAS7BDAT) truncatePage(n int) {
+
+	start := sas.pageOffset(sas.currentPage)
+	end := sas.pageOffset(sas.properties.pageCount)
+	if end < start+int64(sas.properties.pageLength) {
+		end = start + int64(sas.properties.pageLength)
+	}
+	sas.recovery.addRange(start+int64(n), end)
+	sas.cachedPage = sas.cachedPage[0:n]
+	sas.truncated = true
+}
+
+// pageOffset returns the position of page p in the file.
+func (sas *SAS7BDAT) pageOffset(p int) int64 {
+	return int64(sas.properties.headerLength) + int64(p)*int64(sas.properties.pageLength)
+}
+
+// Recovery returns a report of the rows that have been read and the
+// parts of the file that could not be read, for a reader created with
+// NewSAS7BDATReaderWithRecovery.  The report is complete once Read
+// has returned all of the rows.
+func (sas *SAS7BDAT) Recovery() RecoveryReport {
+
+	report := sas.recovery
+	report.RowCount = sas.RowCount()
+	report.Unreadable = append([]ByteRange(nil), sas.recovery.Unreadable...)
+	return report
+}
+
+// mixPageAlignCorrection returns the number of padding bytes between
+// the subheader pointers and the first row on the current mix page.
+func (sas *SAS7BDAT) mixPageAlignCorrection() int {
+
+	if sas.NoAlignCorrection {
+		return 0
+	}
+	return (sas.properties.pageBitOffset + subheader_pointers_offset +
+		sas.currentPageSubheadersCount*sas.properties.subheaderPointerLength) % 8
+}
+
+// processRow reads the row at the given offset of the current mix
+// or data page, or skips it if it is deleted and IncludeDeleted is
+// not set.  Returns false if the row was skipped.
+func (sas *SAS7BDAT) processRow(offset int) (bool, error) {
+
+	deleted := rowDeleted(sas.currentPageDeleted, sas.currentRowOnPageIndex)
+	if deleted && !sas.IncludeDeleted {
+		sas.currentRowOnPageIndex++
+		sas.currentRowInFileIndex++
+		return false, nil
+	}
+	if deleted {
+		sas.deletedchunk[sas.currentRowInChunkIndex] = 1
+	}
+
+	return true, sas.processByteArrayWithData(offset, sas.properties.rowLength)
+}
+
+// rowDeleted returns true if the bit for the given row is set in a
+// page's deletion bitmap.  The bits are ordered starting with the
+// most significant bit of each byte.
+func rowDeleted(bitmap []byte, row int) bool {
+	return row/8 < len(bitmap) && bitmap[row/8]&(0x80>>uint(row%8)) != 0
+}
+
+// deletedMapOffset returns the position of the deletion bitmap on a
+// page with the given header values.  The bitmap follows the row
+// data, at a position given by a pointer in the page header.
+func (sas *SAS7BDAT) deletedMapOffset(pointer, pageType, subheaderCount, rowCount int) int {
+
+	align := 0
+	if sas.isPageMixType(pageType) && !sas.NoAlignCorrection {
+		align = (sas.properties.pageBitOffset + subheader_pointers_offset +
+			subheaderCount*sas.properties.subheaderPointerLength) % 8
+	}
+	return sas.properties.pageBitOffset + pointer + align +
+		subheaderCount*sas.properties.subheaderPointerLength + rowCount*sas.properties.rowLength
+}
+
+// readDeletedMap reads the deletion bitmap of the current page.
+func (sas *SAS7BDAT) readDeletedMap() error {
+
+	pointerOffset := page_deleted_pointer_offset_x86
+	if sas.U64 {
+		pointerOffset = page_deleted_pointer_offset_x64
+	}
+	pointer, err := sas.readInt(pointerOffset, page_deleted_pointer_length)
+	if err != nil {
+		return fmt.Errorf("Unable to read deleted rows pointer.")
+	}
+
+	nrows := sas.pageRowCount()
+	offset := sas.deletedMapOffset(pointer, sas.currentPageType, sas.currentPageSubheadersCount, nrows)
+	length := (nrows + 7) / 8
+	if offset < 0 || offset+length > len(sas.cachedPage) {
+		return fmt.Errorf("deleted rows bitmap at offset %d is outside of the page", offset)
+	}
+	sas.currentPageDeleted = sas.cachedPage[offset : offset+length]
+
+	return nil
+}
+
+// DeletedRowCount returns the number of rows that have been deleted
+// from the data set, but are still present in the file and included
+// in the row count of Properties.  The pages are scanned for deleted rows when this is
+// first called, without changing the position of the reader.
+func (sas *SAS7BDAT) DeletedRowCount() int {
+
+	if !sas.deletedRowCounted {
+		n, err := sas.countDeletedRows()
+		if err != nil && !sas.recover {
+			msg := fmt.Sprintf("Warning: unable to count deleted rows: %v\n", err)
+			os.Stderr.WriteString(msg)
+		}
+		sas.deletedRowCount = n
+		sas.deletedRowCounted = true
+	}
+
+	return sas.deletedRowCount
+}
+
+// countDeletedRows reads the header and deletion bitmap of every page,
+// and returns the total number of deleted rows.
+func (sas *SAS7BDAT) countDeletedRows() (int, error) {
+
+	pos, err := sas.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer sas.file.Seek(pos, io.SeekStart)
+
+	pointerOffset := page_deleted_pointer_offset_x86
+	if sas.U64 {
+		pointerOffset = page_deleted_pointer_offset_x64
+	}
+	header := make([]byte, sas.properties.pageBitOffset+subheader_pointers_offset)
+
+	var count int
+	for page := 0; page < sas.properties.pageCount; page++ {
+		offset := int64(sas.properties.headerLength) + int64(page)*int64(sas.properties.pageLength)
+		if _, err := sas.file.Seek(offset, io.SeekStart); err != nil {
+			return count, err
+		}
+		if _, err := io.ReadFull(sas.file, header); err != nil {
+			return count, fmt.Errorf("failed to read header of page %d: %v", page, err)
+		}
+
+		bit_offset := sas.properties.pageBitOffset
+		pageType, _ := sas.readIntFromBuffer(header[bit_offset+page_type_offset:], page_type_length)
+		if pageType&page_deleted_flag == 0 || !sas.isPageMixDataType(pageType) {
+			continue
+		}
+		blockCount, _ := sas.readIntFromBuffer(header[bit_offset+block_count_offset:], block_count_length)
+		subheaderCount, _ := sas.readIntFromBuffer(header[bit_offset+subheader_count_offset:], subheader_count_length)
+		pointer, _ := sas.readIntFromBuffer(header[pointerOffset:], page_deleted_pointer_length)
+
+		nrows := blockCount
+		if sas.isPageMixType(pageType) {
+			nrows = min(sas.rowCount, sas.properties.mixPageRowCount)
+		}
+		bitmap := make([]byte, (nrows+7)/8)
+		mapOffset := sas.deletedMapOffset(pointer, pageType, subheaderCount, nrows)
+		if _, err := sas.file.Seek(offset+int64(mapOffset), io.SeekStart); err != nil {
+			return count, err
+		}
+		if _, err := io.ReadFull(sas.file, bitmap); err != nil {
+			return count, fmt.Errorf("failed to read deleted rows bitmap of page %d: %v", page, err)
+		}
+		for row := 0; row < nrows; row++ {
+			if rowDeleted(bitmap, row) {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+func (sas *SAS7BDAT) readNextPage() (error, bool) {
+
+	if sas.truncated {
+		sas.eof = true
+		return nil, true
+	}
+
+	page := make([]byte, sas.properties.pageLength)
+	n, err := io.ReadFull(sas.file, page)
+	if n <= 0 {
+		if sas.recover && sas.currentPage+1 < sas.properties.pageCount {
+			sas.recovery.addRange(sas.pageOffset(sas.currentPage+1), sas.pageOffset(sas.properties.pageCount))
+		}
+		sas.eof = true
+		return nil, true
+	}
+	sas.currentPageDataSubheaderPointers = make([]*subheaderPointer, 0, 10)
+	sas.cachedPage = page
+	sas.currentPage++
+
+	if err == io.ErrUnexpectedEOF {
+		if !sas.recover {
+			return fmt.Errorf("failed to read complete page from file (read %d of %d bytes)",
+				n, sas.properties.pageLength), false
+		}
+		sas.truncatePage(n)
+	} else if err != nil {
+		return err, false
+	}
+
+	if err := sas.readPageHeader(); err != nil {
+		return sas.skipPage(err)
+	}
+
+	if sas.currentPageType == page_meta_type {
+		err = sas.processPageMetadata()
+		if err != nil {
+			return sas.skipPage(err)
+		}
+	}
+
+	if checkPageType(sas.currentPageType) {
+		return sas.readNextPage()
+	}
+
+	return nil, false
+}
+
+// SeekRow positions the reader so that the next call to Read begins
+// at the given row.  An index of the rows on each page is built as
+// needed, so the first seek to a row near the end of a large file
+// reads the page headers of all preceding pages, but does not decode
+// any data.  Rows are numbered by their position in the file,
+// including any deleted rows.
+func (sas *SAS7BDAT) SeekRow(row int) error {
+
+	if row < 0 || row > sas.rowCount {
+		return fmt.Errorf("row %d is out of range", row)
+	}
+	if row == sas.rowCount {
+		sas.currentRowInFileIndex = row
+		return nil
+	}
+
+	page, err := sas.findPage(row)
+	if err != nil {
+		return sas.decodeError(err, row, "")
+	}
+	if err := sas.loadPage(page); err != nil {
+		return sas.decodeError(err, row, "")
 	}
+	sas.currentRowOnPageIndex = row - sas.pageFirstRow[page]
+	sas.currentRowInFileIndex = row
 
-	return rslt
+	return nil
 }
 
-func date_time(x float64) time.Time {
-	// Timestamp is epoch 01/01/1960
-	base := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
-	return base.Add(time.Duration(x) * time.Second)
+// RowRange returns the range of rows that are read, from first up to
+// but not including end, numbered as for SeekRow.  This is all of
+// the rows in the file unless the reader was created by
+// NewSAS7BDATPartitions.
+func (sas *SAS7BDAT) RowRange() (first, end int) {
+	return sas.firstRow, sas.endRow
 }
 
-func toDateTime(x []float64) []time.Time {
-	rslt := make([]time.Time, len(x))
+// ReadAt returns up to n rows of data beginning at the given row,
+// numbered as for SeekRow.  The reader is left positioned following
+// the last row that is returned.  See Read for more information.
+func (sas *SAS7BDAT) ReadAt(row, n int) ([]*Series, error) {
 
-	for j, v := range x {
-		rslt[j] = date_time(v)
+	if err := sas.SeekRow(row); err != nil {
+		return nil, err
 	}
 
-	return rslt
+	return sas.Read(n)
 }
 
-func (sas *SAS7BDAT) readline() (error, bool) {
-
-	bit_offset := sas.properties.pageBitOffset
-	subheaderPointerLength := sas.properties.subheaderPointerLength
+// findPage returns the page containing the given row, extending the
+// page index as needed.
+func (sas *SAS7BDAT) findPage(row int) (int, error) {
 
-	// If there is no page, go to the end of the header and read a page.
-	if sas.cachedPage == nil {
-		if _, err := sas.file.Seek(int64(sas.properties.headerLength), 0); err != nil {
-			return err, false
-		}
-		err, done := sas.readNextPage()
-		if err != nil {
-			return err, false
-		} else if done {
-			return nil, true
-		}
+	if sas.pageFirstRow == nil {
+		sas.pageFirstRow = []int{0}
 	}
 
-	// Loop until a data row is read
 	for {
-		if sas.currentPageType == page_meta_type {
-			if sas.currentRowOnPageIndex >= len(sas.currentPageDataSubheaderPointers) {
-				err, done := sas.readNextPage()
-				if err != nil {
-					return err, false
-				} else if done {
-					return nil, true
-				}
-				sas.currentRowOnPageIndex = 0
-				continue
-			}
-			current_subheader_pointer := sas.currentPageDataSubheaderPointers[sas.currentRowOnPageIndex]
-			err := sas.processByteArrayWithData(current_subheader_pointer.offset, current_subheader_pointer.length)
-			if err != nil {
-				return err, false
-			}
-			return nil, false
-		} else if sas.isPageMixType(sas.currentPageType) {
-			alignCorrection := (bit_offset + subheader_pointers_offset +
-				sas.currentPageSubheadersCount*subheaderPointerLength) % 8
-			if sas.NoAlignCorrection {
-				alignCorrection = 0
-			}
-			offset := bit_offset + subheader_pointers_offset +
-				sas.currentPageSubheadersCount*subheaderPointerLength +
-				sas.currentRowOnPageIndex*sas.properties.rowLength +
-				alignCorrection
-			err := sas.processByteArrayWithData(offset, sas.properties.rowLength)
-			if err != nil {
-				return err, false
-			}
-			if sas.currentRowOnPageIndex == min(sas.rowCount, sas.properties.mixPageRowCount) {
-				err, done := sas.readNextPage()
-				if err != nil {
-					return err, false
-				} else if done {
-					return nil, true
-				}
-				sas.currentRowOnPageIndex = 0
-			}
-			return nil, false
-		} else if sas.currentPageType == page_data_type {
-			err := sas.processByteArrayWithData(
-				bit_offset+subheader_pointers_offset+sas.currentRowOnPageIndex*sas.properties.rowLength,
-				sas.properties.rowLength)
-			if err != nil {
-				return err, false
-			}
-			if sas.currentRowOnPageIndex == sas.currentPageBlockCount {
-				err, done := sas.readNextPage()
-				if err != nil {
-					return err, false
-				} else if done {
-					return nil, true
-				}
-				sas.currentRowOnPageIndex = 0
-			}
-			return nil, false
-		} else {
-			return fmt.Errorf("unknown page type: %d", sas.currentPageType), false
+		npage := len(sas.pageFirstRow) - 1
+		if row < sas.pageFirstRow[npage] {
+			break
+		}
+		if npage >= sas.properties.pageCount {
+			return 0, fmt.Errorf("row %d not found in file", row)
+		}
+		if err := sas.loadPage(npage); err != nil {
+			return 0, err
 		}
+		sas.pageFirstRow = append(sas.pageFirstRow, sas.pageFirstRow[npage]+sas.pageRowCount())
 	}
+
+	page := sort.Search(len(sas.pageFirstRow), func(p int) bool {
+		return sas.pageFirstRow[p] > row
+	})
+
+	return page - 1, nil
 }
 
-func (sas *SAS7BDAT) readNextPage() (error, bool) {
+// loadPage reads the given page into the page cache.  Unlike
+// readNextPage, only the data subheaders of meta pages are processed.
+func (sas *SAS7BDAT) loadPage(page int) error {
 
-	sas.currentPageDataSubheaderPointers = make([]*subheaderPointer, 0, 10)
-	sas.cachedPage = make([]byte, sas.properties.pageLength)
-	n, err := sas.file.Read(sas.cachedPage)
-	if n <= 0 {
-		return nil, true
+	sas.currentPage = page
+	sas.eof = false
+	offset := int64(sas.properties.headerLength) + int64(page)*int64(sas.properties.pageLength)
+	if _, err := sas.file.Seek(offset, 0); err != nil {
+		return err
 	}
 
-	if err != nil && err != io.EOF {
-		return err, false
+	sas.cachedPage = make([]byte, sas.properties.pageLength)
+	if _, err := io.ReadFull(sas.file, sas.cachedPage); err != nil {
+		return fmt.Errorf("failed to read page %d: %v", page, err)
 	}
 
-	if len(sas.cachedPage) != sas.properties.pageLength {
-		return fmt.Errorf("failed to read complete page from file (read %d of %d bytes)",
-			len(sas.cachedPage), sas.properties.pageLength), false
+	if err := sas.readPageHeader(); err != nil {
+		return err
 	}
 
-	if err := sas.readPageHeader(); err != nil {
-		return err, false
+	sas.currentPageDataSubheaderPointers = make([]*subheaderPointer, 0, 10)
+	if sas.currentPageType != page_meta_type {
+		return nil
 	}
 
-	if sas.currentPageType == page_meta_type {
-		err = sas.processPageMetadata()
+	bit_offset := sas.properties.pageBitOffset
+	for i := 0; i < sas.currentPageSubheadersCount; i++ {
+		pointer, err := sas.processSubheaderPointers(subheader_pointers_offset+bit_offset, i)
 		if err != nil {
-			return err, false
+			return err
+		}
+		if pointer.length == 0 || pointer.compression == truncated_subheader_id {
+			continue
+		}
+		subheader_signature, err := sas.readSubheaderSignature(pointer.offset)
+		if err != nil {
+			return err
+		}
+		subheader_index, err := sas.getSubheaderIndex(subheader_signature,
+			pointer.compression, pointer.ptype)
+		if err == nil && subheader_index == dataSubheaderIndex {
+			sas.currentPageDataSubheaderPointers = append(sas.currentPageDataSubheaderPointers, pointer)
 		}
 	}
 
-	if checkPageType(sas.currentPageType) {
-		return sas.readNextPage()
-	}
+	return nil
+}
 
-	return nil, false
+// pageRowCount returns the number of data rows on the current page.
+func (sas *SAS7BDAT) pageRowCount() int {
+
+	switch {
+	case sas.currentPageType == page_meta_type:
+		return len(sas.currentPageDataSubheaderPointers)
+	case sas.isPageMixType(sas.currentPageType):
+		return min(sas.rowCount, sas.properties.mixPageRowCount)
+	case isPageDataType(sas.currentPageType):
+		return sas.currentPageBlockCount
+	}
+	return 0
 }
 
 func (sas *SAS7BDAT) getProperties() error {
@@ -954,8 +2175,19 @@ func (sas *SAS7BDAT) getProperties() error {
 	encoding, ok := encoding_names[xb]
 	if ok {
 		sas.FileEncoding = encoding
+		enc, ok := encoding_decoders[encoding]
+		if !ok {
+			msg := fmt.Sprintf("Warning: cannot decode SAS encoding %s, strings will not be decoded\n", encoding)
+			os.Stderr.WriteString(msg)
+		} else if enc != nil {
+			sas.fileDecoder = enc.NewDecoder()
+		}
 	} else {
 		sas.FileEncoding = fmt.Sprintf("encoding code=%d", xb)
+		if xb != 0 {
+			msg := fmt.Sprintf("Warning: unknown SAS encoding code %d, strings will not be decoded\n", xb)
+			os.Stderr.WriteString(msg)
+		}
 	}
 
 	err = sas.readBytes(dataset_offset, dataset_length)
@@ -990,24 +2222,42 @@ func (sas *SAS7BDAT) getProperties() error {
 		os.Stderr.WriteString(fmt.Sprintf("header length %d != 8192\n", prop.headerLength))
 	}
 
-	// Read the rest of the header into cachedPage.
-	v := make([]byte, prop.headerLength-288)
-	if _, err := sas.file.Read(v); err != nil {
+	if prop.headerLength < 288 {
+		return fmt.Errorf("invalid header length %d", prop.headerLength)
+	}
+	if err := sas.limits.checkSize("header", int64(prop.headerLength), sas.fileSize); err != nil {
 		return err
 	}
-	sas.cachedPage = append(sas.cachedPage, v...)
-	if len(sas.cachedPage) != prop.headerLength {
+
+	// Read the rest of the header into cachedPage.
+	v := make([]byte, prop.headerLength-288)
+	if _, err := io.ReadFull(sas.file, v); err != nil {
 		return fmt.Errorf("The SAS7BDAT file appears to be truncated.")
 	}
+	sas.cachedPage = append(sas.cachedPage, v...)
 
 	prop.pageLength, err = sas.readInt(page_size_offset+align1, page_size_length)
 	if err != nil {
 		return fmt.Errorf("Unable to read the page size value.")
 	}
-	prop.pageCount, err = sas.readInt(page_count_offset+align1, page_count_length)
+	if prop.pageLength <= 0 {
+		return fmt.Errorf("invalid page length %d", prop.pageLength)
+	}
+	if err := sas.limits.checkSize("page", int64(prop.pageLength), sas.fileSize-int64(prop.headerLength)); err != nil {
+		return err
+	}
+	// The page count is an 8 byte value in 64 bit files
+	pageCountLength := page_count_length
+	if sas.U64 {
+		pageCountLength = 8
+	}
+	prop.pageCount, err = sas.readInt(page_count_offset+align1, pageCountLength)
 	if err != nil {
 		return fmt.Errorf("Unable to read the page count value.")
 	}
+	if sas.limits != nil && int64(prop.pageCount) > (sas.fileSize-int64(prop.headerLength))/int64(prop.pageLength) {
+		return fmt.Errorf("page count %d is too large for the file size %d", prop.pageCount, sas.fileSize)
+	}
 
 	err = sas.readBytes(sas_release_offset+total_align, sas_release_length)
 	if err != nil {
@@ -1060,6 +2310,17 @@ func (sas *SAS7BDAT) readPageHeader() error {
 	if err != nil {
 		return fmt.Errorf("Unable to read subheader count value.")
 	}
+	if sas.currentPageBlockCount < 0 || sas.currentPageSubheadersCount < 0 {
+		return fmt.Errorf("invalid block count %d or subheader count %d",
+			sas.currentPageBlockCount, sas.currentPageSubheadersCount)
+	}
+
+	sas.currentPageDeleted = nil
+	if sas.currentPageType&page_deleted_flag != 0 && sas.isPageMixDataType(sas.currentPageType) {
+		if err := sas.readDeletedMap(); err != nil && !(sas.recover && sas.truncated) {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -1197,60 +2458,56 @@ func (sas *SAS7BDAT) getSubheaderIndex(signature []byte, compression, ptype int)
 func (sas *SAS7BDAT) processByteArrayWithData(offset, length int) error {
 
 	var source []byte
-	if sas.Compression != "" && length < sas.properties.rowLength {
-		decompressor := sas.getDecompressor()
-		var err error
-		source, err = decompressor(sas.properties.rowLength, sas.cachedPage[offset:offset+length])
-		if err != nil {
-			return err
+	compressed := sas.Compression != "" && length < sas.properties.rowLength
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid row position %d or length %d", offset, length)
+	}
+	if compressed {
+		if offset+length > len(sas.cachedPage) {
+			return fmt.Errorf("compressed row at offset %d with length %d is outside of the page", offset, length)
+		}
+		source = sas.cachedPage[offset : offset+length]
+		if !sas.queueRows {
+			decompressor := sas.getDecompressor()
+			var err error
+			source, err = decompressor(sas.properties.rowLength, source)
+			if err != nil {
+				return err
+			}
 		}
 	} else {
 		if offset+length > len(sas.cachedPage) {
 			oldPage := sas.cachedPage
-			err, ok := sas.readNextPage()
-			if err != nil || !ok {
+			if err := sas.limits.checkAlloc("page bytes", int64(len(oldPage)+sas.properties.pageLength), 1); err != nil {
+				return err
+			}
+			err, done := sas.readNextPage()
+			if err != nil || done {
 				return fmt.Errorf("error reading next page - %v", err)
 			}
 			sas.cachedPage = append(oldPage, sas.cachedPage...)
+			if offset+length > len(sas.cachedPage) {
+				return fmt.Errorf("row at offset %d with length %d is outside of the page", offset, length)
+			}
 		}
 		source = sas.cachedPage[offset : offset+length]
 	}
 
-	for j := 0; j < sas.properties.columnCount; j++ {
-		length := sas.columnDataLengths[j]
-		if length == 0 {
-			break
-		}
-		start := sas.columnDataOffsets[j]
-		end := start + length
-		temp := source[start:end]
-		if sas.columns[j].ctype == SASNumericType {
-			s := 8 * sas.currentRowInChunkIndex
-			if sas.ByteOrder == binary.LittleEndian {
-				m := 8 - length
-				copy(sas.bytechunk[j][s+m:s+8], temp)
-			} else {
-				copy(sas.bytechunk[j][s:s+length], temp)
-			}
-		} else {
-			if sas.TrimStrings {
-				temp = bytes.TrimRight(temp, "\u0000\u0020")
-			}
-			if sas.TextDecoder != nil {
-				var err error
-				temp, err = sas.TextDecoder.Bytes(temp)
-				if err != nil {
-					panic(err)
-				}
+	if sas.queueRows {
+		// The row is decoded by a worker
+		sas.rowBatch = append(sas.rowBatch, rowJob{sas.currentRowInChunkIndex, sas.currentPage,
+			sas.currentRowInFileIndex, source, compressed})
+	} else {
+		sas.storeNumeric(source, sas.currentRowInChunkIndex)
+		for k, j := range sas.selected {
+			length := sas.columnDataLengths[j]
+			if length == 0 || sas.columns[j].ctype != SASStringType {
+				continue
 			}
-
-			k, ok := sas.stringPoolR[string(temp)]
-			if !ok {
-				k = uint64(len(sas.stringPool))
-				sas.stringPool[k] = string(temp)
-				sas.stringPoolR[string(temp)] = k
+			start := sas.columnDataOffsets[j]
+			if err := sas.storeString(k, sas.currentRowInChunkIndex, source[start:start+length]); err != nil {
+				return sas.decodeError(err, sas.currentRowInFileIndex, sas.columnNames[j])
 			}
-			sas.stringchunk[j][sas.currentRowInChunkIndex] = k
 		}
 	}
 
@@ -1260,6 +2517,61 @@ func (sas *SAS7BDAT) processByteArrayWithData(offset, length int) error {
 	return nil
 }
 
+// storeNumeric copies the numeric values in the given row data into
+// the current chunk.  Calls for different rows can run concurrently.
+func (sas *SAS7BDAT) storeNumeric(source []byte, row int) {
+
+	for k, j := range sas.selected {
+		length := sas.columnDataLengths[j]
+		if length == 0 || sas.columns[j].ctype != SASNumericType {
+			continue
+		}
+		start := sas.columnDataOffsets[j]
+		temp := source[start : start+length]
+		s := 8 * row
+		if sas.ByteOrder == binary.LittleEndian {
+			m := 8 - length
+			copy(sas.bytechunk[k][s+m:s+8], temp)
+		} else {
+			copy(sas.bytechunk[k][s:s+length], temp)
+		}
+	}
+}
+
+// storeString trims and decodes a string value, then stores its code
+// in position row of selected column k of the current chunk.  With
+// RawStrings, the bytes are copied to the arena of the column instead.
+func (sas *SAS7BDAT) storeString(k, row int, temp []byte) error {
+
+	if sas.TrimStrings {
+		temp = bytes.TrimRight(temp, "\u0000\u0020")
+	}
+	if sas.rawchunk[k] != nil {
+		arena := sas.rawarena[k]
+		start := len(arena)
+		arena = append(arena, temp...)
+		sas.rawchunk[k][row] = arena[start:len(arena):len(arena)]
+		sas.rawarena[k] = arena
+		return nil
+	}
+	if sas.TextDecoder != nil {
+		var err error
+		temp, err = sas.TextDecoder.Bytes(temp)
+		if err != nil {
+			return fmt.Errorf("unable to decode string: %v", err)
+		}
+	} else if sas.fileDecoder != nil && !sas.NoTextDecoding {
+		var err error
+		temp, err = sas.fileDecoder.Bytes(temp)
+		if err != nil {
+			return fmt.Errorf("unable to decode string: %v", err)
+		}
+	}
+
+	sas.stringchunk[k][row] = sas.dict(k).code(temp)
+	return nil
+}
+
 func (sas *SAS7BDAT) processRowSizeSubheader(offset, length int) error {
 
 	int_len := sas.properties.intLength
@@ -1418,13 +2730,34 @@ func (sas *SAS7BDAT) processColumnNameSubheader(offset, length int) error {
 			return fmt.Errorf("Unable to read column name length.")
 		}
 
-		name_str := sas.columnNamesStrings[idx]
-		sas.columnNames = append(sas.columnNames, name_str[col_offset:col_offset+col_len])
+		name, err := sas.columnText(idx, col_offset, col_len)
+		if err != nil {
+			return fmt.Errorf("column name: %v", err)
+		}
+		sas.columnNames = append(sas.columnNames, name)
 	}
 
 	return nil
 }
 
+// columnText returns the text at the given position of the given
+// column text subheader.
+func (sas *SAS7BDAT) columnText(idx, start, length int) (string, error) {
+
+	if length == 0 {
+		return "", nil
+	}
+	if idx < 0 || idx >= len(sas.columnNamesStrings) {
+		return "", fmt.Errorf("text subheader %d not found", idx)
+	}
+	text := sas.columnNamesStrings[idx]
+	if start < 0 || length < 0 || start+length > len(text) {
+		return "", fmt.Errorf("text at offset %d with length %d is outside of the text subheader", start, length)
+	}
+
+	return text[start : start+length], nil
+}
+
 func (sas *SAS7BDAT) processColumnListSubheader(offset, length int) error {
 	// unknown purpose
 	return nil
@@ -1478,29 +2811,60 @@ func (sas *SAS7BDAT) processFormatSubheader(offset, length int) error {
 
 	format_idx, _ := sas.readInt(text_subheader_format, column_format_text_subheader_index_length)
 	format_idx = min(format_idx, len(sas.columnNamesStrings)-1)
+	if format_idx < 0 {
+		format_idx = 0
+	}
 
 	format_start, _ := sas.readInt(col_format_offset, column_format_offset_length)
 	format_len, _ := sas.readInt(col_format_len, column_format_length_length)
 
 	label_idx, _ := sas.readInt(text_subheader_label, column_label_text_subheader_index_length)
 	label_idx = min(label_idx, len(sas.columnNamesStrings)-1)
+	if label_idx < 0 {
+		label_idx = 0
+	}
 
 	label_start, _ := sas.readInt(col_label_offset, column_label_offset_length)
 	label_len, _ := sas.readInt(col_label_len, column_label_length_length)
 
-	label_names := sas.columnNamesStrings[label_idx]
-	column_label := label_names[label_start : label_start+label_len]
-	format_names := sas.columnNamesStrings[format_idx]
-	column_format := format_names[format_start : format_start+format_len]
+	column_label, err := sas.columnText(label_idx, label_start, label_len)
+	if err != nil {
+		return fmt.Errorf("column label: %v", err)
+	}
+	column_format, err := sas.columnText(format_idx, format_start, format_len)
+	if err != nil {
+		return fmt.Errorf("column format: %v", err)
+	}
 	current_column_number := len(sas.columns)
+	if current_column_number >= len(sas.columnNames) || current_column_number >= len(sas.columnTypes) ||
+		current_column_number >= len(sas.columnDataOffsets) || current_column_number >= len(sas.columnDataLengths) {
+		return fmt.Errorf("format found for column %d, which has no name or attributes", current_column_number)
+	}
+
+	base := offset + 3*int_len
+	format_width, _ := sas.readInt(base+column_format_width_offset, column_format_width_length)
+	format_decimals, _ := sas.readInt(base+column_format_decimals_offset, column_format_width_length)
+	informat_width, _ := sas.readInt(base+column_informat_width_offset, column_format_width_length)
+	informat_decimals, _ := sas.readInt(base+column_informat_decimals_offset, column_format_width_length)
+
+	informat_idx, _ := sas.readInt(base+column_informat_text_subheader_offset, column_format_text_subheader_index_length)
+	informat_start, _ := sas.readInt(base+column_informat_offset_offset, column_format_offset_length)
+	informat_len, _ := sas.readInt(base+column_informat_length_offset, column_format_length_length)
+	column_informat, _ := sas.columnText(informat_idx, informat_start, informat_len)
 
 	col := &column{
-		colId:  current_column_number,
-		name:   sas.columnNames[current_column_number],
-		label:  column_label,
-		format: column_format,
-		ctype:  sas.columnTypes[current_column_number],
-		length: sas.columnDataLengths[current_column_number],
+		colId:            current_column_number,
+		name:             sas.columnNames[current_column_number],
+		label:            column_label,
+		format:           column_format,
+		formatWidth:      format_width,
+		formatDecimals:   format_decimals,
+		informat:         column_informat,
+		informatWidth:    informat_width,
+		informatDecimals: informat_decimals,
+		ctype:            sas.columnTypes[current_column_number],
+		offset:           sas.columnDataOffsets[current_column_number],
+		length:           sas.columnDataLengths[current_column_number],
 	}
 
 	sas.columnLabels = append(sas.columnLabels, column_label)
@@ -1510,38 +2874,209 @@ func (sas *SAS7BDAT) processFormatSubheader(offset, length int) error {
 	return nil
 }
 
-// RowCount returns the number of rows in the data set.
+// RowCount returns the number of rows in the data set.  Deleted rows
+// are not counted unless IncludeDeleted is set.  The row count in the
+// file header, which includes the deleted rows and gives the
+// numbering used by SeekRow, ReadAt and RowRange, is available from
+// Properties.
 func (sas *SAS7BDAT) RowCount() int {
-	return sas.rowCount
+	if sas.IncludeDeleted {
+		return sas.rowCount
+	}
+	return sas.rowCount - sas.DeletedRowCount()
 }
 
-// ColumnNames returns the names of the columns.
+// ColumnNames returns the names of the columns (only the selected
+// columns if SelectColumns has been called).
 func (sas *SAS7BDAT) ColumnNames() []string {
-	return sas.columnNames
+	if sas.allSelected() && !sas.IncludeDeleted {
+		return sas.columnNames
+	}
+	names := make([]string, len(sas.selected))
+	for k, j := range sas.selected {
+		names[k] = sas.columnNames[j]
+	}
+	if sas.IncludeDeleted {
+		names = append(names, deletedColumnName)
+	}
+	return names
 }
 
-// ColumnLabels returns the column labels.
+// ColumnLabels returns the column labels (only the selected columns
+// if SelectColumns has been called).
 func (sas *SAS7BDAT) ColumnLabels() []string {
-	return sas.columnLabels
+	if sas.allSelected() && !sas.IncludeDeleted {
+		return sas.columnLabels
+	}
+	labels := make([]string, len(sas.selected))
+	for k, j := range sas.selected {
+		labels[k] = sas.columnLabels[j]
+	}
+	if sas.IncludeDeleted {
+		labels = append(labels, "Deleted row indicator")
+	}
+	return labels
+}
+
+// ColumnInfo describes a column of a data file, as stored in the
+// file metadata.
+type ColumnInfo struct {
+
+	// The position of the column in the file, -1 for the deleted
+	// row indicator added when IncludeDeleted is set
+	Index int
+
+	Name  string
+	Label string
+	Type  ColumnTypeT
+
+	// The name of the format (e.g. "DATE" for the format DATE9.),
+	// with its width and number of decimals, which are zero if not
+	// given
+	Format         string
+	FormatWidth    int
+	FormatDecimals int
+
+	// The informat, described in the same way as the format
+	Informat         string
+	InformatWidth    int
+	InformatDecimals int
+
+	// The byte offset of the column within a row, and the number of
+	// bytes used to store each value
+	Offset int
+	Length int
 }
 
-// ColumnTypes returns integer codes for the column data types.
+// Columns returns the metadata for each column (only the selected
+// columns if SelectColumns has been called).
+func (sas *SAS7BDAT) Columns() []ColumnInfo {
+
+	var info []ColumnInfo
+	for _, j := range sas.selected {
+		c := sas.columns[j]
+		info = append(info, ColumnInfo{
+			Index:            j,
+			Name:             c.name,
+			Label:            c.label,
+			Type:             c.ctype,
+			Format:           c.format,
+			FormatWidth:      c.formatWidth,
+			FormatDecimals:   c.formatDecimals,
+			Informat:         c.informat,
+			InformatWidth:    c.informatWidth,
+			InformatDecimals: c.informatDecimals,
+			Offset:           c.offset,
+			Length:           c.length,
+		})
+	}
+	if sas.IncludeDeleted {
+		info = append(info, ColumnInfo{
+			Index: -1,
+			Name:  deletedColumnName,
+			Label: "Deleted row indicator",
+			Type:  SASNumericType,
+		})
+	}
+
+	return info
+}
+
+// ColumnTypes returns integer codes for the column data types (only
+// the selected columns if SelectColumns has been called).
 func (sas *SAS7BDAT) ColumnTypes() []ColumnTypeT {
-	return sas.columnTypes
+	if sas.allSelected() && !sas.IncludeDeleted {
+		return sas.columnTypes
+	}
+	types := make([]ColumnTypeT, len(sas.selected))
+	for k, j := range sas.selected {
+		types[k] = sas.columnTypes[j]
+	}
+	if sas.IncludeDeleted {
+		types = append(types, SASNumericType)
+	}
+	return types
+}
+
+// SelectColumns restricts reading to the columns at the given
+// positions (in the full list of columns in the file).  The columns
+// are returned by Read in the given order.  Only the selected columns
+// are decoded, which is much faster than reading all columns when
+// only a few are needed.  Calling SelectColumns with no arguments
+// selects all columns.
+func (sas *SAS7BDAT) SelectColumns(cols ...int) error {
+
+	ncol := sas.properties.columnCount
+	if len(cols) == 0 {
+		cols = make([]int, ncol)
+		for j := range cols {
+			cols[j] = j
+		}
+	}
+
+	formats := make([]string, len(cols))
+	for k, j := range cols {
+		if j < 0 || j >= ncol {
+			return fmt.Errorf("column position %d out of range", j)
+		}
+		formats[k] = sas.columns[j].format
+	}
+
+	sas.selected = make([]int, len(cols))
+	copy(sas.selected, cols)
+	sas.ColumnFormats = formats
+
+	return nil
+}
+
+// SelectColumnsByName restricts reading to the columns with the given
+// names.  See SelectColumns for more information.
+func (sas *SAS7BDAT) SelectColumnsByName(names ...string) error {
+
+	pos := make(map[string]int)
+	for j, na := range sas.columnNames {
+		pos[na] = j
+	}
+
+	cols := make([]int, len(names))
+	for k, na := range names {
+		j, ok := pos[na]
+		if !ok {
+			return fmt.Errorf("unknown column name: %s", na)
+		}
+		cols[k] = j
+	}
+
+	return sas.SelectColumns(cols...)
+}
+
+// allSelected returns true if all columns are read, in file order.
+func (sas *SAS7BDAT) allSelected() bool {
+	if len(sas.selected) != len(sas.columnNames) {
+		return false
+	}
+	for k, j := range sas.selected {
+		if k != j {
+			return false
+		}
+	}
+	return true
 }
 
 func (sas *SAS7BDAT) parseMetadata() error {
 
 	for {
-		n, err := sas.file.Read(sas.cachedPage)
+		n, err := io.ReadFull(sas.file, sas.cachedPage)
 		if n <= 0 {
 			break
 		}
-		if err != nil {
-			return err
-		}
-		if n != sas.properties.pageLength {
+		sas.currentPage++
+		if err == io.ErrUnexpectedEOF && sas.recover {
+			sas.truncatePage(n)
+		} else if err == io.ErrUnexpectedEOF {
 			return fmt.Errorf("Failed to read a meta data page from the SAS file.")
+		} else if err != nil {
+			return err
 		}
 		var done bool
 		if done, err = sas.processPageMeta(); err != nil {
@@ -1588,7 +3123,15 @@ func (sas *SAS7BDAT) isPageMixType(val int) bool {
 
 func (sas *SAS7BDAT) isPageMixDataType(val int) bool {
 	switch val {
-	case 512, 640, 256:
+	case 512, 640, 256, 384:
+		return true
+	}
+	return false
+}
+
+func isPageDataType(val int) bool {
+	switch val {
+	case page_data_type, page_data_type | page_deleted_flag:
 		return true
 	}
 	return false
@@ -1596,7 +3139,7 @@ func (sas *SAS7BDAT) isPageMixDataType(val int) bool {
 
 func checkPageType(current_page int) bool {
 	switch current_page {
-	case page_meta_type, page_data_type, 512, 640:
+	case page_meta_type, page_data_type, 384, 512, 640:
 		return false
 	}
 	return true
@@ -0,0 +1,776 @@
+package datareader
+
+// Write SAS7BDAT files with go.
+//
+// The files are written without compression, using one or more meta
+// pages holding the subheaders that describe the columns, followed by
+// data pages holding the rows.  The layout follows the description
+// of the format used by the reader in sas7bdat.go.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SAS7BDATColumn describes a column of a SAS7BDAT file written by a
+// SAS7BDATWriter.
+type SAS7BDATColumn struct {
+
+	// The column name, at most 32 bytes long
+	Name string
+
+	// The column label, at most 256 bytes long
+	Label string
+
+	// The SAS format of the column, e.g. "DATE9." or "8.2", may
+	// be empty
+	Format string
+
+	// The data type, SASNumericType or SASStringType
+	Type ColumnTypeT
+
+	// The width in bytes of a string column.  Numeric values are
+	// always stored in 8 bytes.
+	Length int
+}
+
+// SAS7BDATWriter writes data to a file in SAS7BDAT format.  The
+// configuration fields must be set before the first call to Write.
+type SAS7BDATWriter struct {
+
+	// If true, the 64 bit layout is written, otherwise the 32 bit
+	// layout is written
+	U64 bool
+
+	// The byte order of the file, little endian if nil
+	ByteOrder binary.ByteOrder
+
+	// The data set name stored in the file header
+	Name string
+
+	// The length of the pages in bytes, 65536 if zero.  The pages
+	// are enlarged if a row does not fit on a page.
+	PageLength int
+
+	// The creation and modification time stored in the file
+	// header, the current time if zero
+	DateCreated time.Time
+
+	w       io.WriteSeeker
+	columns []SAS7BDATColumn
+
+	// The position of each column within a row, and the row length
+	offsets   []int
+	rowLength int
+
+	intLength     int
+	pageBitOffset int
+	headerLength  int
+	pageLength    int
+	rowsPerPage   int
+
+	// The file position of the header, and of the row count in
+	// the row size subheader, which are updated by Close
+	start       int64
+	rowCountPos int64
+
+	// The current data page, and the number of rows on it
+	page     []byte
+	pageRows int
+
+	pageCount int
+	rowCount  int
+	started   bool
+	closed    bool
+}
+
+// The default page length of written files.
+const sasWriterPageLength = 65536
+
+// Subheader signatures, as integers written in the byte order of
+// the file with the integer length of the file.
+const (
+	rowSizeSignature          = 0xF7F7F7F7
+	columnSizeSignature       = 0xF6F6F6F6
+	columnTextSignature       = -3
+	columnNameSignature       = -1
+	columnAttributesSignature = -4
+	formatAndLabelSignature   = -1026
+)
+
+// The largest text block held by a column text subheader.  Offsets
+// into the text blocks are stored as signed 16 bit integers.
+const maxTextBlockLength = 32000
+
+// The base time for SAS dates and datetimes.
+var sasEpoch = time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// sasSeconds returns the SAS datetime value of t, the seconds since
+// 1960.  A time.Duration only spans about 292 years, so the seconds
+// are found from the Unix times.
+func sasSeconds(t time.Time) float64 {
+	return float64(t.Unix()-sasEpoch.Unix()) + float64(t.Nanosecond())/1e9
+}
+
+// NewSAS7BDATWriter returns a writer that writes data with the given
+// columns to w in SAS7BDAT format.  The data are written with Write,
+// then Close must be called to complete the file.
+func NewSAS7BDATWriter(w io.WriteSeeker, columns []SAS7BDATColumn) (*SAS7BDATWriter, error) {
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns to write")
+	}
+
+	sw := &SAS7BDATWriter{
+		w:       w,
+		columns: make([]SAS7BDATColumn, len(columns)),
+		offsets: make([]int, len(columns)),
+	}
+	copy(sw.columns, columns)
+
+	names := make(map[string]bool)
+	for j, c := range sw.columns {
+		if c.Name == "" || len(c.Name) > 32 {
+			return nil, fmt.Errorf("column %d: name %q must have between 1 and 32 bytes", j, c.Name)
+		}
+		uname := strings.ToUpper(c.Name)
+		if names[uname] {
+			return nil, fmt.Errorf("column %d: duplicate name %q", j, c.Name)
+		}
+		names[uname] = true
+		if len(c.Label) > 256 {
+			return nil, fmt.Errorf("column %s: label is longer than 256 bytes", c.Name)
+		}
+		if len(c.Format) > 32 {
+			return nil, fmt.Errorf("column %s: format is longer than 32 bytes", c.Name)
+		}
+		switch c.Type {
+		case SASNumericType:
+			sw.columns[j].Length = 8
+		case SASStringType:
+			if c.Length < 1 || c.Length > 32767 {
+				return nil, fmt.Errorf("column %s: string length %d is not between 1 and 32767", c.Name, c.Length)
+			}
+		default:
+			return nil, fmt.Errorf("column %s: unknown type %d", c.Name, c.Type)
+		}
+		sw.offsets[j] = sw.rowLength
+		sw.rowLength += sw.columns[j].Length
+	}
+
+	return sw, nil
+}
+
+// Write appends the rows in data to the file.  The Series must be in
+// the same order as the columns passed to NewSAS7BDATWriter, and have
+// the same length.  Numeric columns may hold float or integer values,
+// time.Time values (stored as SAS dates if the column has a date
+// format, otherwise as SAS datetimes), or time.Duration values
+// (stored as seconds).  String columns must hold string values, which
+// are stored as UTF-8 and must fit within the column length.
+func (sw *SAS7BDATWriter) Write(data []*Series) error {
+
+	if sw.closed {
+		return fmt.Errorf("write to closed SAS7BDATWriter")
+	}
+	if len(data) != len(sw.columns) {
+		return fmt.Errorf("received %d columns, expected %d", len(data), len(sw.columns))
+	}
+
+	if !sw.started {
+		if err := sw.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	n := data[0].Length()
+	numeric := make([][]float64, len(data))
+	strs := make([][]string, len(data))
+	for j, s := range data {
+		if s.Length() != n {
+			return fmt.Errorf("column %s has length %d, expected %d", sw.columns[j].Name, s.Length(), n)
+		}
+		var err error
+		if sw.columns[j].Type == SASNumericType {
+			numeric[j], err = sw.numericValues(j, s)
+		} else {
+			strs[j], err = sasStringValues(sw.columns[j].Name, sw.columns[j].Length, sw.rowCount, s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		row := sw.page[sw.pageBitOffset+subheader_pointers_offset+sw.pageRows*sw.rowLength:]
+		for j, c := range sw.columns {
+			b := row[sw.offsets[j] : sw.offsets[j]+c.Length]
+			if c.Type == SASNumericType {
+				sw.byteOrder().PutUint64(b, math.Float64bits(numeric[j][i]))
+			} else {
+				copy(b, strs[j][i])
+				for k := len(strs[j][i]); k < len(b); k++ {
+					b[k] = ' '
+				}
+			}
+		}
+		sw.pageRows++
+		sw.rowCount++
+		if sw.pageRows == sw.rowsPerPage {
+			if err := sw.flushPage(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close writes the final data page and updates the row and page
+// counts in the file.  It does not close the underlying writer.
+func (sw *SAS7BDATWriter) Close() error {
+
+	if sw.closed {
+		return nil
+	}
+	if !sw.started {
+		if err := sw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	sw.closed = true
+
+	if sw.pageRows > 0 {
+		if err := sw.flushPage(); err != nil {
+			return err
+		}
+	}
+
+	end, err := sw.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8)
+	align1 := 0
+	pageCountLength := page_count_length
+	if sw.U64 {
+		align1 = 4
+		pageCountLength = 8
+	}
+	sw.putInt(buf, pageCountLength, int64(sw.pageCount))
+	if err := sw.writeAt(buf[0:pageCountLength], sw.start+int64(page_count_offset+align1)); err != nil {
+		return err
+	}
+	sw.putInt(buf, sw.intLength, int64(sw.rowCount))
+	if err := sw.writeAt(buf[0:sw.intLength], sw.rowCountPos); err != nil {
+		return err
+	}
+
+	_, err = sw.w.Seek(end, io.SeekStart)
+	return err
+}
+
+// RowCount returns the number of rows written so far.
+func (sw *SAS7BDATWriter) RowCount() int {
+	return sw.rowCount
+}
+
+func (sw *SAS7BDATWriter) byteOrder() binary.ByteOrder {
+	if sw.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return sw.ByteOrder
+}
+
+// putInt stores x in b as an integer of the given width.
+func (sw *SAS7BDATWriter) putInt(b []byte, width int, x int64) {
+	switch width {
+	case 1:
+		b[0] = byte(x)
+	case 2:
+		sw.byteOrder().PutUint16(b, uint16(x))
+	case 4:
+		sw.byteOrder().PutUint32(b, uint32(x))
+	case 8:
+		sw.byteOrder().PutUint64(b, uint64(x))
+	default:
+		panic("invalid integer width")
+	}
+}
+
+func (sw *SAS7BDATWriter) writeAt(b []byte, pos int64) error {
+	if _, err := sw.w.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(b)
+	return err
+}
+
+// sasNumericValues returns the values of Series s, which is written
+// to the column with the given name and SAS format, as SAS numeric
+// values.  Missing values are indicated in miss (NaN values are also
+// treated as missing), with the codes of special missing values in
+// codes, which is nil if there are none.
+func sasNumericValues(name, format string, s *Series) ([]float64, []bool, []byte, error) {
+
+	n := s.Length()
+	x := make([]float64, n)
+	switch v := s.Data().(type) {
+	case []float64, []float32, []int64, []int32, []int16, []int8:
+		copy(x, s.UpcastNumeric().Data().([]float64))
+	case []time.Time:
+		days := sasDateFormatKind(format) == SASDate
+		for i, t := range v {
+			secs := sasSeconds(t)
+			if days {
+				x[i] = math.Floor(secs / 86400)
+			} else {
+				x[i] = secs
+			}
+		}
+	case []time.Duration:
+		for i, d := range v {
+			x[i] = d.Seconds()
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("column %s: cannot write %T as numeric values", name, v)
+	}
+
+	miss := make([]bool, n)
+	if m := s.Missing(); m != nil {
+		copy(miss, m)
+	}
+	for i := range x {
+		if math.IsNaN(x[i]) {
+			miss[i] = true
+		}
+	}
+
+	return x, miss, s.MissingCodes(), nil
+}
+
+// numericValues returns the values of Series s as SAS numeric
+// values, with missing values encoded as SAS missing values.
+func (sw *SAS7BDATWriter) numericValues(j int, s *Series) ([]float64, error) {
+
+	x, miss, codes, err := sasNumericValues(sw.columns[j].Name, sw.columns[j].Format, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range x {
+		if miss[i] {
+			var code byte
+			if codes != nil {
+				code = codes[i]
+			}
+			x[i] = sasMissingValue(code)
+		}
+	}
+
+	return x, nil
+}
+
+// sasMissingValue returns the SAS missing value with the given code
+// (see sasSpecialCode).
+func sasMissingValue(code byte) float64 {
+
+	var tag byte = 1
+	switch code = sasSpecialCode(code); {
+	case code == '_':
+		tag = 0
+	case code >= 'A' && code <= 'Z':
+		tag = code - 'A' + 2
+	}
+	return math.Float64frombits(0xFFFF000000000000 | uint64(^tag)<<40)
+}
+
+// sasSpecialCode returns the SAS special missing value code for a
+// missing value code from Series.MissingCodes: '_' and 'A' to 'Z' are
+// kept, the Stata codes 'a' to 'z' become 'A' to 'Z', and any other
+// code becomes zero, the standard missing value.
+func sasSpecialCode(code byte) byte {
+
+	switch {
+	case code == '_', code >= 'A' && code <= 'Z':
+		return code
+	case code >= 'a' && code <= 'z':
+		return code - 'a' + 'A'
+	}
+	return 0
+}
+
+// sasStringValues returns the values of Series s, checking that they
+// fit within a column of the given name and length.  Missing values
+// are returned as empty strings.  The rows are numbered from
+// firstRow in error messages.
+func sasStringValues(name string, length, firstRow int, s *Series) ([]string, error) {
+
+	v, ok := s.Data().([]string)
+	if !ok {
+		return nil, fmt.Errorf("column %s: cannot write %T as string values", name, s.Data())
+	}
+
+	miss := s.Missing()
+	x := make([]string, len(v))
+	for i := range v {
+		if miss != nil && miss[i] {
+			continue
+		}
+		if len(v[i]) > length {
+			return nil, fmt.Errorf("column %s: value in row %d is longer than %d bytes",
+				name, firstRow+i, length)
+		}
+		x[i] = v[i]
+	}
+
+	return x, nil
+}
+
+// flushPage writes the current data page.
+func (sw *SAS7BDATWriter) flushPage() error {
+
+	bit_offset := sw.pageBitOffset
+	sw.putInt(sw.page[bit_offset+page_type_offset:], page_type_length, page_data_type)
+	sw.putInt(sw.page[bit_offset+block_count_offset:], block_count_length, int64(sw.pageRows))
+	sw.putInt(sw.page[bit_offset+subheader_count_offset:], subheader_count_length, 0)
+
+	if _, err := sw.w.Write(sw.page); err != nil {
+		return err
+	}
+	sw.pageCount++
+
+	for i := range sw.page {
+		sw.page[i] = 0
+	}
+	sw.pageRows = 0
+
+	return nil
+}
+
+// writeHeader writes the file header and the meta pages.
+func (sw *SAS7BDATWriter) writeHeader() error {
+
+	sw.started = true
+
+	var align1, total_align int
+	sw.intLength = 4
+	sw.pageBitOffset = 16
+	sw.headerLength = 1024
+	if sw.U64 {
+		align1 = 4
+		total_align = 8
+		sw.intLength = 8
+		sw.pageBitOffset = 32
+		sw.headerLength = 8192
+	}
+
+	sw.pageLength = sw.PageLength
+	if sw.pageLength == 0 {
+		sw.pageLength = sasWriterPageLength
+	}
+	if sw.pageLength < 1024 {
+		return fmt.Errorf("page length %d is less than 1024", sw.pageLength)
+	}
+	dataStart := sw.pageBitOffset + subheader_pointers_offset
+	if dataStart+sw.rowLength > sw.pageLength {
+		sw.pageLength = 1024 * ((dataStart + sw.rowLength + 1023) / 1024)
+	}
+	sw.rowsPerPage = (sw.pageLength - dataStart) / sw.rowLength
+	if sw.rowsPerPage > 32767 {
+		// The block count is a signed 16 bit integer
+		sw.rowsPerPage = 32767
+	}
+
+	var err error
+	sw.start, err = sw.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	meta, rowCountPos := sw.metaPages()
+	sw.rowCountPos = sw.start + int64(sw.headerLength) + int64(rowCountPos)
+	sw.pageCount = len(meta)
+
+	created := sw.DateCreated
+	if created.IsZero() {
+		created = time.Now()
+	}
+	stamp := sasSeconds(created)
+
+	header := make([]byte, sw.headerLength)
+	copy(header, magic)
+	header[align_1_offset] = '"'
+	header[align_2_offset] = '2'
+	if sw.U64 {
+		header[align_1_offset] = u64_byte_checker_value
+		header[align_2_offset] = align_1_checker_value
+	}
+	if sw.byteOrder() == binary.LittleEndian {
+		header[endianness_offset] = 1
+	}
+	header[platform_offset] = '1'
+	header[encoding_offset] = 20
+	copy(header[84:92], "SAS FILE")
+	copy(header[dataset_offset:dataset_offset+dataset_length], padRight(sw.Name, dataset_length))
+	copy(header[file_type_offset:file_type_offset+file_type_length], padRight("DATA", file_type_length))
+	sw.byteOrder().PutUint64(header[date_created_offset+align1:], math.Float64bits(stamp))
+	sw.byteOrder().PutUint64(header[date_modified_offset+align1:], math.Float64bits(stamp))
+	sw.putInt(header[header_size_offset+align1:], header_size_length, int64(sw.headerLength))
+	sw.putInt(header[page_size_offset+align1:], page_size_length, int64(sw.pageLength))
+	copy(header[sas_release_offset+total_align:], "9.0401M0")
+	copy(header[sas_server_type_offset+total_align:], "Linux")
+	copy(header[os_name_offset+total_align:], "x86_64")
+
+	if _, err := sw.w.Write(header); err != nil {
+		return err
+	}
+	for _, page := range meta {
+		if _, err := sw.w.Write(page); err != nil {
+			return err
+		}
+	}
+
+	sw.page = make([]byte, sw.pageLength)
+
+	return nil
+}
+
+// padRight pads s with spaces to length n.
+func padRight(s string, n int) string {
+	if len(s) >= n {
+		return s[0:n]
+	}
+	return s + strings.Repeat(" ", n-len(s))
+}
+
+// sasTextRef locates a string within the column text subheaders.
+type sasTextRef struct {
+	index  int
+	offset int
+	length int
+}
+
+// sasTextBlocks accumulates the strings stored in the column text
+// subheaders.
+type sasTextBlocks struct {
+	maxLength int
+	blocks    [][]byte
+}
+
+// The text at the start of the first text block, which holds the
+// (empty) compression literal.
+const textBlockPrefixLength = 28
+
+func (tb *sasTextBlocks) add(s string) sasTextRef {
+
+	if s == "" {
+		return sasTextRef{}
+	}
+
+	// Strings are padded to a multiple of four bytes.
+	n := 4 * ((len(s) + 3) / 4)
+	last := len(tb.blocks) - 1
+	if last < 0 || len(tb.blocks[last])+n > tb.maxLength {
+		tb.blocks = append(tb.blocks, make([]byte, textBlockPrefixLength))
+		last++
+	}
+	ref := sasTextRef{index: last, offset: len(tb.blocks[last]), length: len(s)}
+	b := make([]byte, n)
+	copy(b, s)
+	for i := len(s); i < n; i++ {
+		b[i] = ' '
+	}
+	tb.blocks[last] = append(tb.blocks[last], b...)
+
+	return ref
+}
+
+// splitFormat splits a SAS format into its name, width and number of
+// decimals, e.g. "DATE9." gives "DATE", 9, 0 and "8.2" gives "", 8, 2.
+func splitFormat(format string) (string, int, int) {
+
+	format = strings.TrimSpace(format)
+	var decimals int
+	if i := strings.LastIndex(format, "."); i >= 0 {
+		decimals, _ = strconv.Atoi(format[i+1:])
+		format = format[0:i]
+	}
+	name := strings.TrimRight(format, "0123456789")
+	width, _ := strconv.Atoi(format[len(name):])
+
+	return name, width, decimals
+}
+
+// metaPages returns the meta pages holding the subheaders that
+// describe the columns, and the position of the row count relative
+// to the start of the first page.
+func (sw *SAS7BDATWriter) metaPages() ([][]byte, int) {
+
+	intLen := sw.intLength
+	ncol := len(sw.columns)
+	ptrLen := 12
+	if sw.U64 {
+		ptrLen = 24
+	}
+
+	// The space available for a single subheader on a meta page
+	capacity := sw.pageLength - sw.pageBitOffset - subheader_pointers_offset - ptrLen - 8
+
+	newSubheader := func(signature int64, length int) []byte {
+		b := make([]byte, length)
+		sw.putInt(b, intLen, signature)
+		return b
+	}
+
+	// Column text
+	text := &sasTextBlocks{maxLength: capacity - intLen - 8}
+	if text.maxLength > maxTextBlockLength {
+		text.maxLength = maxTextBlockLength
+	}
+	text.blocks = append(text.blocks, make([]byte, textBlockPrefixLength))
+	nameRefs := make([]sasTextRef, ncol)
+	formatRefs := make([]sasTextRef, ncol)
+	labelRefs := make([]sasTextRef, ncol)
+	widths := make([]int, ncol)
+	decimals := make([]int, ncol)
+	for j, c := range sw.columns {
+		nameRefs[j] = text.add(c.Name)
+		var name string
+		name, widths[j], decimals[j] = splitFormat(c.Format)
+		formatRefs[j] = text.add(name)
+		labelRefs[j] = text.add(c.Label)
+	}
+
+	// Row size
+	rowSizeLength := 480
+	lcsOffset, lcpOffset := 354, 378
+	if sw.U64 {
+		rowSizeLength = 808
+		lcsOffset, lcpOffset = 682, 706
+	}
+	rowSize := newSubheader(rowSizeSignature, rowSizeLength)
+	sw.putInt(rowSize[5*intLen:], intLen, int64(sw.rowLength))
+	sw.putInt(rowSize[9*intLen:], intLen, int64(ncol))
+	sw.putInt(rowSize[15*intLen:], intLen, int64(sw.rowsPerPage))
+	sw.putInt(rowSize[lcsOffset:], 2, 0)
+	sw.putInt(rowSize[lcpOffset:], 2, 0)
+
+	// Column size
+	columnSize := newSubheader(columnSizeSignature, 3*intLen)
+	sw.putInt(columnSize[intLen:], intLen, int64(ncol))
+
+	subheaders := [][]byte{rowSize, columnSize}
+
+	for _, block := range text.blocks {
+		sh := newSubheader(columnTextSignature, intLen+len(block))
+		copy(sh[intLen:], block)
+		sw.putInt(sh[intLen:], text_block_size_length, int64(len(block)))
+		subheaders = append(subheaders, sh)
+	}
+
+	// Column names, in as many subheaders as needed
+	perName := (capacity - 2*intLen - 12) / column_name_pointer_length
+	for first := 0; first < ncol; first += perName {
+		last := first + perName
+		if last > ncol {
+			last = ncol
+		}
+		length := 2*intLen + 12 + column_name_pointer_length*(last-first)
+		sh := newSubheader(columnNameSignature, length)
+		sw.putInt(sh[intLen:], 2, int64(length-intLen))
+		for j := first; j < last; j++ {
+			p := sh[intLen+column_name_pointer_length*(j-first+1):]
+			sw.putInt(p[column_name_text_subheader_offset:], column_name_text_subheader_length, int64(nameRefs[j].index))
+			sw.putInt(p[column_name_offset_offset:], column_name_offset_length, int64(nameRefs[j].offset))
+			sw.putInt(p[column_name_length_offset:], column_name_length_length, int64(nameRefs[j].length))
+		}
+		subheaders = append(subheaders, sh)
+	}
+
+	// Column attributes, in as many subheaders as needed
+	perAttr := (capacity - 2*intLen - 12) / (intLen + 8)
+	for first := 0; first < ncol; first += perAttr {
+		last := first + perAttr
+		if last > ncol {
+			last = ncol
+		}
+		length := 2*intLen + 12 + (intLen+8)*(last-first)
+		sh := newSubheader(columnAttributesSignature, length)
+		sw.putInt(sh[intLen:], 2, int64(length-intLen))
+		for j := first; j < last; j++ {
+			p := sh[(j-first)*(intLen+8):]
+			sw.putInt(p[intLen+column_data_offset_offset:], intLen, int64(sw.offsets[j]))
+			sw.putInt(p[2*intLen+column_data_length_offset:], column_data_length_length, int64(sw.columns[j].Length))
+			sw.putInt(p[2*intLen+12:], 2, 4)
+			ctype := 1
+			if sw.columns[j].Type == SASStringType {
+				ctype = 2
+			}
+			sw.putInt(p[2*intLen+column_type_offset:], column_type_length, int64(ctype))
+		}
+		subheaders = append(subheaders, sh)
+	}
+
+	// Formats and labels, one subheader per column
+	formatLength := 52
+	if sw.U64 {
+		formatLength = 64
+	}
+	for j := range sw.columns {
+		sh := newSubheader(formatAndLabelSignature, formatLength)
+		sw.putInt(sh[3*intLen:], 2, int64(widths[j]))
+		sw.putInt(sh[3*intLen+2:], 2, int64(decimals[j]))
+		p := sh[3*intLen:]
+		sw.putInt(p[column_format_text_subheader_index_offset:], column_format_text_subheader_index_length, int64(formatRefs[j].index))
+		sw.putInt(p[column_format_offset_offset:], column_format_offset_length, int64(formatRefs[j].offset))
+		sw.putInt(p[column_format_length_offset:], column_format_length_length, int64(formatRefs[j].length))
+		sw.putInt(p[column_label_text_subheader_index_offset:], column_label_text_subheader_index_length, int64(labelRefs[j].index))
+		sw.putInt(p[column_label_offset_offset:], column_label_offset_length, int64(labelRefs[j].offset))
+		sw.putInt(p[column_label_length_offset:], column_label_length_length, int64(labelRefs[j].length))
+		subheaders = append(subheaders, sh)
+	}
+
+	// Place the subheaders on the pages.  The pointers are stored
+	// at the start of the page, and the subheaders are stored from
+	// the end of the page backwards.
+	var pages [][]byte
+	var page []byte
+	var count, low, rowCountPos int
+	finish := func() {
+		if page != nil {
+			sw.putInt(page[sw.pageBitOffset+page_type_offset:], page_type_length, page_meta_type)
+			sw.putInt(page[sw.pageBitOffset+block_count_offset:], block_count_length, int64(count))
+			sw.putInt(page[sw.pageBitOffset+subheader_count_offset:], subheader_count_length, int64(count))
+			pages = append(pages, page)
+		}
+	}
+	for k, sh := range subheaders {
+		ptr := sw.pageBitOffset + subheader_pointers_offset + count*ptrLen
+		start := (low - len(sh)) &^ 7
+		if page == nil || start < ptr+ptrLen {
+			finish()
+			page = make([]byte, sw.pageLength)
+			count, low = 0, sw.pageLength
+			ptr = sw.pageBitOffset + subheader_pointers_offset
+			start = (low - len(sh)) &^ 7
+		}
+		copy(page[start:], sh)
+		sw.putInt(page[ptr:], intLen, int64(start))
+		sw.putInt(page[ptr+intLen:], intLen, int64(len(sh)))
+		if k == 0 {
+			rowCountPos = start + 6*intLen
+		}
+		count++
+		low = start
+	}
+	finish()
+
+	return pages, rowCountPos
+}
@@ -0,0 +1,382 @@
+package datareader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestSAS writes the data to a temporary SAS7BDAT file using
+// the given writer configuration, in chunks of the given size, and
+// returns the open file positioned at the start.
+func writeTestSAS(t *testing.T, columns []SAS7BDATColumn, data []*Series, chunk int,
+	config func(*SAS7BDATWriter)) *os.File {
+
+	f, err := ioutil.TempFile("", "datareader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(f.Name())
+
+	sw, err := NewSAS7BDATWriter(f, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config(sw)
+
+	n := data[0].Length()
+	for i := 0; i < n; i += chunk {
+		j := i + chunk
+		if j > n {
+			j = n
+		}
+		chunk := make([]*Series, len(data))
+		for k := range data {
+			chunk[k] = sliceTestSeries(data[k], i, j)
+		}
+		if err := sw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sw.RowCount() != n {
+		t.Fatalf("Wrote %d rows, expected %d", sw.RowCount(), n)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// testWriterData returns columns and data used to test the writer.
+func testWriterData(n int) ([]SAS7BDATColumn, []*Series) {
+
+	columns := []SAS7BDATColumn{
+		{Name: "x", Label: "A number", Type: SASNumericType},
+		{Name: "Name", Label: "The name of the row", Type: SASStringType, Length: 12},
+		{Name: "count", Format: "8.", Type: SASNumericType},
+		{Name: "when", Format: "DATE9.", Type: SASNumericType},
+		{Name: "stamp", Label: "Time stamp", Format: "DATETIME20.", Type: SASNumericType},
+		{Name: "a_rather_long_column_name_abcdef", Format: "$CHAR3.", Type: SASStringType, Length: 3},
+	}
+
+	base := time.Date(2001, 5, 17, 0, 0, 0, 0, time.UTC)
+	x := make([]float64, n)
+	xmiss := make([]bool, n)
+	xcodes := make([]byte, n)
+	names := make([]string, n)
+	counts := make([]int32, n)
+	dates := make([]time.Time, n)
+	stamps := make([]time.Time, n)
+	short := make([]string, n)
+	smiss := make([]bool, n)
+	for i := 0; i < n; i++ {
+		x[i] = float64(i) / 7
+		switch i % 11 {
+		case 3:
+			xmiss[i] = true
+		case 5:
+			xmiss[i] = true
+			xcodes[i] = byte('A' + i%26)
+		}
+		names[i] = fmt.Sprintf("row %d", i)
+		counts[i] = int32(i%100 - 50)
+		dates[i] = base.AddDate(0, 0, i-n/2)
+		stamps[i] = base.Add(time.Duration(i) * 97 * time.Second)
+		smiss[i] = i%13 == 0
+		if !smiss[i] {
+			short[i] = strings.Repeat("z", i%4)
+		}
+	}
+
+	var data []*Series
+	for j, v := range []interface{}{x, names, counts, dates, stamps, short} {
+		var miss []bool
+		switch j {
+		case 0:
+			miss = xmiss
+		case 5:
+			miss = smiss
+		}
+		s, err := NewSeries(columns[j].Name, v, miss)
+		if err != nil {
+			panic(err)
+		}
+		data = append(data, s)
+	}
+	data[0].missingCodes = xcodes
+
+	return columns, data
+}
+
+func TestSAS7BDATWriter(t *testing.T) {
+
+	for _, tc := range []struct {
+		u64        bool
+		byteOrder  binary.ByteOrder
+		pageLength int
+		n          int
+	}{
+		{false, nil, 0, 10},
+		{true, nil, 0, 10},
+		{false, binary.BigEndian, 0, 10},
+		{true, binary.BigEndian, 0, 10},
+		{false, nil, 1024, 500},
+		{true, binary.LittleEndian, 4096, 2000},
+		{true, nil, 0, 0},
+	} {
+		columns, data := testWriterData(tc.n)
+		f := writeTestSAS(t, columns, data, 97, func(sw *SAS7BDATWriter) {
+			sw.U64 = tc.u64
+			sw.ByteOrder = tc.byteOrder
+			sw.PageLength = tc.pageLength
+			sw.Name = "WRITTEN"
+		})
+		defer f.Close()
+
+		sas, err := NewSAS7BDATReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sas.U64 != tc.u64 {
+			t.Errorf("U64 is %v, expected %v", sas.U64, tc.u64)
+		}
+		if tc.byteOrder != nil && sas.ByteOrder != tc.byteOrder {
+			t.Errorf("Byte order is %v, expected %v", sas.ByteOrder, tc.byteOrder)
+		}
+		if strings.TrimSpace(sas.Name) != "WRITTEN" || sas.FileEncoding != "utf-8" {
+			t.Errorf("Incorrect header, name %q, encoding %q", sas.Name, sas.FileEncoding)
+		}
+		if sas.RowCount() != tc.n {
+			t.Fatalf("Row count is %d, expected %d", sas.RowCount(), tc.n)
+		}
+
+		names := sas.ColumnNames()
+		labels := sas.ColumnLabels()
+		types := sas.ColumnTypes()
+		info := sas.Columns()
+		for j, c := range columns {
+			format, width, decimals := splitFormat(c.Format)
+			if names[j] != c.Name || labels[j] != c.Label || types[j] != c.Type || sas.ColumnFormats[j] != format {
+				t.Errorf("Column %d is %q %q %v %q, expected %+v", j, names[j], labels[j], types[j], sas.ColumnFormats[j], c)
+			}
+			if info[j].FormatWidth != width || info[j].FormatDecimals != decimals || (c.Length != 0 && info[j].Length != c.Length) {
+				t.Errorf("Column %d has metadata %+v, expected %+v", j, info[j], c)
+			}
+		}
+
+		if tc.n == 0 {
+			if _, err := sas.Read(-1); err != io.EOF {
+				t.Errorf("Expected io.EOF reading empty file, got %v", err)
+			}
+			continue
+		}
+
+		sas.TrimStrings = true
+		sas.ConvertDates = true
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f, r := ds[0].AllEqual(data[0]); !f {
+			t.Errorf("Column 0 differs in row %d", r)
+		}
+		codes := ds[0].MissingCodes()
+		for i, c := range data[0].MissingCodes() {
+			if codes[i] != c {
+				t.Errorf("Missing code in row %d is %q, expected %q", i, codes[i], c)
+			}
+		}
+
+		// Missing strings are written as blanks
+		blank, _ := NewSeries(data[5].Name, data[5].Data(), nil)
+		expected := []*Series{
+			nil,
+			data[1],
+			data[2].UpcastNumeric(),
+			data[3],
+			data[4],
+			blank,
+		}
+		for j := 1; j < len(expected); j++ {
+			if f, r := ds[j].AllEqual(expected[j]); !f {
+				t.Errorf("Column %d differs in row %d", j, r)
+			}
+		}
+
+		// Seek into the middle of the file and read with workers
+		sas.Workers = 3
+		if err := sas.SeekRow(tc.n / 2); err != nil {
+			t.Fatal(err)
+		}
+		tail, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range tail {
+			if f, r := tail[j].AllEqual(sliceTestSeries(ds[j], tc.n/2, tc.n)); !f {
+				t.Errorf("Column %d differs in row %d after seek", j, r)
+			}
+		}
+	}
+}
+
+// TestSAS7BDATWriterDates writes dates and datetimes outside of the
+// range of a time.Duration from 1960.
+func TestSAS7BDATWriterDates(t *testing.T) {
+
+	columns := []SAS7BDATColumn{
+		{Name: "d", Format: "DATE9.", Type: SASNumericType},
+		{Name: "t", Format: "DATETIME20.", Type: SASNumericType},
+	}
+	dates := []time.Time{
+		time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+	}
+	times := []time.Time{
+		time.Date(1600, 1, 1, 12, 30, 15, 0, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	d, _ := NewSeries("d", dates, nil)
+	tm, _ := NewSeries("t", times, nil)
+	created := time.Date(9999, 12, 31, 12, 0, 0, 0, time.UTC)
+	f := writeTestSAS(t, columns, []*Series{d, tm}, 2, func(sw *SAS7BDATWriter) { sw.DateCreated = created })
+	defer f.Close()
+
+	for _, convert := range []bool{true, false} {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		sas, err := NewSAS7BDATReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sas.DateCreated.Equal(created) {
+			t.Errorf("Created %v, expected %v", sas.DateCreated, created)
+		}
+		sas.ConvertDates = convert
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !convert {
+			x := ds[0].Data().([]float64)
+			y := ds[1].Data().([]float64)
+			if x[0] != -131487 || x[1] != 2936549 || y[1] != 86400*2936549+86399 {
+				t.Errorf("Dates %v, times %v", x, y)
+			}
+			continue
+		}
+		for j, expected := range [][]time.Time{dates, times} {
+			for i, v := range ds[j].Data().([]time.Time) {
+				if !v.Equal(expected[i]) {
+					t.Errorf("Column %d, row %d: read %v, expected %v", j, i, v, expected[i])
+				}
+			}
+		}
+	}
+}
+
+func TestSAS7BDATWriterErrors(t *testing.T) {
+
+	for _, columns := range [][]SAS7BDATColumn{
+		nil,
+		{{Name: "", Type: SASNumericType}},
+		{{Name: strings.Repeat("x", 33), Type: SASNumericType}},
+		{{Name: "x", Type: SASNumericType}, {Name: "X", Type: SASNumericType}},
+		{{Name: "s", Type: SASStringType}},
+	} {
+		f, err := NewSAS7BDATWriter(nil, columns)
+		if err == nil || f != nil {
+			t.Errorf("No error creating writer with columns %v", columns)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "datareader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+
+	sw, err := NewSAS7BDATWriter(f, []SAS7BDATColumn{{Name: "s", Type: SASStringType, Length: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := NewSeries("s", []string{"abc"}, nil)
+	if err := sw.Write([]*Series{s}); err == nil {
+		t.Errorf("No error writing a string that is too long")
+	}
+	s, _ = NewSeries("s", []float64{1}, nil)
+	if err := sw.Write([]*Series{s}); err == nil {
+		t.Errorf("No error writing numbers to a string column")
+	}
+	if err := sw.Write([]*Series{s, s}); err == nil {
+		t.Errorf("No error writing the wrong number of columns")
+	}
+}
+
+func TestSAS7BDATWriterWide(t *testing.T) {
+
+	// Enough columns to need several column name and attribute
+	// subheaders, and several meta pages
+	const ncol = 1500
+	columns := make([]SAS7BDATColumn, ncol)
+	data := make([]*Series, ncol)
+	for j := range columns {
+		name := fmt.Sprintf("column_%d", j)
+		label := strings.Repeat(fmt.Sprintf("label %d ", j), 3)
+		if j%2 == 0 {
+			columns[j] = SAS7BDATColumn{Name: name, Label: label, Type: SASNumericType}
+			data[j], _ = NewSeries(name, []float64{float64(j), math.NaN(), -float64(j)}, nil)
+		} else {
+			columns[j] = SAS7BDATColumn{Name: name, Label: label, Type: SASStringType, Length: 6}
+			data[j], _ = NewSeries(name, []string{"a", fmt.Sprintf("%d", j), ""}, nil)
+		}
+	}
+
+	for _, u64 := range []bool{false, true} {
+		f := writeTestSAS(t, columns, data, 2, func(sw *SAS7BDATWriter) {
+			sw.U64 = u64
+			sw.PageLength = 8192
+		})
+		defer f.Close()
+
+		sas, err := NewSAS7BDATReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.TrimStrings = true
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) != ncol {
+			t.Fatalf("Read %d columns, expected %d", len(ds), ncol)
+		}
+		labels := sas.ColumnLabels()
+		for j := range ds {
+			if ds[j].Name != columns[j].Name || labels[j] != columns[j].Label {
+				t.Errorf("Column %d has name %q and label %q", j, ds[j].Name, labels[j])
+			}
+			if j%2 == 0 {
+				x := ds[j].Data().([]float64)
+				if x[0] != float64(j) || !ds[j].Missing()[1] || x[2] != -float64(j) {
+					t.Errorf("Column %d read incorrectly", j)
+				}
+			} else if f, r := ds[j].AllEqual(data[j]); !f {
+				t.Errorf("Column %d differs in row %d", j, r)
+			}
+		}
+	}
+}
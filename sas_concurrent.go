@@ -0,0 +1,154 @@
+package datareader
+
+import (
+	"sync"
+)
+
+// The number of rows sent to a worker at a time in concurrent mode.
+const rowBatchSize = 256
+
+// rowJob holds the data for one row that is decoded by a worker.
+type rowJob struct {
+
+	// The position of the row within the current chunk
+	row int
+
+	// The page holding the row, and the position of the row in the
+	// file, used to report errors
+	page    int
+	fileRow int
+
+	// The row data, replaced with the decompressed data by the worker
+	data []byte
+
+	// If true, the data must be decompressed
+	compressed bool
+}
+
+// rowJobBatch is a batch of rows sent to a worker.  The done channel
+// is closed when the worker has finished with the rows.
+type rowJobBatch struct {
+	rows []rowJob
+	done chan struct{}
+}
+
+// readConcurrent reads up to num_rows rows into the current chunk.
+// The pages are read and split into rows by the calling goroutine,
+// while decompression and decoding of numeric values is done by
+// sas.Workers goroutines.  The string values of each batch are then
+// decoded in row order as soon as the batch is complete, so that the
+// factor codes do not depend on the scheduling of the workers.  At
+// most a few batches per worker are held at any time.
+func (sas *SAS7BDAT) readConcurrent(num_rows int) error {
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	jobs := make(chan *rowJobBatch, sas.Workers)
+	decompressor := sas.getDecompressor()
+	for w := 0; w < sas.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				for i := range batch.rows {
+					job := &batch.rows[i]
+					if job.compressed {
+						var err error
+						job.data, err = decompressor(sas.properties.rowLength, job.data)
+						if err != nil {
+							mu.Lock()
+							if firstErr == nil {
+								firstErr = &SASDecodeError{Page: job.page, Row: job.fileRow, Err: err}
+							}
+							mu.Unlock()
+							job.data = nil
+							continue
+						}
+					}
+					sas.storeNumeric(job.data, job.row)
+				}
+				close(batch.done)
+			}
+		}()
+	}
+
+	// The batches are queued in order, and their strings decoded as
+	// they complete.  Sending to the queue blocks while it is full,
+	// which bounds the number of batches held in memory.
+	queue := make(chan *rowJobBatch, 2*sas.Workers)
+	decoded := make(chan error)
+	go func() {
+		var strErr error
+		for batch := range queue {
+			<-batch.done
+			if strErr == nil {
+				strErr = sas.storeStrings(batch.rows)
+			}
+		}
+		decoded <- strErr
+	}()
+
+	flush := func() {
+		if len(sas.rowBatch) > 0 {
+			batch := &rowJobBatch{rows: sas.rowBatch, done: make(chan struct{})}
+			queue <- batch
+			jobs <- batch
+			sas.rowBatch = make([]rowJob, 0, rowBatchSize)
+		}
+	}
+
+	sas.queueRows = true
+	sas.rowBatch = make([]rowJob, 0, rowBatchSize)
+	var err error
+	for i := 0; i < num_rows; i++ {
+		var done bool
+		err, done = sas.readline()
+		if err != nil || done {
+			break
+		}
+		if len(sas.rowBatch) >= rowBatchSize {
+			flush()
+		}
+	}
+	flush()
+	close(jobs)
+	close(queue)
+	wg.Wait()
+	strErr := <-decoded
+	sas.queueRows = false
+	sas.rowBatch = nil
+
+	if err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return strErr
+}
+
+// storeStrings decodes the string values of a batch of rows.  Rows
+// that could not be decompressed are skipped.
+func (sas *SAS7BDAT) storeStrings(rows []rowJob) error {
+
+	for _, job := range rows {
+		if job.data == nil {
+			continue
+		}
+		for k, j := range sas.selected {
+			length := sas.columnDataLengths[j]
+			if length == 0 || sas.columns[j].ctype != SASStringType {
+				continue
+			}
+			start := sas.columnDataOffsets[j]
+			if err := sas.storeString(k, job.row, job.data[start:start+length]); err != nil {
+				return &SASDecodeError{Page: job.page, Row: job.fileRow, Column: sas.columnNames[j], Err: err}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package datareader
+
+import (
+	"strings"
+	"sync"
+)
+
+// SASDateFormatKind indicates how numeric values with a given SAS
+// format are converted when ConvertDates is set.
+type SASDateFormatKind int
+
+const (
+	// SASDate formats hold the number of days since January 1,
+	// 1960, and are converted to time.Time values.
+	SASDate SASDateFormatKind = iota + 1
+
+	// SASDateTime formats hold the number of seconds since
+	// January 1, 1960, and are converted to time.Time values.
+	SASDateTime
+
+	// SASTime formats hold the number of seconds since midnight,
+	// and are converted to time.Duration values.
+	SASTime
+)
+
+var (
+	sasDateFormatsMu sync.RWMutex
+
+	// SAS date, datetime and time formats, keyed by format name
+	// without width and decimal specifications.
+	sasDateFormats = map[string]SASDateFormatKind{
+		// Date formats
+		"B8601DA":  SASDate,
+		"DATE":     SASDate,
+		"DAY":      SASDate,
+		"DDMMYY":   SASDate,
+		"DDMMYYB":  SASDate,
+		"DDMMYYC":  SASDate,
+		"DDMMYYD":  SASDate,
+		"DDMMYYN":  SASDate,
+		"DDMMYYP":  SASDate,
+		"DDMMYYS":  SASDate,
+		"DOWNAME":  SASDate,
+		"E8601DA":  SASDate,
+		"EURDFDD":  SASDate,
+		"EURDFDE":  SASDate,
+		"EURDFDN":  SASDate,
+		"EURDFDWN": SASDate,
+		"EURDFMN":  SASDate,
+		"EURDFMY":  SASDate,
+		"EURDFWDX": SASDate,
+		"EURDFWKX": SASDate,
+		"HDATE":    SASDate,
+		"HEBDATE":  SASDate,
+		"JULDAY":   SASDate,
+		"JULIAN":   SASDate,
+		"MINGUO":   SASDate,
+		"MMDDYY":   SASDate,
+		"MMDDYYB":  SASDate,
+		"MMDDYYC":  SASDate,
+		"MMDDYYD":  SASDate,
+		"MMDDYYN":  SASDate,
+		"MMDDYYP":  SASDate,
+		"MMDDYYS":  SASDate,
+		"MMYY":     SASDate,
+		"MMYYC":    SASDate,
+		"MMYYD":    SASDate,
+		"MMYYN":    SASDate,
+		"MMYYP":    SASDate,
+		"MMYYS":    SASDate,
+		"MONNAME":  SASDate,
+		"MONTH":    SASDate,
+		"MONYY":    SASDate,
+		"NENGO":    SASDate,
+		"NLDATE":   SASDate,
+		"NLDATEL":  SASDate,
+		"NLDATEM":  SASDate,
+		"NLDATEMD": SASDate,
+		"NLDATEMN": SASDate,
+		"NLDATES":  SASDate,
+		"NLDATEW":  SASDate,
+		"NLDATEWN": SASDate,
+		"NLDATEYM": SASDate,
+		"NLDATEYQ": SASDate,
+		"NLDATEYR": SASDate,
+		"NLDATEYW": SASDate,
+		"PDJULG":   SASDate,
+		"PDJULI":   SASDate,
+		"QTR":      SASDate,
+		"QTRR":     SASDate,
+		"WEEKDATE": SASDate,
+		"WEEKDATX": SASDate,
+		"WEEKDAY":  SASDate,
+		"WEEKU":    SASDate,
+		"WEEKV":    SASDate,
+		"WEEKW":    SASDate,
+		"WORDDATE": SASDate,
+		"WORDDATX": SASDate,
+		"YEAR":     SASDate,
+		"YYMM":     SASDate,
+		"YYMMC":    SASDate,
+		"YYMMD":    SASDate,
+		"YYMMN":    SASDate,
+		"YYMMP":    SASDate,
+		"YYMMS":    SASDate,
+		"YYMMDD":   SASDate,
+		"YYMMDDB":  SASDate,
+		"YYMMDDC":  SASDate,
+		"YYMMDDD":  SASDate,
+		"YYMMDDN":  SASDate,
+		"YYMMDDP":  SASDate,
+		"YYMMDDS":  SASDate,
+		"YYMON":    SASDate,
+		"YYQ":      SASDate,
+		"YYQC":     SASDate,
+		"YYQD":     SASDate,
+		"YYQN":     SASDate,
+		"YYQP":     SASDate,
+		"YYQS":     SASDate,
+		"YYQR":     SASDate,
+		"YYQRC":    SASDate,
+		"YYQRD":    SASDate,
+		"YYQRN":    SASDate,
+		"YYQRP":    SASDate,
+		"YYQRS":    SASDate,
+		"YYQZ":     SASDate,
+
+		// Datetime formats
+		"B8601DN":  SASDateTime,
+		"B8601DT":  SASDateTime,
+		"B8601DX":  SASDateTime,
+		"B8601DZ":  SASDateTime,
+		"B8601LX":  SASDateTime,
+		"DATEAMPM": SASDateTime,
+		"DATETIME": SASDateTime,
+		"DTDATE":   SASDateTime,
+		"DTMONYY":  SASDateTime,
+		"DTWKDATX": SASDateTime,
+		"DTYEAR":   SASDateTime,
+		"DTYYQC":   SASDateTime,
+		"E8601DN":  SASDateTime,
+		"E8601DT":  SASDateTime,
+		"E8601DX":  SASDateTime,
+		"E8601DZ":  SASDateTime,
+		"E8601LX":  SASDateTime,
+		"EURDFDT":  SASDateTime,
+		"MDYAMPM":  SASDateTime,
+		"NLDATM":   SASDateTime,
+		"NLDATMAP": SASDateTime,
+		"NLDATMDT": SASDateTime,
+		"NLDATML":  SASDateTime,
+		"NLDATMM":  SASDateTime,
+		"NLDATMMD": SASDateTime,
+		"NLDATMMN": SASDateTime,
+		"NLDATMS":  SASDateTime,
+		"NLDATMW":  SASDateTime,
+		"NLDATMWN": SASDateTime,
+		"NLDATMYM": SASDateTime,
+		"NLDATMYQ": SASDateTime,
+		"NLDATMYR": SASDateTime,
+		"NLDATMYW": SASDateTime,
+
+		// Time formats
+		"B8601LZ":  SASTime,
+		"B8601TM":  SASTime,
+		"B8601TX":  SASTime,
+		"B8601TZ":  SASTime,
+		"E8601LZ":  SASTime,
+		"E8601TM":  SASTime,
+		"E8601TX":  SASTime,
+		"E8601TZ":  SASTime,
+		"HHMM":     SASTime,
+		"HOUR":     SASTime,
+		"MMSS":     SASTime,
+		"NLTIMAP":  SASTime,
+		"NLTIME":   SASTime,
+		"TIME":     SASTime,
+		"TIMEAMPM": SASTime,
+		"TOD":      SASTime,
+	}
+)
+
+// RegisterSASDateFormat registers a SAS format name (for example a
+// user-defined picture format) as a date, datetime or time format, so
+// that columns with this format are converted when ConvertDates is
+// set.  A width and decimal specification ending in a period (e.g. the
+// "12." in "MYTIME12.") is ignored, so a name that itself ends in digits
+// should be given without a period.
+func RegisterSASDateFormat(name string, kind SASDateFormatKind) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if i := strings.Index(name, "."); i >= 0 {
+		name = strings.TrimRight(name[0:i], "0123456789")
+	}
+
+	sasDateFormatsMu.Lock()
+	defer sasDateFormatsMu.Unlock()
+	sasDateFormats[name] = kind
+}
+
+// sasDateFormatKind returns the kind of date format for the given
+// SAS format name, or 0 if the format is not a date format.
+func sasDateFormatKind(format string) SASDateFormatKind {
+	sasDateFormatsMu.RLock()
+	defer sasDateFormatsMu.RUnlock()
+	name := baseFormatName(format, func(name string) bool {
+		_, ok := sasDateFormats[name]
+		return ok
+	})
+	return sasDateFormats[name]
+}
+
+// baseFormatName removes the width and decimal specifications from a
+// SAS format name, e.g. "DATE9." becomes "DATE" and "YYMMDD10."
+// becomes "YYMMDD".  Since format names may themselves end in digits
+// (e.g. "B8601DT19." is "B8601DT" with width 19), trailing digits are
+// removed one at a time until known reports a match, and the longest
+// known name is returned.  If no name is known, all trailing digits
+// are removed.
+func baseFormatName(format string, known func(string) bool) string {
+
+	format = strings.ToUpper(strings.TrimSpace(format))
+	if i := strings.Index(format, "."); i >= 0 {
+		format = format[0:i]
+	}
+
+	for name := format; ; name = name[0 : len(name)-1] {
+		if known(name) {
+			return name
+		}
+		if n := len(name); n == 0 || name[n-1] < '0' || name[n-1] > '9' {
+			return name
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package datareader
+
+// Inspect the structure of SAS7BDAT files, to diagnose files that are
+// not read correctly.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// SASProperties holds the layout of a SAS7BDAT file, as decoded from
+// the file header and the metadata subheaders.
+type SASProperties struct {
+
+	// True if the file uses the 64 bit layout
+	U64 bool
+
+	// True if the file is big endian
+	BigEndian bool
+
+	// The length in bytes of the integers that hold offsets and
+	// lengths, 4 or 8
+	IntLength int
+
+	// The length of the file header and of each page, and the
+	// number of pages
+	HeaderLength int
+	PageLength   int
+	PageCount    int
+
+	// The offset of the page header fields on each page, and the
+	// length of each subheader pointer
+	PageBitOffset          int
+	SubheaderPointerLength int
+
+	// The length of each row, the number of rows including deleted
+	// rows, and the maximum number of rows on a mix page
+	RowLength       int
+	RowCount        int
+	MixPageRowCount int
+
+	// The number of columns, and the counts from the two column
+	// size subheaders
+	ColumnCount int
+	ColCountP1  int
+	ColCountP2  int
+
+	// The lengths of the creator strings in the row size subheader
+	LCS int
+	LCP int
+
+	// The procedure that created the file
+	CreatorProc string
+
+	// The compression mode, empty if the file is not compressed
+	Compression string
+
+	// The detected value of NoAlignCorrection
+	NoAlignCorrection bool
+}
+
+// SASSubheaderInfo describes a subheader pointer on a page.
+type SASSubheaderInfo struct {
+
+	// The position of the subheader on the page and its length
+	Offset int
+	Length int
+
+	// The compression and type flags of the pointer
+	Compression int
+	Type        int
+
+	// The signature at the start of the subheader, nil if the
+	// subheader is empty or truncated
+	Signature []byte
+
+	// The kind of subheader, e.g. "column text" or "data"
+	Kind string
+}
+
+// SASPageInfo describes a page of a SAS7BDAT file.
+type SASPageInfo struct {
+
+	// The page number, starting from zero, and the position of the
+	// page in the file
+	Index  int
+	Offset int64
+
+	// The page type code, and its name ("meta", "data", "mix",
+	// "amd" or "unknown", followed by "deleted" if the page has
+	// deleted rows)
+	Type     int
+	TypeName string
+
+	// The counts from the page header
+	BlockCount     int
+	SubheaderCount int
+
+	// The number of rows on the page, and the number of these rows
+	// that are marked as deleted
+	RowCount        int
+	DeletedRowCount int
+
+	// The position on the page of the first row, after alignment
+	// padding, and the number of padding bytes, for data and mix
+	// pages.  DataOffset is -1 for other pages.
+	DataOffset   int
+	AlignPadding int
+
+	// The subheader pointers on the page
+	Subheaders []SASSubheaderInfo
+}
+
+// Names of the subheader kinds, indexed by subheader index
+var sasSubheaderKinds = []string{
+	rowSizeIndex:          "row size",
+	columnSizeIndex:       "column size",
+	subheaderCountsIndex:  "subheader counts",
+	columnTextIndex:       "column text",
+	columnNameIndex:       "column name",
+	columnAttributesIndex: "column attributes",
+	formatAndLabelIndex:   "format and label",
+	columnListIndex:       "column list",
+	dataSubheaderIndex:    "data",
+}
+
+// sasPageTypeName returns a name for a page type code.
+func sasPageTypeName(t int) string {
+
+	var name string
+	switch t &^ page_deleted_flag {
+	case page_meta_type:
+		name = "meta"
+	case page_data_type:
+		name = "data"
+	case 512:
+		name = "mix"
+	case page_amd_type:
+		name = "amd"
+	default:
+		return "unknown"
+	}
+	if t&page_deleted_flag != 0 {
+		name += " deleted"
+	}
+	return name
+}
+
+// NewSAS7BDATInspector returns a reader for inspecting a SAS7BDAT file
+// whose metadata cannot be read, for example to diagnose the error
+// returned by NewSAS7BDATReader.  Only the file header is read, so
+// Properties, HeaderBytes, PageBytes and InspectPage can be used, but
+// no columns are known and Read returns no rows.
+func NewSAS7BDATInspector(r io.ReadSeeker) (*SAS7BDAT, error) {
+
+	sas := new(SAS7BDAT)
+	sas.file = r
+	sas.currentPage = -1
+	if err := sas.getProperties(); err != nil {
+		return nil, sas.decodeError(err, -1, "")
+	}
+
+	return sas, nil
+}
+
+// Properties returns the layout of the file.
+func (sas *SAS7BDAT) Properties() SASProperties {
+
+	p := sas.properties
+	return SASProperties{
+		U64:                    sas.U64,
+		BigEndian:              sas.ByteOrder == binary.BigEndian,
+		IntLength:              p.intLength,
+		HeaderLength:           p.headerLength,
+		PageLength:             p.pageLength,
+		PageCount:              p.pageCount,
+		PageBitOffset:          p.pageBitOffset,
+		SubheaderPointerLength: p.subheaderPointerLength,
+		RowLength:              p.rowLength,
+		RowCount:               sas.rowCount,
+		MixPageRowCount:        p.mixPageRowCount,
+		ColumnCount:            p.columnCount,
+		ColCountP1:             p.colCountP1,
+		ColCountP2:             p.colCountP2,
+		LCS:                    p.lcs,
+		LCP:                    p.lcp,
+		CreatorProc:            p.creatorProc,
+		Compression:            sas.Compression,
+		NoAlignCorrection:      sas.detectedNoAlign,
+	}
+}
+
+// HeaderBytes returns the bytes of the file header.  The position of
+// the reader is not changed.
+func (sas *SAS7BDAT) HeaderBytes() ([]byte, error) {
+	return sas.readRegion(0, sas.properties.headerLength)
+}
+
+// PageBytes returns the bytes of page p, numbered from zero.  The
+// position of the reader is not changed.
+func (sas *SAS7BDAT) PageBytes(p int) ([]byte, error) {
+
+	if p < 0 || p >= sas.properties.pageCount {
+		return nil, fmt.Errorf("page %d is out of range", p)
+	}
+	offset := int64(sas.properties.headerLength) + int64(p)*int64(sas.properties.pageLength)
+	return sas.readRegion(offset, sas.properties.pageLength)
+}
+
+// readRegion reads length bytes from the given file position, leaving
+// the position of the reader unchanged.
+func (sas *SAS7BDAT) readRegion(offset int64, length int) ([]byte, error) {
+
+	pos, err := sas.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer sas.file.Seek(pos, io.SeekStart)
+
+	if _, err := sas.file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(sas.file, b); err != nil {
+		return nil, fmt.Errorf("failed to read %d bytes at position %d: %v", length, offset, err)
+	}
+	return b, nil
+}
+
+// InspectPage returns the page header and subheader pointers of page
+// p, numbered from zero.  The data on the page are not decoded, and
+// the position of the reader is not changed.
+func (sas *SAS7BDAT) InspectPage(p int) (*SASPageInfo, error) {
+
+	page, err := sas.PageBytes(p)
+	if err != nil {
+		return nil, err
+	}
+
+	bitOffset := sas.properties.pageBitOffset
+	if bitOffset+subheader_pointers_offset > len(page) {
+		return nil, fmt.Errorf("page %d is too short for a page header", p)
+	}
+	info := &SASPageInfo{
+		Index:      p,
+		Offset:     int64(sas.properties.headerLength) + int64(p)*int64(sas.properties.pageLength),
+		DataOffset: -1,
+	}
+	info.Type, _ = sas.readIntFromBuffer(page[bitOffset+page_type_offset:], page_type_length)
+	info.BlockCount, _ = sas.readIntFromBuffer(page[bitOffset+block_count_offset:], block_count_length)
+	info.SubheaderCount, _ = sas.readIntFromBuffer(page[bitOffset+subheader_count_offset:], subheader_count_length)
+	info.TypeName = sasPageTypeName(info.Type)
+
+	intLen := sas.properties.intLength
+	for i := 0; i < info.SubheaderCount; i++ {
+		pos := bitOffset + subheader_pointers_offset + i*sas.properties.subheaderPointerLength
+		if pos+2*intLen+2 > len(page) {
+			return info, fmt.Errorf("page %d: subheader pointer %d is outside of the page", p, i)
+		}
+		var sh SASSubheaderInfo
+		sh.Offset, _ = sas.readIntFromBuffer(page[pos:], intLen)
+		sh.Length, _ = sas.readIntFromBuffer(page[pos+intLen:], intLen)
+		sh.Compression = int(page[pos+2*intLen])
+		sh.Type = int(page[pos+2*intLen+1])
+
+		switch {
+		case sh.Length == 0:
+			sh.Kind = "empty"
+		case sh.Compression == truncated_subheader_id:
+			sh.Kind = "truncated"
+		case sh.Offset < 0 || sh.Offset+intLen > len(page):
+			sh.Kind = "outside of page"
+		default:
+			sh.Signature = make([]byte, intLen)
+			copy(sh.Signature, page[sh.Offset:])
+			sh.Kind = "unknown"
+			if index, err := sas.getSubheaderIndex(sh.Signature, sh.Compression, sh.Type); err == nil {
+				sh.Kind = sasSubheaderKinds[index]
+			}
+		}
+		if sh.Kind == "data" {
+			info.RowCount++
+		}
+		info.Subheaders = append(info.Subheaders, sh)
+	}
+
+	if !sas.isPageMixDataType(info.Type) {
+		return info, nil
+	}
+
+	info.RowCount = info.BlockCount
+	info.DataOffset = bitOffset + subheader_pointers_offset + info.SubheaderCount*sas.properties.subheaderPointerLength
+	if sas.isPageMixType(info.Type) {
+		info.RowCount = min(sas.rowCount, sas.properties.mixPageRowCount)
+		if !sas.NoAlignCorrection {
+			info.AlignPadding = info.DataOffset % 8
+		}
+		info.DataOffset += info.AlignPadding
+	}
+
+	if info.Type&page_deleted_flag != 0 {
+		pointerOffset := page_deleted_pointer_offset_x86
+		if sas.U64 {
+			pointerOffset = page_deleted_pointer_offset_x64
+		}
+		pointer, _ := sas.readIntFromBuffer(page[pointerOffset:], page_deleted_pointer_length)
+		offset := sas.deletedMapOffset(pointer, info.Type, info.SubheaderCount, info.RowCount)
+		length := (info.RowCount + 7) / 8
+		if offset < 0 || offset+length > len(page) {
+			return info, fmt.Errorf("page %d: deleted rows bitmap at offset %d is outside of the page", p, offset)
+		}
+		for row := 0; row < info.RowCount; row++ {
+			if rowDeleted(page[offset:offset+length], row) {
+				info.DeletedRowCount++
+			}
+		}
+	}
+
+	return info, nil
+}
@@ -1,27 +1,51 @@
 package datareader
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
+
+	xencoding "golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
-func sasBaseTest(fnameCSV, fnameSAS string, factorizeStrings bool) bool {
+// utf8TestFiles are SAS test files holding UTF-8 strings, although
+// their headers give a Latin-1 encoding.
+var utf8TestFiles = map[string]bool{
+	"test16.sas7bdat": true,
+	"test17.sas7bdat": true,
+	"test18.sas7bdat": true,
+	"test19.sas7bdat": true,
+	"test20.sas7bdat": true,
+	"test21.sas7bdat": true,
+}
+
+// readCSVTestFile reads a CSV file from the test_files directory.
+func readCSVTestFile(fnameCSV string) ([]*Series, error) {
 
 	f, err := os.Open(filepath.Join("test_files", "data", fnameCSV))
 	if err != nil {
-		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
-		return false
+		return nil, err
 	}
 	defer f.Close()
 
-	// Read the whole CSV file
 	rt := NewCSVReader(f)
 	rt.HasHeader = true
 	rt.TypeHintsName = map[string]string{"Column 1": "float64"}
-	dt, err := rt.Read(-1)
+	return rt.Read(-1)
+}
+
+func sasBaseTest(fnameCSV, fnameSAS string, factorizeStrings bool) bool {
+
+	// Read the whole CSV file
+	dt, err := readCSVTestFile(fnameCSV)
 	if err != nil {
 		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
 		return false
@@ -35,12 +59,25 @@ func sasBaseTest(fnameCSV, fnameSAS string, factorizeStrings bool) bool {
 	}
 	defer r.Close()
 
+	return sasCompareTest(dt, r, factorizeStrings, utf8TestFiles[fnameSAS])
+}
+
+// sasCompareTest reads the SAS data from r and compares it to the
+// CSV data in dt.  If utf8 is true, the strings are read as UTF-8
+// regardless of the encoding in the file header.
+func sasCompareTest(dt []*Series, r io.ReadSeeker, factorizeStrings, utf8 bool) bool {
+
 	// Set up the SAS reader
 	sas, err := NewSAS7BDATReader(r)
 	if err != nil {
 		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
 		return false
 	}
+	if utf8 {
+		if err := sas.SetEncoding("utf-8"); err != nil {
+			panic(err)
+		}
+	}
 	sas.TrimStrings = true
 	sas.ConvertDates = true
 	sas.FactorizeStrings = factorizeStrings
@@ -164,3 +201,1416 @@ func TestSASGenerated2(t *testing.T) {
 		}
 	}
 }
+
+// TestSASEncoding checks that strings are decoded using the encoding
+// recorded in the file header, using test files in several encodings.
+// The third value of each file is also valid UTF-8 before decoding.
+func TestSASEncoding(t *testing.T) {
+
+	for _, tc := range []struct {
+		encoding string
+		text     []string
+	}{
+		{"wlatin1", []string{"café", "naïve", "Ã©tÃ©", "plain", "€uro"}},
+		{"wlatin2", []string{"krokodýly", "Łódź", "Ă©", "plain", "Žluťoučký"}},
+		{"wcyrillic", []string{"крокодилы", "Москва", "Г©", "plain", "Ёж"}},
+		{"shift-jis", []string{"ワニ", "東京", "ﾃｩ", "plain", "日本語"}},
+	} {
+		raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "encoding_"+tc.encoding+".sas7bdat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, workers := range []int{0, 4} {
+			for _, factorizeStrings := range []bool{false, true} {
+				sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if sas.FileEncoding != tc.encoding {
+					t.Errorf("FileEncoding is %s, expected %s", sas.FileEncoding, tc.encoding)
+				}
+				sas.TrimStrings = true
+				sas.FactorizeStrings = factorizeStrings
+				sas.Workers = workers
+				ds, err := sas.Read(-1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				text := make([]string, ds[1].Length())
+				if factorizeStrings {
+					m := sas.StringFactorMap()
+					for i, c := range ds[1].Data().([]uint64) {
+						text[i] = m[c]
+					}
+				} else {
+					text = ds[1].Data().([]string)
+				}
+				for i := range tc.text {
+					if text[i] != tc.text[i] {
+						t.Errorf("%s: row %d decoded as %q, expected %q", tc.encoding, i, text[i], tc.text[i])
+					}
+				}
+			}
+		}
+
+		// Decoding can be turned off
+		sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.NoTextDecoding = true
+		sas.TrimStrings = true
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, _, _ := ds[1].AsStringSlice()
+		for i, s := range tc.text {
+			encoded, err := encoding_decoders[tc.encoding].NewEncoder().String(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x[i] != encoded {
+				t.Errorf("%s: expected undecoded string %q, got %q", tc.encoding, encoded, x[i])
+			}
+		}
+	}
+
+	// The encoding can be overridden
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "encoding_wcyrillic.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sas.SetEncoding("wlatin1"); err != nil {
+		t.Fatal(err)
+	}
+	sas.TrimStrings = true
+	ds, err := sas.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _, _ := ds[1].AsStringSlice()
+	if x[1] != "Ìîñêâà" {
+		t.Errorf("Expected string decoded as wlatin1, got %q", x[1])
+	}
+
+	if err := sas.SetEncoding("no-such-encoding"); err == nil {
+		t.Errorf("Expected error for unknown encoding")
+	}
+}
+
+func TestSASDateFormatKind(t *testing.T) {
+
+	for _, tc := range []struct {
+		format string
+		kind   SASDateFormatKind
+	}{
+		{"MMDDYY", SASDate},
+		{"DATE9.", SASDate},
+		{"yymmdd10.", SASDate},
+		{"E8601DA", SASDate},
+		{"E8601DA10.", SASDate},
+		{"WEEKDATE29.", SASDate},
+		{"E8601DT19.", SASDateTime},
+		{"B8601DT", SASDateTime},
+		{"B8601DT19.3", SASDateTime},
+		{"DTDATE", SASDateTime},
+		{"DATETIME20.3", SASDateTime},
+		{"TIME8.", SASTime},
+		{"HHMM", SASTime},
+		{"TOD", SASTime},
+		{"B8601", 0},
+		{"BEST12.", 0},
+		{"", 0},
+	} {
+		if k := sasDateFormatKind(tc.format); k != tc.kind {
+			t.Errorf("Format %s has kind %d, expected %d", tc.format, k, tc.kind)
+		}
+	}
+}
+
+// TestSASDateConversion checks date conversion using copies of
+// test1.sas7bdat in which the MMDDYY format has been renamed.  Names
+// that are not six characters long are set after reading the header.
+func TestSASDateConversion(t *testing.T) {
+
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sasDateFormatsMu.Lock()
+	saved := make(map[string]SASDateFormatKind, len(sasDateFormats))
+	for k, v := range sasDateFormats {
+		saved[k] = v
+	}
+	sasDateFormatsMu.Unlock()
+	t.Cleanup(func() {
+		sasDateFormatsMu.Lock()
+		sasDateFormats = saved
+		sasDateFormatsMu.Unlock()
+	})
+
+	RegisterSASDateFormat("TSTTIM12.", SASTime)
+	RegisterSASDateFormat("TSTDT2", SASDateTime)
+
+	for _, tc := range []struct {
+		format       string
+		convertDates bool
+		typ          string
+	}{
+		{"MMDDYY", false, "[]float64"},
+		{"MMDDYY", true, "[]time.Time"},
+		{"DATE", false, "[]float64"},
+		{"DATE", true, "[]time.Time"},
+		{"DDMMYY", true, "[]time.Time"},
+		{"YYMMDD", true, "[]time.Time"},
+		{"DTDATE", true, "[]time.Time"},
+		{"TSTTIM", true, "[]time.Duration"},
+		{"TSTTIM", false, "[]float64"},
+		{"TSTDT2", true, "[]time.Time"},
+		{"TSTDT", true, "[]float64"},
+		{"BEST12", true, "[]float64"},
+	} {
+		buf := raw
+		if len(tc.format) == 6 {
+			buf = bytes.Replace(raw, []byte("MMDDYY"), []byte(tc.format), -1)
+		}
+		sas, err := NewSAS7BDATReader(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.ColumnFormats[3] = tc.format
+		sas.ConvertDates = tc.convertDates
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ := fmt.Sprintf("%T", ds[3].Data()); typ != tc.typ {
+			t.Errorf("Format %s has type %s, expected %s", tc.format, typ, tc.typ)
+		}
+	}
+}
+
+func TestSASMissingCode(t *testing.T) {
+
+	for _, tc := range []struct {
+		bits uint64
+		code byte
+	}{
+		{0xFFFFFE0000000000, 0},
+		{0xFFFFFF0000000000, '_'},
+		{0xFFFFFD0000000000, 'A'},
+		{0xFFFFEC0000000000, 'R'},
+		{0xFFFFE40000000000, 'Z'},
+		{0xFFFFD10000000000, 0},
+		{0xFFFFAD0000000000, 'R'},
+		{0xFFFFA00000000000, '_'},
+	} {
+		if c := sasMissingCode(math.Float64frombits(tc.bits)); c != tc.code {
+			t.Errorf("Missing code for %x is %q, expected %q", tc.bits, c, tc.code)
+		}
+	}
+}
+
+// TestSASSpecialMissing checks that special missing values are
+// recovered from a copy of test1.sas7bdat in which all missing
+// numeric values have been changed to .R.
+func TestSASSpecialMissing(t *testing.T) {
+
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Replace(raw, []byte("\x00\x00\x00\x00\x00\xfe\xff\xff"),
+		[]byte("\x00\x00\x00\x00\x00\xec\xff\xff"), -1)
+	buf = bytes.Replace(buf, []byte("\x00\x00\x00\x00\x00\xd1\xff\xff"),
+		[]byte("\x00\x00\x00\x00\x00\xad\xff\xff"), -1)
+
+	for _, tc := range []struct {
+		data []byte
+		code byte
+	}{
+		{raw, 0},
+		{buf, 'R'},
+	} {
+		sas, err := NewSAS7BDATReader(bytes.NewReader(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.ConvertDates = true
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var nmiss int
+		for j := range ds {
+			if sas.ColumnTypes()[j] != SASNumericType {
+				continue
+			}
+			miss := ds[j].Missing()
+			codes := ds[j].MissingCodes()
+			for i := range miss {
+				var code byte
+				if codes != nil {
+					code = codes[i]
+				}
+				if !miss[i] {
+					if code != 0 {
+						t.Errorf("Non-missing value has missing code")
+					}
+					continue
+				}
+				nmiss++
+				if code != tc.code {
+					t.Errorf("Missing code in column %d row %d is %q, expected %q", j, i, code, tc.code)
+				}
+			}
+		}
+		if nmiss == 0 {
+			t.Errorf("No missing values found")
+		}
+	}
+}
+
+func TestSASSelectColumns(t *testing.T) {
+
+	for _, fname := range []string{"test1.sas7bdat", "test3.sas7bdat", "test16.sas7bdat"} {
+
+		r, err := os.Open(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		sas, err := NewSAS7BDATReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.ConvertDates = true
+		all, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allTypes := sas.ColumnTypes()
+
+		for _, byName := range []bool{false, true} {
+			if _, err := r.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			sas, err := NewSAS7BDATReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sas.ConvertDates = true
+
+			cols := []int{17, 3, 0, 99}
+			if byName {
+				err = sas.SelectColumnsByName("Column18", "Column4", "Column1", "Column100")
+			} else {
+				err = sas.SelectColumns(cols...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := sas.ColumnNames()
+			types := sas.ColumnTypes()
+			if len(names) != len(cols) || len(types) != len(cols) || len(sas.ColumnFormats) != len(cols) {
+				t.Fatalf("Incorrect number of columns")
+			}
+			for k, j := range cols {
+				if names[k] != fmt.Sprintf("Column%d", j+1) || types[k] != allTypes[j] {
+					t.Errorf("Incorrect metadata for selected column %d", k)
+				}
+			}
+
+			var ds []*Series
+			for {
+				chunk, err := sas.Read(3)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if ds == nil {
+					ds = chunk
+					continue
+				}
+				for k := range ds {
+					ds[k] = concatTestSeries(ds[k], chunk[k])
+				}
+			}
+
+			if len(ds) != len(cols) {
+				t.Fatalf("Read %d columns, expected %d", len(ds), len(cols))
+			}
+			for k, j := range cols {
+				if f, i := ds[k].AllEqual(all[j]); !f {
+					t.Errorf("%s: selected column %d differs from full read at row %d", fname, k, i)
+				}
+			}
+		}
+
+		if err := sas.SelectColumnsByName("NoSuchColumn"); err == nil {
+			t.Errorf("Expected error for unknown column name")
+		}
+		if err := sas.SelectColumns(100); err == nil {
+			t.Errorf("Expected error for column position out of range")
+		}
+	}
+}
+
+// concatTestSeries concatenates two Series holding float64, string or
+// time values.
+func concatTestSeries(a, b *Series) *Series {
+
+	var data interface{}
+	switch x := a.Data().(type) {
+	case []float64:
+		data = append(x[0:len(x):len(x)], b.Data().([]float64)...)
+	case []string:
+		data = append(x[0:len(x):len(x)], b.Data().([]string)...)
+	case []time.Time:
+		data = append(x[0:len(x):len(x)], b.Data().([]time.Time)...)
+	default:
+		panic(fmt.Sprintf("unsupported type %T", x))
+	}
+	miss := append(a.Missing()[0:a.Length():a.Length()], b.Missing()...)
+	s, err := NewSeries(a.Name, data, miss)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestSASSeekRow(t *testing.T) {
+
+	for k := 1; k < 22; k++ {
+
+		fname := fmt.Sprintf("test%d.sas7bdat", k)
+		r, err := os.Open(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		sas, err := NewSAS7BDATReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nrow := sas.RowCount()
+
+		for _, tc := range []struct{ row, n int }{
+			{nrow - 1, 1},
+			{0, 3},
+			{5, 2},
+			{3, -1},
+			{nrow - 2, 10},
+		} {
+			ds, err := sas.ReadAt(tc.row, tc.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := tc.n
+			if m < 0 || tc.row+m > nrow {
+				m = nrow - tc.row
+			}
+			for j := range ds {
+				expected := sliceTestSeries(all[j], tc.row, tc.row+m)
+				if f, i := ds[j].AllEqual(expected); !f {
+					t.Errorf("%s: column %d differs at row %d after seeking to row %d", fname, j, i, tc.row)
+				}
+			}
+		}
+
+		// Reading continues from the end of the previous read
+		if err := sas.SeekRow(2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sas.Read(3); err != nil {
+			t.Fatal(err)
+		}
+		ds, err := sas.Read(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, _ := ds[0].AllEqual(sliceTestSeries(all[0], 5, 6)); !f {
+			t.Errorf("%s: incorrect row following ReadAt", fname)
+		}
+
+		if err := sas.SeekRow(nrow); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sas.Read(1); err != io.EOF {
+			t.Errorf("Expected EOF after seeking to end of file")
+		}
+		if err := sas.SeekRow(nrow + 1); err == nil {
+			t.Errorf("Expected error when seeking past end of file")
+		}
+	}
+}
+
+// sliceTestSeries returns the values of a Series holding float64,
+// int32, string or time values in positions i through j-1.
+func sliceTestSeries(s *Series, i, j int) *Series {
+
+	var data interface{}
+	switch x := s.Data().(type) {
+	case []float64:
+		data = x[i:j]
+	case []int32:
+		data = x[i:j]
+	case []string:
+		data = x[i:j]
+	case []time.Time:
+		data = x[i:j]
+	default:
+		panic(fmt.Sprintf("unsupported type %T", x))
+	}
+	var miss []bool
+	if s.Missing() != nil {
+		miss = s.Missing()[i:j]
+	}
+	r, err := NewSeries(s.Name, data, miss)
+	if err != nil {
+		panic(err)
+	}
+	if s.missingCodes != nil {
+		r.missingCodes = s.missingCodes[i:j]
+	}
+	return r
+}
+
+func TestSASWorkers(t *testing.T) {
+
+	// readAll reads the file in chunks of three rows.
+	readAll := func(fname string, workers int, factorize bool) ([][]*Series, map[uint64]string) {
+		r, err := os.Open(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		sas, err := NewSAS7BDATReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.Workers = workers
+		sas.FactorizeStrings = factorize
+		sas.ConvertDates = true
+		var chunks [][]*Series
+		for {
+			chunk, err := sas.Read(3)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			chunks = append(chunks, chunk)
+		}
+		return chunks, sas.StringFactorMap()
+	}
+
+	for k := 1; k < 22; k++ {
+		fname := fmt.Sprintf("test%d.sas7bdat", k)
+		for _, factorize := range []bool{false, true} {
+			serial, serialMap := readAll(fname, 0, factorize)
+			concurrent, concurrentMap := readAll(fname, 4, factorize)
+			if len(serial) != len(concurrent) {
+				t.Fatalf("%s: read %d chunks concurrently, expected %d", fname, len(concurrent), len(serial))
+			}
+			for i := range serial {
+				for j := range serial[i] {
+					if f, r := concurrent[i][j].AllEqual(serial[i][j]); !f {
+						t.Errorf("%s: chunk %d column %d differs at row %d", fname, i, j, r)
+					}
+				}
+			}
+			if len(serialMap) != len(concurrentMap) {
+				t.Errorf("%s: string factor maps differ", fname)
+				continue
+			}
+			for j := range serialMap {
+				if serialMap[j] != concurrentMap[j] {
+					t.Errorf("%s: string factor maps differ at code %d", fname, j)
+				}
+			}
+		}
+	}
+}
+
+func TestSASAlignCorrection(t *testing.T) {
+
+	for _, tc := range []struct{ fname, csv string }{
+		{"test1.sas7bdat", "test1.csv"},
+		{"test10.sas7bdat", "test1.csv"},
+		{"test19.sas7bdat", "test2.csv"},
+	} {
+
+		raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", tc.fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sas.DetectedNoAlignCorrection() || sas.NoAlignCorrection {
+			t.Errorf("%s: alignment correction should be detected", tc.fname)
+		}
+		expected, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Remove the padding before the first row of the mix
+		// page, as done by software that does not align the rows.
+		start := sas.properties.headerLength + sas.properties.pageBitOffset + subheader_pointers_offset +
+			sas.currentPageSubheadersCount*sas.properties.subheaderPointerLength
+		end := start + sas.rowCount*sas.properties.rowLength
+		buf := make([]byte, len(raw))
+		copy(buf, raw)
+		copy(buf[start:end], raw[start+4:end+4])
+
+		sas, err = NewSAS7BDATReader(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sas.DetectedNoAlignCorrection() || !sas.NoAlignCorrection {
+			t.Errorf("%s: missing alignment correction not detected", tc.fname)
+		}
+		dt, err := readCSVTestFile(tc.csv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sasCompareTest(dt, bytes.NewReader(buf), false, utf8TestFiles[tc.fname]) {
+			t.Errorf("%s: incorrect data without alignment correction", tc.fname)
+		}
+
+		// The detected value can be overridden
+		sas.NoAlignCorrection = false
+		ds, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, _ := ds[0].AllEqual(expected[0]); f {
+			t.Errorf("%s: override of detected alignment has no effect", tc.fname)
+		}
+	}
+}
+
+// TestSASRowSpanningPages checks that a row of a compressed file that
+// is stored without compression, and that continues at the start of
+// the next page, is read from both pages.
+func TestSASRowSpanningPages(t *testing.T) {
+
+	const n = 20000
+	x, _ := NewSeries("X", make([]float64, n), nil)
+	y, _ := NewSeries("Y", make([]float64, n), nil)
+	columns := []SAS7BDATColumn{{Name: "X", Type: SASNumericType}, {Name: "Y", Type: SASNumericType}}
+	f := writeTestSAS(t, columns, []*Series{x, y}, n, func(*SAS7BDATWriter) {})
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := sas.properties
+	if p.pageCount < 2 || p.rowLength != 16 || sas.columnDataOffsets[1] != 8 {
+		t.Fatalf("Unexpected layout with %d pages and row length %d", p.pageCount, p.rowLength)
+	}
+
+	// The row holds 42 in the last 8 bytes of the first page, and -42
+	// in the first 8 bytes of the second page, which precede the page
+	// header.
+	second := p.headerLength + p.pageLength
+	sas.ByteOrder.PutUint64(raw[second:], math.Float64bits(-42))
+	page := make([]byte, p.pageLength)
+	sas.ByteOrder.PutUint64(page[p.pageLength-8:], math.Float64bits(42))
+
+	sas.Compression = "SASYZCRL"
+	sas.cachedPage = page
+	sas.currentPage = 0
+	if _, err := sas.file.Seek(int64(second), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	sas.bytechunk = [][]byte{make([]byte, 8), make([]byte, 8)}
+	if err := sas.processByteArrayWithData(p.pageLength-8, p.rowLength); err != nil {
+		t.Fatal(err)
+	}
+	for k, expected := range []float64{42, -42} {
+		if v := math.Float64frombits(sas.ByteOrder.Uint64(sas.bytechunk[k])); v != expected {
+			t.Errorf("Column %d is %v, expected %v", k, v, expected)
+		}
+	}
+	if sas.currentPage != 1 {
+		t.Errorf("Current page is %d, expected 1", sas.currentPage)
+	}
+}
+
+func TestSASDeletedRows(t *testing.T) {
+
+	deleted := []int{1, 4, 9}
+
+	for _, fname := range []string{"test1.sas7bdat", "test13.sas7bdat"} {
+
+		raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sas.DeletedRowCount() != 0 || sas.RowCount() != 10 {
+			t.Fatalf("%s: unexpected deleted rows", fname)
+		}
+
+		// Mark rows as deleted in a bitmap following the rows on
+		// the mix page.
+		page := sas.properties.headerLength
+		bitOffset := sas.properties.pageBitOffset
+		rowsEnd := page + bitOffset + subheader_pointers_offset +
+			sas.currentPageSubheadersCount*sas.properties.subheaderPointerLength +
+			sas.mixPageAlignCorrection() + sas.rowCount*sas.properties.rowLength
+		all, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(raw))
+		copy(buf, raw)
+		buf[rowsEnd], buf[rowsEnd+1] = 0, 0
+		sas.ByteOrder.PutUint16(buf[page+bitOffset+page_type_offset:], 640)
+		pointerOffset := page_deleted_pointer_offset_x86
+		if sas.U64 {
+			pointerOffset = page_deleted_pointer_offset_x64
+		}
+		sas.ByteOrder.PutUint32(buf[page+pointerOffset:], subheader_pointers_offset)
+		for _, i := range deleted {
+			buf[rowsEnd+i/8] |= 0x80 >> uint(i%8)
+		}
+
+		for _, workers := range []int{0, 4} {
+			sas, err = NewSAS7BDATReader(bytes.NewReader(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sas.Workers = workers
+			if sas.DeletedRowCount() != len(deleted) || sas.RowCount() != 10-len(deleted) {
+				t.Errorf("%s: found %d deleted rows, expected %d", fname, sas.DeletedRowCount(), len(deleted))
+			}
+			if sas.Properties().RowCount != 10 {
+				t.Errorf("%s: header row count is %d, expected 10", fname, sas.Properties().RowCount)
+			}
+
+			// Deleted rows are skipped, including when they span
+			// chunks, and are not counted in the chunk size.
+			var ds []*Series
+			var sizes []int
+			for {
+				chunk, err := sas.Read(4)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				sizes = append(sizes, chunk[0].Length())
+				if ds == nil {
+					ds = chunk
+					continue
+				}
+				for j := range ds {
+					ds[j] = concatTestSeries(ds[j], chunk[j])
+				}
+			}
+			if len(sizes) != 2 || sizes[0] != 4 || sizes[1] != 10-len(deleted)-4 {
+				t.Errorf("%s: read chunks of %v rows", fname, sizes)
+			}
+			for _, j := range []int{0, 1, 3} {
+				expected := concatTestSeries(concatTestSeries(sliceTestSeries(all[j], 0, 1),
+					sliceTestSeries(all[j], 2, 4)), sliceTestSeries(all[j], 5, 9))
+				if f, i := ds[j].AllEqual(expected); !f {
+					t.Errorf("%s: column %d differs at row %d with deleted rows skipped", fname, j, i)
+				}
+			}
+
+			// Deleted rows are included with an indicator column
+			sas, err = NewSAS7BDATReader(bytes.NewReader(buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sas.Workers = workers
+			sas.IncludeDeleted = true
+			if sas.RowCount() != 10 {
+				t.Errorf("%s: RowCount should include deleted rows", fname)
+			}
+			names := sas.ColumnNames()
+			if len(names) != len(all)+1 || names[len(all)] != "_DELETED_" {
+				t.Errorf("%s: deleted row indicator missing from column names", fname)
+			}
+			ds, err = sas.Read(-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ds) != len(all)+1 {
+				t.Fatalf("%s: read %d columns, expected %d", fname, len(ds), len(all)+1)
+			}
+			if f, i := ds[0].AllEqual(all[0]); !f {
+				t.Errorf("%s: column 0 differs at row %d with deleted rows included", fname, i)
+			}
+			ind := ds[len(all)].Data().([]float64)
+			for i := range ind {
+				var expected float64
+				for _, k := range deleted {
+					if i == k {
+						expected = 1
+					}
+				}
+				if ind[i] != expected {
+					t.Errorf("%s: deleted row indicator is %v in row %d", fname, ind[i], i)
+				}
+			}
+		}
+	}
+}
+
+func TestSASStableStringFactors(t *testing.T) {
+
+	for _, fname := range []string{"test1.sas7bdat", "test2.sas7bdat", "test16.sas7bdat"} {
+
+		r, err := os.Open(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		sas, err := NewSAS7BDATReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := sas.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			perColumn bool
+			max       int
+		}{
+			{false, 0},
+			{true, 0},
+			{false, 1000},
+			{false, 3},
+			{true, 3},
+		} {
+			if _, err := r.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			sas, err := NewSAS7BDATReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sas.FactorizeStrings = true
+			sas.StableStringFactors = true
+			sas.FactorizePerColumn = tc.perColumn
+			sas.MaxStringFactors = tc.max
+
+			// The codes from each chunk are decoded with the maps
+			// obtained after reading the whole file.
+			var chunks [][]*Series
+			for {
+				chunk, err := sas.Read(3)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				chunks = append(chunks, chunk)
+			}
+
+			for j, typ := range sas.ColumnTypes() {
+				if typ != SASStringType {
+					continue
+				}
+				mp := sas.ColumnStringFactorMap(j)
+				if !tc.perColumn && len(mp) != len(sas.StringFactorMap()) {
+					t.Errorf("%s: columns do not share the string factor map", fname)
+				}
+				var s []string
+				var decoded bool
+				for i, chunk := range chunks {
+					switch x := chunk[j].Data().(type) {
+					case []uint64:
+						if decoded {
+							t.Errorf("%s: column %d chunk %d is coded after falling back to strings", fname, j, i)
+						}
+						for _, c := range x {
+							s = append(s, mp[c])
+						}
+					case []string:
+						if tc.max == 0 || tc.max >= 1000 {
+							t.Errorf("%s: column %d chunk %d is not coded", fname, j, i)
+						}
+						decoded = true
+						s = append(s, x...)
+					}
+				}
+				expected, _ := all[j].Data().([]string)
+				if len(s) != len(expected) {
+					t.Fatalf("%s: column %d has %d values, expected %d", fname, j, len(s), len(expected))
+				}
+				for i := range s {
+					if s[i] != expected[i] {
+						t.Errorf("%s: column %d row %d is %q, expected %q", fname, j, i, s[i], expected[i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSASColumns(t *testing.T) {
+
+	for _, fname := range []string{"test1.sas7bdat", "test16.sas7bdat"} {
+
+		r, err := os.Open(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		sas, err := NewSAS7BDATReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cols := sas.Columns()
+		if len(cols) != 100 {
+			t.Fatalf("%s: found %d columns, expected 100", fname, len(cols))
+		}
+		strlen := 9
+		if fname == "test16.sas7bdat" {
+			strlen = 14
+		}
+		for _, expected := range []ColumnInfo{
+			{Index: 0, Name: "Column1", Type: SASNumericType, Format: "BEST", FormatWidth: 12,
+				Informat: "BEST", InformatWidth: 32, Offset: 0, Length: 8},
+			{Index: 1, Name: "Column2", Label: "Column 2 label", Type: SASStringType, Format: "$", FormatWidth: strlen,
+				Informat: "$", InformatWidth: strlen, Offset: 600, Length: strlen},
+			{Index: 3, Name: "Column4", Type: SASNumericType, Format: "MMDDYY", FormatWidth: 10,
+				Informat: "BEST", InformatWidth: 32, Offset: 16, Length: 8},
+		} {
+			if cols[expected.Index] != expected {
+				t.Errorf("%s: column %d is %+v, expected %+v", fname, expected.Index, cols[expected.Index], expected)
+			}
+		}
+
+		// The offsets and lengths must describe non-overlapping
+		// parts of the row.
+		used := make(map[int]bool)
+		for _, c := range cols {
+			for k := c.Offset; k < c.Offset+c.Length; k++ {
+				if used[k] {
+					t.Errorf("%s: column %s overlaps another column", fname, c.Name)
+					break
+				}
+				used[k] = true
+			}
+		}
+
+		if err := sas.SelectColumns(3, 1); err != nil {
+			t.Fatal(err)
+		}
+		sas.IncludeDeleted = true
+		sel := sas.Columns()
+		if len(sel) != 3 || sel[0] != cols[3] || sel[1] != cols[1] || sel[2].Name != deletedColumnName || sel[2].Index != -1 {
+			t.Errorf("%s: incorrect selected columns %+v", fname, sel)
+		}
+	}
+}
+
+// failingTransformer is a text transformer that always fails.
+type failingTransformer struct {
+	transform.NopResetter
+}
+
+func (failingTransformer) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	return 0, 0, fmt.Errorf("invalid text")
+}
+
+// failingSeeker is a ReadSeeker that cannot seek.
+type failingSeeker struct {
+	io.Reader
+}
+
+func (failingSeeker) Seek(offset int64, whence int) (int64, error) {
+	return 0, fmt.Errorf("seek not supported")
+}
+
+func TestSASDecodeErrors(t *testing.T) {
+
+	r, err := os.Open(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	_, err = NewSAS7BDATReader(failingSeeker{r})
+	if e, ok := err.(*SASDecodeError); !ok || e.Page != -1 || e.Row != -1 {
+		t.Errorf("Unexpected error %v reading from a file that cannot seek", err)
+	}
+
+	for _, workers := range []int{1, 3} {
+		if _, err := r.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		sas, err := NewSAS7BDATReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.Workers = workers
+		sas.TextDecoder = &xencoding.Decoder{Transformer: failingTransformer{}}
+		_, err = sas.Read(5)
+		e, ok := err.(*SASDecodeError)
+		if !ok {
+			t.Fatalf("Expected a SASDecodeError, got %v", err)
+		}
+		if e.Page < 0 || e.Row != 0 || e.Column != "Column2" || e.Unwrap() == nil {
+			t.Errorf("Incorrect error location %+v", e)
+		}
+	}
+}
+
+func TestSASLimits(t *testing.T) {
+
+	b, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := &ReadLimits{}
+	if _, err := NewSAS7BDATReaderWithLimits(bytes.NewReader(b), limits); err != nil {
+		t.Fatal(err)
+	}
+
+	// Page length and page count that are larger than the file
+	for _, offset := range []int{page_size_offset, page_count_offset} {
+		c := make([]byte, len(b))
+		copy(c, b)
+		binary.LittleEndian.PutUint32(c[offset:], 0x7fff0000)
+		if _, err := NewSAS7BDATReaderWithLimits(bytes.NewReader(c), limits); err == nil {
+			t.Errorf("No error with a corrupt value at offset %d", offset)
+		}
+	}
+
+	// A Read that needs more memory than allowed
+	const n = 20000
+	x := make([]float64, n)
+	s, _ := NewSeries("X", x, nil)
+	f := writeTestSAS(t, []SAS7BDATColumn{{Name: "X", Type: SASNumericType}}, []*Series{s}, n,
+		func(*SAS7BDATWriter) {})
+	defer f.Close()
+	sas, err := NewSAS7BDATReaderWithLimits(f, &ReadLimits{MaxAlloc: 1 << 17})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sas.Read(-1); err == nil {
+		t.Errorf("No error reading %d rows", n)
+	}
+	ds, err := sas.Read(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds[0].Length() != 1000 {
+		t.Errorf("Read %d rows, expected 1000", ds[0].Length())
+	}
+
+	// The width of string columns counts when reading raw strings
+	const m = 200
+	str := make([]string, m)
+	s, _ = NewSeries("S", str, nil)
+	g := writeTestSAS(t, []SAS7BDATColumn{{Name: "S", Type: SASStringType, Length: 1000}}, []*Series{s}, m,
+		func(*SAS7BDATWriter) {})
+	defer g.Close()
+	for _, raw := range []bool{false, true} {
+		if _, err := g.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		sas, err := NewSAS7BDATReaderWithLimits(g, &ReadLimits{MaxAlloc: 1 << 17})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sas.RawStrings = raw
+		if _, err := sas.Read(-1); (err == nil) != !raw {
+			t.Errorf("Reading %d strings with RawStrings=%v gives error %v", m, raw, err)
+		}
+	}
+}
+
+func FuzzSAS7BDAT(f *testing.F) {
+
+	fnames, err := filepath.Glob(filepath.Join("test_files", "data", "*.sas7bdat"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fname := range fnames {
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		sas, err := NewSAS7BDATReaderWithLimits(bytes.NewReader(b), &ReadLimits{MaxAlloc: 1 << 24})
+		if err != nil {
+			return
+		}
+		sas.Columns()
+		for {
+			ds, err := sas.Read(1000)
+			if err != nil || len(ds) == 0 || ds[0].Length() == 0 {
+				return
+			}
+		}
+	})
+}
+
+func TestSASRawStrings(t *testing.T) {
+
+	for k := 1; k < 22; k++ {
+		fname := fmt.Sprintf("test%d.sas7bdat", k)
+		for _, workers := range []int{1, 3} {
+			var results [2][]*Series
+			for m, raw := range []bool{false, true} {
+				r, err := os.Open(filepath.Join("test_files", "data", fname))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sas, err := NewSAS7BDATReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sas.TrimStrings = true
+				sas.NoTextDecoding = true
+				sas.Workers = workers
+				sas.RawStrings = raw
+				results[m], err = sas.Read(-1)
+				r.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for j, s := range results[1] {
+				x, _, err := s.AsBytesSlice()
+				if err != nil {
+					if f, _ := s.AllEqual(results[0][j]); !f {
+						t.Errorf("%s: numeric column %d differs", fname, j)
+					}
+					continue
+				}
+				if f, i := s.ToString().AllEqual(results[0][j]); !f {
+					t.Errorf("%s: column %d differs in row %d", fname, j, i)
+				}
+
+				// Appending to a value cannot overwrite the
+				// following values in the shared buffer
+				for i, v := range x {
+					if cap(v) != len(v) {
+						t.Errorf("%s: column %d, row %d has extra capacity", fname, j, i)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSASInspect(t *testing.T) {
+
+	fnames, err := filepath.Glob(filepath.Join("test_files", "data", "*.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fname := range fnames {
+		r, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		sas, err := NewSAS7BDATReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prop := sas.Properties()
+		if prop.PageCount < 1 || prop.ColumnCount != len(sas.ColumnNames()) {
+			t.Errorf("%s: unexpected properties %+v", fname, prop)
+		}
+
+		// Read part of the data, so the inspection below starts
+		// from the middle of the file
+		first, err := sas.Read(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var nrow int
+		var rowSize bool
+		for p := 0; p < prop.PageCount; p++ {
+			info, err := sas.InspectPage(p)
+			if err != nil {
+				t.Fatalf("%s: page %d: %v", fname, p, err)
+			}
+			if info.SubheaderCount != len(info.Subheaders) {
+				t.Errorf("%s: page %d has %d subheaders, expected %d", fname, p, len(info.Subheaders), info.SubheaderCount)
+			}
+			for _, sh := range info.Subheaders {
+				switch sh.Kind {
+				case "unknown":
+					t.Errorf("%s: page %d has an unknown subheader", fname, p)
+				case "row size":
+					rowSize = true
+				}
+			}
+			nrow += info.RowCount
+		}
+		if !rowSize {
+			t.Errorf("%s: no row size subheader", fname)
+		}
+		if nrow != prop.RowCount {
+			t.Errorf("%s: pages have %d rows, expected %d", fname, nrow, prop.RowCount)
+		}
+
+		// The position of the reader is not changed
+		rest, err := sas.Read(-1)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if rest != nil && rest[0].Length()+first[0].Length() != prop.RowCount {
+			t.Errorf("%s: read %d rows after inspection", fname, rest[0].Length()+first[0].Length())
+		}
+
+		if _, err := sas.InspectPage(prop.PageCount); err == nil {
+			t.Errorf("%s: no error for a page out of range", fname)
+		}
+	}
+}
+
+// TestSASInspector checks that the pages of a file with damaged
+// metadata can be inspected.
+func TestSASInspector(t *testing.T) {
+
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := NewSAS7BDATReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prop := sas.Properties()
+	var pages []*SASPageInfo
+	for p := 0; p < prop.PageCount; p++ {
+		info, err := sas.InspectPage(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, info)
+	}
+
+	// Give the column size subheader more columns than are described
+	b := append([]byte(nil), raw...)
+	for _, info := range pages {
+		for _, sh := range info.Subheaders {
+			if sh.Kind == "column size" {
+				pos := int(info.Offset) + sh.Offset + prop.IntLength
+				sas.ByteOrder.PutUint32(b[pos:], 1000)
+			}
+		}
+	}
+	if _, err := NewSAS7BDATReader(bytes.NewReader(b)); err == nil {
+		t.Fatalf("No error reading damaged metadata")
+	}
+
+	sas, err = NewSAS7BDATInspector(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := sas.Properties(); p.PageCount != prop.PageCount || p.PageLength != prop.PageLength {
+		t.Errorf("Inspector properties are %+v", p)
+	}
+	for p, expected := range pages {
+		info, err := sas.InspectPage(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Type != expected.Type || len(info.Subheaders) != len(expected.Subheaders) {
+			t.Errorf("Page %d inspected as %+v", p, info)
+		}
+	}
+	if ds, err := sas.Read(-1); err != io.EOF {
+		t.Errorf("Read %v, %v from an inspector", ds, err)
+	}
+}
+
+// readRecovered reads all the rows of a damaged SAS file in recovery
+// mode.
+func readRecovered(t *testing.T, b []byte) ([]*Series, RecoveryReport) {
+
+	sas, err := NewSAS7BDATReaderWithRecovery(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas.TrimStrings = true
+	sas.Workers = 4
+	var ds []*Series
+	for {
+		chunk, err := sas.Read(300)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if ds == nil {
+			ds = chunk
+			continue
+		}
+		for j := range ds {
+			ds[j] = concatTestSeries(ds[j], chunk[j])
+		}
+	}
+	return ds, sas.Recovery()
+}
+
+func TestSASRecovery(t *testing.T) {
+
+	const n = 3000
+	x := make([]float64, n)
+	s := make([]string, n)
+	for i := range x {
+		x[i] = float64(i)
+		s[i] = fmt.Sprintf("row %d", i)
+	}
+	xs, _ := NewSeries("X", x, nil)
+	ss, _ := NewSeries("S", s, nil)
+	f := writeTestSAS(t, []SAS7BDATColumn{{Name: "X", Type: SASNumericType}, {Name: "S", Type: SASStringType, Length: 10}},
+		[]*Series{xs, ss}, 1000, func(sw *SAS7BDATWriter) { sw.PageLength = 4096 })
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sas, err := NewSAS7BDATReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prop := sas.Properties()
+	fileEnd := int64(prop.HeaderLength + prop.PageCount*prop.PageLength)
+	var pages []*SASPageInfo
+	for p := 0; p < prop.PageCount; p++ {
+		info, err := sas.InspectPage(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, info)
+	}
+
+	// Truncate the file in the middle of a page and at a page
+	// boundary.  All the complete rows are returned.
+	for _, cut := range []int64{fileEnd - 1000, int64(pages[len(pages)/2].Offset), fileEnd - 5*int64(prop.PageLength) + 7} {
+		var expected int
+		for _, info := range pages {
+			for i := 0; i < info.RowCount; i++ {
+				if info.Offset+int64(info.DataOffset+(i+1)*prop.RowLength) <= cut {
+					expected++
+				}
+			}
+		}
+
+		// Without recovery, a partial page is an error
+		if (cut-int64(prop.HeaderLength))%int64(prop.PageLength) != 0 {
+			sas, err := NewSAS7BDATReader(bytes.NewReader(b[:cut]))
+			if err == nil {
+				_, err = sas.Read(-1)
+			}
+			if err == nil {
+				t.Errorf("No error reading a file truncated at %d", cut)
+			}
+		}
+
+		ds, report := readRecovered(t, b[:cut])
+		if ds[0].Length() != expected || report.RowsRecovered != expected || report.RowCount != n {
+			t.Errorf("Recovered %d rows (reported %d of %d), expected %d of %d",
+				ds[0].Length(), report.RowsRecovered, report.RowCount, expected, n)
+		}
+		for j := range ds {
+			if f, i := ds[j].AllEqual(sliceTestSeries([]*Series{xs, ss}[j], 0, expected)); !f {
+				t.Errorf("Column %d differs at row %d after truncation at %d", j, i, cut)
+			}
+		}
+		if len(report.Unreadable) != 1 || report.Unreadable[0].End != fileEnd ||
+			report.Unreadable[0].Start > cut || report.Unreadable[0].Start < cut-int64(prop.RowLength) {
+			t.Errorf("Truncated at %d, unreadable ranges %v", cut, report.Unreadable)
+		}
+	}
+
+	// A damaged page in the middle of the file is skipped
+	damaged := pages[len(pages)/2]
+	var first int
+	for _, info := range pages[:damaged.Index] {
+		first += info.RowCount
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	pos := damaged.Offset + int64(prop.PageBitOffset)
+	sas.ByteOrder.PutUint16(buf[pos+page_type_offset:], page_meta_type)
+	sas.ByteOrder.PutUint16(buf[pos+subheader_count_offset:], 0xffff)
+	sas, err = NewSAS7BDATReader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sas.Read(-1); err == nil {
+		t.Errorf("No error reading a damaged page")
+	}
+	ds, report := readRecovered(t, buf)
+	if ds[0].Length() != n-damaged.RowCount || report.RowsRecovered != n-damaged.RowCount {
+		t.Errorf("Recovered %d rows, expected %d", ds[0].Length(), n-damaged.RowCount)
+	}
+	expected, _ := NewSeries("X", append(x[0:first:first], x[first+damaged.RowCount:]...), nil)
+	if f, i := ds[0].AllEqual(expected); !f {
+		t.Errorf("Column 0 differs at row %d with a damaged page", i)
+	}
+	if len(report.Unreadable) != 1 || report.Unreadable[0] != (ByteRange{damaged.Offset, damaged.Offset + int64(prop.PageLength)}) {
+		t.Errorf("Damaged page at %d, unreadable ranges %v", damaged.Offset, report.Unreadable)
+	}
+
+	// An intact file is read completely
+	ds, report = readRecovered(t, b)
+	if ds[0].Length() != n || report.RowsRecovered != n || len(report.Unreadable) != 0 {
+		t.Errorf("Intact file: %v", report)
+	}
+
+	// The metadata subheaders are at the end of a mix page, so the
+	// file cannot be read if the only page is truncated
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSAS7BDATReaderWithRecovery(bytes.NewReader(raw[:len(raw)-1000])); err == nil {
+		t.Errorf("No error with truncated metadata")
+	}
+}
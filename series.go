@@ -1,6 +1,7 @@
 package datareader
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math"
@@ -19,12 +20,19 @@ type Series struct {
 	// The length of the series.
 	length int
 
-	// The data, must be a slice of primitives, e.g. []float64.
+	// The data, must be a slice of primitives, e.g. []float64, or
+	// a [][]byte holding byte strings.
 	data interface{}
 
 	// Indicators that data values are missing.  If nil, there are
 	// no missing values.
 	missing []bool
+
+	// Codes for special missing values (e.g. 'A' for the SAS
+	// missing value .A, or 'a' for the Stata missing value .a),
+	// zero for standard missing values and non-missing values.  If
+	// nil, there are no special missing values.
+	missingCodes []byte
 }
 
 // ilen returns the length of a slice, held in an interface value.
@@ -37,6 +45,8 @@ func ilen(data interface{}) (int, error) {
 		return len(data.([]float64)), nil
 	case []string:
 		return len(data.([]string)), nil
+	case [][]byte:
+		return len(data.([][]byte)), nil
 	case []int64:
 		return len(data.([]int64)), nil
 	case []int32:
@@ -51,6 +61,8 @@ func ilen(data interface{}) (int, error) {
 		return len(data.([]uint64)), nil
 	case []time.Time:
 		return len(data.([]time.Time)), nil
+	case []time.Duration:
+		return len(data.([]time.Duration)), nil
 	default:
 		return 0, fmt.Errorf("Unknown data type")
 	}
@@ -204,6 +216,20 @@ func (ser *Series) WriteRange(w io.Writer, first, last int) {
 				}
 			}
 		}
+	case [][]byte:
+		data := ser.data.([][]byte)
+		for j := first; j < last; j++ {
+			if ser.missing == nil || !ser.missing[j] {
+				s := fmt.Sprintf("%d:  %s\n", j, data[j])
+				if _, err := io.WriteString(w, s); err != nil {
+					panic(err)
+				}
+			} else {
+				if _, err := io.WriteString(w, fmt.Sprintf("%d:\n", j)); err != nil {
+					panic(err)
+				}
+			}
+		}
 	case []time.Time:
 		data := ser.data.([]time.Time)
 		for j := first; j < last; j++ {
@@ -218,6 +244,20 @@ func (ser *Series) WriteRange(w io.Writer, first, last int) {
 				}
 			}
 		}
+	case []time.Duration:
+		data := ser.data.([]time.Duration)
+		for j := first; j < last; j++ {
+			if ser.missing == nil || !ser.missing[j] {
+				s := fmt.Sprintf("%d:  %v\n", j, data[j])
+				if _, err := io.WriteString(w, s); err != nil {
+					panic(err)
+				}
+			} else {
+				if _, err := io.WriteString(w, fmt.Sprintf("%d:\n", j)); err != nil {
+					panic(err)
+				}
+			}
+		}
 	default:
 		panic("Unknown type in WriteRange")
 	}
@@ -243,6 +283,25 @@ func (ser *Series) Missing() []bool {
 	return ser.missing
 }
 
+// MissingCodes returns the codes for special missing values, or nil
+// if the Series has no special missing values.  The code for a value
+// is zero unless the value is a special missing value, in which case
+// it is the letter identifying the missing value ('A'-'Z' or '_' for
+// SAS, 'a'-'z' for Stata).
+func (ser *Series) MissingCodes() []byte {
+	return ser.missingCodes
+}
+
+// copyMissingCodes returns a copy of the special missing value codes.
+func (ser *Series) copyMissingCodes() []byte {
+	if ser.missingCodes == nil {
+		return nil
+	}
+	codes := make([]byte, len(ser.missingCodes))
+	copy(codes, ser.missingCodes)
+	return codes
+}
+
 // Length returns the number of elements in a Series.
 func (ser *Series) Length() int {
 	return ser.length
@@ -379,6 +438,21 @@ func (ser *Series) AllClose(other *Series, tol float64) (bool, int) {
 				return false, j
 			}
 		}
+	case [][]byte:
+		u := ser.data.([][]byte)
+		v, ok := other.data.([][]byte)
+		if !ok {
+			return false, -2
+		}
+		for j := 0; j < ser.length; j++ {
+			c := cmiss(j)
+			if c == 0 {
+				return false, j
+			}
+			if (c == 1) && !bytes.Equal(u[j], v[j]) {
+				return false, j
+			}
+		}
 	case []time.Time:
 		u := ser.data.([]time.Time)
 		v, ok := other.data.([]time.Time)
@@ -394,6 +468,21 @@ func (ser *Series) AllClose(other *Series, tol float64) (bool, int) {
 				return false, j
 			}
 		}
+	case []time.Duration:
+		u := ser.data.([]time.Duration)
+		v, ok := other.data.([]time.Duration)
+		if !ok {
+			return false, -2
+		}
+		for j := 0; j < ser.length; j++ {
+			c := cmiss(j)
+			if c == 0 {
+				return false, j
+			}
+			if (c == 1) && (u[j] != v[j]) {
+				return false, j
+			}
+		}
 	}
 	return true, 0
 }
@@ -422,8 +511,12 @@ func (ser *Series) UpcastNumeric() *Series {
 		return ser
 	case []string:
 		return ser
+	case [][]byte:
+		return ser
 	case []time.Time:
 		return ser
+	case []time.Duration:
+		return ser
 	case []float32:
 		d := ser.data.([]float32)
 		n := len(d)
@@ -432,6 +525,7 @@ func (ser *Series) UpcastNumeric() *Series {
 			a[i] = float64(d[i])
 		}
 		s, _ := NewSeries(ser.Name, a, cmiss)
+		s.missingCodes = ser.copyMissingCodes()
 		return s
 	case []int64:
 		d := ser.data.([]int64)
@@ -441,6 +535,7 @@ func (ser *Series) UpcastNumeric() *Series {
 			a[i] = float64(d[i])
 		}
 		s, _ := NewSeries(ser.Name, a, cmiss)
+		s.missingCodes = ser.copyMissingCodes()
 		return s
 	case []int32:
 		d := ser.data.([]int32)
@@ -451,6 +546,7 @@ func (ser *Series) UpcastNumeric() *Series {
 		}
 		ser.data = a
 		s, _ := NewSeries(ser.Name, a, cmiss)
+		s.missingCodes = ser.copyMissingCodes()
 		return s
 	case []int16:
 		d := ser.data.([]int16)
@@ -461,6 +557,7 @@ func (ser *Series) UpcastNumeric() *Series {
 		}
 		ser.data = a
 		s, _ := NewSeries(ser.Name, a, cmiss)
+		s.missingCodes = ser.copyMissingCodes()
 		return s
 	case []int8:
 		d := ser.data.([]int8)
@@ -471,6 +568,7 @@ func (ser *Series) UpcastNumeric() *Series {
 		}
 		ser.data = a
 		s, _ := NewSeries(ser.Name, a, cmiss)
+		s.missingCodes = ser.copyMissingCodes()
 		return s
 	}
 }
@@ -568,8 +666,28 @@ func (ser *Series) ToString() *Series {
 		}
 		s, _ := NewSeries(ser.Name, x, cmiss)
 		return s
+	case []time.Duration:
+		x := make([]string, n)
+		y := ser.data.([]time.Duration)
+		for i := 0; i < n; i++ {
+			if !cmiss[i] {
+				x[i] = y[i].String()
+			}
+		}
+		s, _ := NewSeries(ser.Name, x, cmiss)
+		return s
 	case []string:
 		return ser
+	case [][]byte:
+		x := make([]string, n)
+		y := ser.data.([][]byte)
+		for i := 0; i < n; i++ {
+			if !cmiss[i] {
+				x[i] = string(y[i])
+			}
+		}
+		s, _ := NewSeries(ser.Name, x, cmiss)
+		return s
 	case []float64:
 		x := make([]string, n)
 		y := ser.data.([]float64)
@@ -609,6 +727,17 @@ func (ser *Series) NullStringMissing() *Series {
 		}
 		s, _ := NewSeries(ser.Name, x, cmiss)
 		return s
+	case [][]byte:
+		x := make([][]byte, n)
+		y := ser.data.([][]byte)
+		copy(x, y)
+		for i := 0; i < n; i++ {
+			if len(x[i]) == 0 {
+				cmiss[i] = true
+			}
+		}
+		s, _ := NewSeries(ser.Name, x, cmiss)
+		return s
 	}
 }
 
@@ -680,6 +809,7 @@ func (ser *Series) DateFromDuration(base time.Time, units string) (*Series, erro
 	if err != nil {
 		return nil, err
 	}
+	rslt.missingCodes = ser.copyMissingCodes()
 
 	return rslt, nil
 }
@@ -722,3 +852,16 @@ func (ser *Series) AsStringSlice() ([]string, []bool, error) {
 
 	return v, ser.missing, nil
 }
+
+// AsBytesSlice returns the data of a series holding byte strings,
+// and the missing data indicators.  The byte strings may share
+// memory with each other, so they should not be modified in place.
+func (ser *Series) AsBytesSlice() ([][]byte, []bool, error) {
+
+	v, ok := ser.data.([][]byte)
+	if !ok {
+		return nil, nil, fmt.Errorf("can't convert %T to [][]byte", ser.data)
+	}
+
+	return v, ser.missing, nil
+}
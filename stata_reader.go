@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -26,13 +27,30 @@ const (
 	StataStrlType    ColumnTypeT = 32768
 )
 
+// The system missing value "." of each numeric type.  The extended
+// missing values .a to .z follow it, in steps of one for the integer
+// types, 1<<11 in the bits of a float, and 1<<40 in the bits of a
+// double.
+const (
+	stataMissingInt8    = 101
+	stataMissingInt16   = 32741
+	stataMissingInt32   = 2147483621
+	stataMissingFloat32 = 0x7f000000
+	stataMissingFloat64 = 0x7fe0000000000000
+)
+
 var (
-	supportedDtaVersions = []int{114, 115, 117, 118}
-	rowCountLength       = map[int]int{114: 4, 115: 4, 117: 4, 118: 8}
-	nvarLength           = map[int]int{114: 2, 115: 2, 117: 2, 118: 2}
-	datasetLabelLength   = map[int]int{117: 1, 118: 2}
-	valueLabelLength     = map[int]int{117: 33, 118: 129}
-	voLength             = map[int]int{117: 8, 118: 12}
+	supportedDtaVersions = []int{102, 103, 104, 105, 108, 110, 111, 112, 113, 114, 115, 117, 118, 119}
+	rowCountLength       = map[int]int{102: 2, 103: 4, 104: 4, 105: 4, 108: 4, 110: 4, 111: 4, 112: 4, 113: 4, 114: 4, 115: 4, 117: 4, 118: 8, 119: 8}
+	nvarLength           = map[int]int{102: 2, 103: 2, 104: 2, 105: 2, 108: 2, 110: 2, 111: 2, 112: 2, 113: 2, 114: 2, 115: 2, 117: 2, 118: 2, 119: 4}
+	datasetLabelLength   = map[int]int{117: 1, 118: 2, 119: 2}
+	valueLabelLength     = map[int]int{117: 33, 118: 129, 119: 129}
+	voLength             = map[int]int{117: 8, 118: 12, 119: 12}
+
+	// The number of bytes holding the variable number in a strl
+	// reference in the data, the remaining bytes of the 8 byte
+	// reference hold the observation number
+	strlVarLength = map[int]int{117: 4, 118: 2, 119: 3}
 )
 
 func logerr(err error) {
@@ -42,7 +60,7 @@ func logerr(err error) {
 }
 
 // StataReader reads Stata dta data files.  Currently dta format
-// versions 114, 115, 117, and 118 can be read.
+// versions 102 to 105, 108, 110 to 115, and 117 to 119 can be read.
 //
 // The Read method reads and returns the data.  Several fields of the
 // StataReader struct may also be of interest.
@@ -83,7 +101,9 @@ type StataReader struct {
 	// An additional text entry describing each variable
 	ColumnNamesLong []string
 
-	// String labels for categorical variables
+	// String labels for categorical variables.  The labels of the
+	// extended missing values .a to .z have the keys 2147483622 to
+	// 2147483647.
 	ValueLabels     map[string]map[int32]string
 	ValueLabelNames []string
 
@@ -103,6 +123,17 @@ type StataReader struct {
 	// The number of rows of data that have been read.
 	rowsRead int
 
+	// The range of rows that are read, all rows in the file unless
+	// the reader was created by NewStataPartitions
+	firstRow int
+	endRow   int
+
+	// The position of the first row of data, the length of each
+	// row, and whether the reader is positioned at the next row
+	dataStart int64
+	rowLength int64
+	atData    bool
+
 	// Map information
 	seekVartypes        int64
 	seekVarnames        int64
@@ -114,18 +145,69 @@ type StataReader struct {
 	seekData            int64
 	seekStrls           int64
 	seekValueLabels     int64
+	seekEnd             int64
 
 	// Indicates the columns that contain dates
 	isDate []bool
 
+	// The largest integer values that are not missing, which are
+	// lower in versions before 113 as there are no extended missing
+	// values
+	maxInt8  int8
+	maxInt16 int16
+	maxInt32 int32
+
 	// An io channel from which the data are read
 	reader io.ReadSeeker
+
+	// The limits applied in hardened mode (nil otherwise), and the
+	// size of the file
+	limits   *ReadLimits
+	fileSize int64
+
+	// In recovery mode, the rows and sections that are missing or
+	// damaged are skipped and recorded in the report
+	recover  bool
+	recovery RecoveryReport
 }
 
 // NewStataReader returns a StataReader for reading from the given io.ReadSeeker.
 func NewStataReader(r io.ReadSeeker) (*StataReader, error) {
+	return NewStataReaderWithLimits(r, nil)
+}
+
+// NewStataReaderWithLimits returns a StataReader that reads the file
+// in hardened mode, checking all sizes read from the file against the
+// file size and the given limits.  Use this to read files from
+// untrusted sources.  If limits is nil, this is equivalent to
+// NewStataReader.
+func NewStataReaderWithLimits(r io.ReadSeeker, limits *ReadLimits) (*StataReader, error) {
+	return newStataReader(r, limits, false)
+}
+
+// NewStataReaderWithRecovery returns a StataReader for a file that may
+// be truncated or partially corrupt.  Only the complete rows present
+// in the file are read, and the strls and value labels are skipped if
+// they cannot be read, so that all the intact data are returned
+// instead of an error.  Recovery returns a report of the rows
+// recovered and the parts of the file that could not be read.  The
+// header and the variable descriptions must be intact.
+func NewStataReaderWithRecovery(r io.ReadSeeker) (*StataReader, error) {
+	return newStataReader(r, nil, true)
+}
+
+func newStataReader(r io.ReadSeeker, limits *ReadLimits, recover bool) (*StataReader, error) {
 	rdr := new(StataReader)
 	rdr.reader = r
+	rdr.limits = limits
+	rdr.recover = recover
+	if limits != nil || recover {
+		var err error
+		rdr.fileSize, err = streamSize(r)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Defaults, can be changed before reading
 	rdr.InsertStrls = true
@@ -144,6 +226,13 @@ func (rdr *StataReader) RowCount() int {
 	return rdr.rowCount
 }
 
+// RowRange returns the range of rows that are read, from first up to
+// but not including end.  This is all of the rows in the file unless
+// the reader was created by NewStataPartitions.
+func (rdr *StataReader) RowRange() (first, end int) {
+	return rdr.firstRow, rdr.endRow
+}
+
 // ColumnNames returns the names of the columns in the data file.
 func (rdr *StataReader) ColumnNames() []string {
 	return rdr.columnNames
@@ -168,7 +257,8 @@ func (rdr *StataReader) init() error {
 		return err
 	}
 	if _, err := rdr.reader.Seek(0, 0); err != nil {
-		panic(err)
+		logerr(err)
+		return err
 	}
 
 	if string(c) == "<" {
@@ -181,6 +271,19 @@ func (rdr *StataReader) init() error {
 		return err
 	}
 
+	if rdr.FormatVersion < 113 {
+		rdr.maxInt8, rdr.maxInt16, rdr.maxInt32 = 126, 32766, 2147483646
+	} else {
+		rdr.maxInt8, rdr.maxInt16, rdr.maxInt32 = 100, 32740, 2147483620
+	}
+
+	if rdr.Nvar < 0 || rdr.rowCount < 0 {
+		return fmt.Errorf("invalid dimensions %d x %d", rdr.rowCount, rdr.Nvar)
+	}
+	if rdr.limits != nil && int64(rdr.Nvar) > rdr.fileSize {
+		return fmt.Errorf("%d variables cannot fit in a file of %d bytes", rdr.Nvar, rdr.fileSize)
+	}
+
 	if err := rdr.readVartypes(); err != nil {
 		logerr(err)
 		return err
@@ -193,6 +296,11 @@ func (rdr *StataReader) init() error {
 		}
 	}
 
+	if err := rdr.checkVartypes(); err != nil {
+		logerr(err)
+		return err
+	}
+
 	if err := rdr.readVarnames(); err != nil {
 		logerr(err)
 		return err
@@ -227,35 +335,112 @@ func (rdr *StataReader) init() error {
 			logerr(err)
 			return err
 		}
-	}
 
-	if rdr.FormatVersion >= 117 {
-		if err := rdr.readStrls(); err != nil {
+		// The data follow the expansion fields
+		rdr.dataStart, err = rdr.reader.Seek(0, io.SeekCurrent)
+		if err != nil {
 			logerr(err)
 			return err
 		}
+	} else {
+		rdr.dataStart = rdr.seekData + 6
+	}
+	rdr.endRow = rdr.rowCount
+	if rdr.recover {
+		rdr.recoverRows()
+	}
+
+	if rdr.FormatVersion < 117 {
+		// The value labels follow the data
+		labelStart := rdr.dataStart + int64(rdr.rowCount)*rdr.rowLength
+		if err := rdr.readOldValueLabels(labelStart); err != nil {
+			if !rdr.recover {
+				logerr(err)
+				return err
+			}
+			rdr.recovery.addRange(labelStart, rdr.fileSize)
+		}
+	} else {
+		if err := rdr.readStrls(); err != nil {
+			if !rdr.recover {
+				logerr(err)
+				return err
+			}
+			rdr.recovery.addRange(rdr.seekStrls, rdr.seekValueLabels)
+		}
 
-		// Must be called manually for older format < 117.
 		if err := rdr.readValueLabels(); err != nil {
-			logerr(err)
-			return err
+			if !rdr.recover {
+				logerr(err)
+				return err
+			}
+			rdr.recovery.addRange(rdr.seekValueLabels, rdr.seekEnd)
 		}
 	}
 
 	return nil
 }
 
+// recoverRows limits the rows that are read to the complete rows that
+// are present in the file, and records the missing part of a
+// truncated file as unreadable.
+func (rdr *StataReader) recoverRows() {
+
+	dataEnd := rdr.dataStart + int64(rdr.rowCount)*rdr.rowLength
+	end := dataEnd
+	if rdr.FormatVersion >= 117 {
+		end = rdr.seekEnd + int64(len("</stata_dta>"))
+	}
+	if rdr.fileSize >= end || rdr.rowLength == 0 {
+		return
+	}
+
+	// The incomplete final row is also unreadable
+	start := rdr.fileSize
+	if start < dataEnd {
+		complete := (rdr.fileSize - rdr.dataStart) / rdr.rowLength
+		if complete < 0 {
+			complete = 0
+		}
+		rdr.endRow = int(complete)
+		start = rdr.dataStart + complete*rdr.rowLength
+	}
+	rdr.recovery.addRange(start, end)
+}
+
+// Recovery returns a report of the rows that have been read and the
+// parts of the file that could not be read, for a reader created with
+// NewStataReaderWithRecovery.  The report is complete once Read has
+// returned all of the rows.
+func (rdr *StataReader) Recovery() RecoveryReport {
+
+	report := rdr.recovery
+	report.RowCount = rdr.RowCount()
+	report.Unreadable = append([]ByteRange(nil), rdr.recovery.Unreadable...)
+	return report
+}
+
+// readExpansionFields skips over the expansion fields of a pre version
+// 117 file.  Versions before 105 have no expansion fields, and versions
+// before 110 use 2 byte field lengths.
 func (rdr *StataReader) readExpansionFields() error {
-	var b byte
-	var i int32
 
+	if rdr.FormatVersion < 105 {
+		return nil
+	}
+	width := 4
+	if rdr.FormatVersion < 110 {
+		width = 2
+	}
+
+	var b byte
 	for {
 		err := binary.Read(rdr.reader, rdr.ByteOrder, &b)
 		if err != nil {
 			logerr(err)
 			return err
 		}
-		err = binary.Read(rdr.reader, rdr.ByteOrder, &i)
+		i, err := rdr.readInt(width)
 		if err != nil {
 			logerr(err)
 			return err
@@ -315,7 +500,7 @@ func (rdr *StataReader) readUint(width int) (int, error) {
 
 	switch width {
 	default:
-		panic("unsupported width in readUint")
+		return 0, fmt.Errorf("unsupported width %d in readUint", width)
 	case 1:
 		var x uint8
 		err := binary.Read(rdr.reader, rdr.ByteOrder, &x)
@@ -401,18 +586,25 @@ func (rdr *StataReader) readOldHeader() error {
 		return err
 	}
 
-	// Data label
-	n, err := rdr.reader.Read(buf[0:81])
+	// Data label, which is shorter before version 108
+	w := 81
+	if rdr.FormatVersion < 108 {
+		w = 32
+	}
+	n, err := rdr.reader.Read(buf[0:w])
 	if err != nil {
 		logerr(err)
 		return err
 	}
-	if n != 81 {
+	if n != w {
 		return fmt.Errorf("stata file appears to be truncated")
 	}
-	rdr.DatasetLabel = string(partition(buf[0:81]))
+	rdr.DatasetLabel = string(partition(buf[0:w]))
 
-	// Time stamp
+	// Time stamp, not present before version 105
+	if rdr.FormatVersion < 105 {
+		return nil
+	}
 	n, err = rdr.reader.Read(buf[0:18])
 	if err != nil {
 		logerr(err)
@@ -525,6 +717,9 @@ func (rdr *StataReader) readNewHeader() error {
 		logerr(err)
 		return err
 	}
+	if w > len(buf) {
+		buf = make([]byte, w)
+	}
 	n, err = rdr.reader.Read(buf[0:w])
 	if err != nil {
 		logerr(err)
@@ -553,7 +748,8 @@ func (rdr *StataReader) readNewHeader() error {
 		return err
 	}
 	if n != int(n8) {
-		logerr(fmt.Errorf("stata file appears to be truncated"))
+		err = fmt.Errorf("stata file appears to be truncated")
+		logerr(err)
 		return err
 	}
 	rdr.TimeStamp = string(buf[0:n8])
@@ -595,6 +791,9 @@ func (rdr *StataReader) readNewHeader() error {
 	if err := binary.Read(rdr.reader, rdr.ByteOrder, &rdr.seekValueLabels); err != nil {
 		return err
 	}
+	if err := binary.Read(rdr.reader, rdr.ByteOrder, &rdr.seekEnd); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -604,7 +803,7 @@ func (rdr *StataReader) readVartypes() error {
 	var err error
 
 	switch {
-	case rdr.FormatVersion == 118:
+	case rdr.FormatVersion == 118, rdr.FormatVersion == 119:
 		err = rdr.readVartypes16()
 	case rdr.FormatVersion == 117:
 		err = rdr.readVartypes16()
@@ -612,6 +811,8 @@ func (rdr *StataReader) readVartypes() error {
 		err = rdr.readVartypes8()
 	case rdr.FormatVersion == 114:
 		err = rdr.readVartypes8()
+	case rdr.FormatVersion >= 102:
+		err = rdr.readVartypes8()
 	default:
 		err = fmt.Errorf("unknown format version %v", rdr.FormatVersion)
 	}
@@ -654,8 +855,45 @@ func (rdr *StataReader) readVartypes8() error {
 	return nil
 }
 
+// checkVartypes returns an error if a variable has a type that cannot
+// be read, or if the rows of data cannot fit in the file in hardened
+// mode.
+func (rdr *StataReader) checkVartypes() error {
+
+	var rowLength int64
+	for k, t := range rdr.varTypes {
+		switch {
+		case t <= 2045:
+			rowLength += int64(t)
+		case t == StataStrlType, t == StataFloat64Type:
+			rowLength += 8
+		case t == StataFloat32Type, t == StataInt32Type:
+			rowLength += 4
+		case t == StataInt16Type:
+			rowLength += 2
+		case t == StataInt8Type:
+			rowLength++
+		default:
+			return fmt.Errorf("variable %d has unknown type %d", k, t)
+		}
+	}
+
+	if rdr.limits != nil && rowLength > 0 && int64(rdr.rowCount) > rdr.fileSize/rowLength {
+		return fmt.Errorf("%d rows of %d bytes cannot fit in a file of %d bytes", rdr.rowCount, rowLength, rdr.fileSize)
+	}
+	rdr.rowLength = rowLength
+
+	return nil
+}
+
+// translateVartypes converts the one byte type codes of a pre version
+// 117 file to the codes used in later versions.
 func (rdr *StataReader) translateVartypes() error {
 
+	if rdr.FormatVersion < 111 {
+		return rdr.translateOldVartypes()
+	}
+
 	for k := 0; k < int(rdr.Nvar); k++ {
 		switch {
 		case rdr.varTypes[k] <= 244:
@@ -679,12 +917,40 @@ func (rdr *StataReader) translateVartypes() error {
 	return nil
 }
 
+// translateOldVartypes converts the type codes used before version
+// 111, which are the characters 'b', 'i', 'l', 'f' and 'd' for the
+// numeric types, and 127 plus the length for strings.
+func (rdr *StataReader) translateOldVartypes() error {
+
+	for k := 0; k < int(rdr.Nvar); k++ {
+		switch t := rdr.varTypes[k]; {
+		case t > 127 && t <= 255:
+			// strf
+			rdr.varTypes[k] = t - 127
+		case t == 'b':
+			rdr.varTypes[k] = StataInt8Type
+		case t == 'i':
+			rdr.varTypes[k] = StataInt16Type
+		case t == 'l':
+			rdr.varTypes[k] = StataInt32Type
+		case t == 'f':
+			rdr.varTypes[k] = StataFloat32Type
+		case t == 'd':
+			rdr.varTypes[k] = StataFloat64Type
+		default:
+			return fmt.Errorf("unknown variable type %d", t)
+		}
+	}
+
+	return nil
+}
+
 func (rdr *StataReader) readFormats() error {
 
 	var err error
 
 	switch {
-	case rdr.FormatVersion == 118:
+	case rdr.FormatVersion == 118, rdr.FormatVersion == 119:
 		err = rdr.doReadFormats(57, true)
 	case rdr.FormatVersion == 117:
 		err = rdr.doReadFormats(49, true)
@@ -692,6 +958,10 @@ func (rdr *StataReader) readFormats() error {
 		err = rdr.doReadFormats(49, false)
 	case rdr.FormatVersion == 114:
 		err = rdr.doReadFormats(49, false)
+	case rdr.FormatVersion >= 105:
+		err = rdr.doReadFormats(12, false)
+	case rdr.FormatVersion >= 102:
+		err = rdr.doReadFormats(7, false)
 	default:
 		err = fmt.Errorf("unknown format version %v", rdr.FormatVersion)
 	}
@@ -750,14 +1020,16 @@ func (rdr *StataReader) readVarnames() error {
 
 	var err error
 	switch rdr.FormatVersion {
-	case 118:
+	case 118, 119:
 		err = rdr.doReadVarnames(129, true)
 	case 117:
 		err = rdr.doReadVarnames(33, true)
 	case 115:
 		err = rdr.doReadVarnames(33, false)
-	case 114:
+	case 114, 113, 112, 111, 110:
 		err = rdr.doReadVarnames(33, false)
+	case 108, 105, 104, 103, 102:
+		err = rdr.doReadVarnames(9, false)
 	default:
 		err = fmt.Errorf("unknown format version %d", rdr.FormatVersion)
 	}
@@ -774,7 +1046,8 @@ func (rdr *StataReader) doReadVarnames(bufsize int, seek bool) error {
 	if seek {
 		_, err := rdr.reader.Seek(rdr.seekVarnames+10, 0)
 		if err != nil {
-			panic(err)
+			logerr(err)
+			return err
 		}
 	}
 
@@ -798,14 +1071,16 @@ func (rdr *StataReader) readValueLabelNames() error {
 
 	var err error
 	switch rdr.FormatVersion {
-	case 118:
+	case 118, 119:
 		err = rdr.doReadValueLabelNames(129, true)
 	case 117:
 		err = rdr.doReadValueLabelNames(33, true)
-	case 116:
-		err = rdr.doReadValueLabelNames(33, false)
 	case 115:
 		err = rdr.doReadValueLabelNames(33, false)
+	case 114, 113, 112, 111, 110:
+		err = rdr.doReadValueLabelNames(33, false)
+	case 108, 105, 104, 103, 102:
+		err = rdr.doReadValueLabelNames(9, false)
 	default:
 		return fmt.Errorf("unknown format version %v", rdr.FormatVersion)
 	}
@@ -841,14 +1116,16 @@ func (rdr *StataReader) readVariableLabels() error {
 
 	var err error
 	switch rdr.FormatVersion {
-	case 118:
+	case 118, 119:
 		err = rdr.doReadVariableLabels(321, true)
 	case 117:
 		err = rdr.doReadVariableLabels(81, true)
 	case 115:
 		err = rdr.doReadVariableLabels(81, false)
-	case 114:
+	case 114, 113, 112, 111, 110, 108:
 		err = rdr.doReadVariableLabels(81, false)
+	case 105, 104, 103, 102:
+		err = rdr.doReadVariableLabels(32, false)
 	default:
 		err = fmt.Errorf("Unknown format version %d", rdr.FormatVersion)
 	}
@@ -919,6 +1196,12 @@ func (rdr *StataReader) readValueLabels() error {
 		if err := binary.Read(rdr.reader, rdr.ByteOrder, &textlen); err != nil {
 			return err
 		}
+		if err := rdr.limits.checkSize("value label table", 8*int64(n), rdr.fileSize); err != nil {
+			return err
+		}
+		if err := rdr.limits.checkSize("value label text", int64(textlen), rdr.fileSize); err != nil {
+			return err
+		}
 
 		off := make([]int32, n)
 		val := make([]int32, n)
@@ -939,13 +1222,16 @@ func (rdr *StataReader) readValueLabels() error {
 			buf = make([]byte, 2*textlen)
 		}
 
-		if _, err := rdr.reader.Read(buf[0:textlen]); err != nil {
+		if _, err := io.ReadFull(rdr.reader, buf[0:textlen]); err != nil {
 			return err
 		}
 
 		vk := make(map[int32]string)
 		for j := int32(0); j < n; j++ {
-			vk[val[j]] = string(partition(buf[off[j]:]))
+			if off[j] < 0 || off[j] > textlen {
+				return fmt.Errorf("value label %s: offset %d is outside the text", labname, off[j])
+			}
+			vk[val[j]] = string(partition(buf[off[j]:textlen]))
 		}
 		vl[labname] = vk
 
@@ -960,6 +1246,106 @@ func (rdr *StataReader) readValueLabels() error {
 	return nil
 }
 
+// readOldValueLabels reads the value label tables of a pre version
+// 117 file, which follow the data at position start and extend to the
+// end of the file.  Before version 108, each table holds 2 byte values
+// with labels of 8 bytes.
+func (rdr *StataReader) readOldValueLabels(start int64) error {
+
+	rdr.ValueLabels = make(map[string]map[int32]string)
+	if _, err := rdr.reader.Seek(start, 0); err != nil {
+		return err
+	}
+
+	nameLen := 33
+	if rdr.FormatVersion < 110 {
+		nameLen = 9
+	}
+	buf := make([]byte, nameLen+3)
+
+	for {
+		if rdr.FormatVersion < 108 {
+			n, err := rdr.readInt(2)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(rdr.reader, buf[0:nameLen+1]); err != nil {
+				return err
+			}
+			labname := string(partition(buf[0:nameLen]))
+			if err := rdr.limits.checkSize("value label table", 10*int64(n), rdr.fileSize); err != nil {
+				return err
+			}
+
+			val := make([]int16, n)
+			if err := binary.Read(rdr.reader, rdr.ByteOrder, val); err != nil {
+				return err
+			}
+			txt := make([]byte, 8*n)
+			if _, err := io.ReadFull(rdr.reader, txt); err != nil {
+				return err
+			}
+
+			vk := make(map[int32]string)
+			for j := range val {
+				vk[int32(val[j])] = string(partition(txt[8*j : 8*j+8]))
+			}
+			rdr.ValueLabels[labname] = vk
+			continue
+		}
+
+		// The length of the table is not needed
+		if _, err := rdr.readInt(4); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rdr.reader, buf[0:nameLen+3]); err != nil {
+			return err
+		}
+		labname := string(partition(buf[0:nameLen]))
+
+		n, err := rdr.readInt(4)
+		if err != nil {
+			return err
+		}
+		textlen, err := rdr.readInt(4)
+		if err != nil {
+			return err
+		}
+		if err := rdr.limits.checkSize("value label table", 8*int64(n), rdr.fileSize); err != nil {
+			return err
+		}
+		if err := rdr.limits.checkSize("value label text", int64(textlen), rdr.fileSize); err != nil {
+			return err
+		}
+
+		off := make([]int32, n)
+		val := make([]int32, n)
+		if err := binary.Read(rdr.reader, rdr.ByteOrder, off); err != nil {
+			return err
+		}
+		if err := binary.Read(rdr.reader, rdr.ByteOrder, val); err != nil {
+			return err
+		}
+		txt := make([]byte, textlen)
+		if _, err := io.ReadFull(rdr.reader, txt); err != nil {
+			return err
+		}
+
+		vk := make(map[int32]string)
+		for j := range val {
+			if off[j] < 0 || int(off[j]) > textlen {
+				return fmt.Errorf("value label %s: offset %d is outside the text", labname, off[j])
+			}
+			vk[val[j]] = string(partition(txt[off[j]:]))
+		}
+		rdr.ValueLabels[labname] = vk
+	}
+}
+
 func (rdr *StataReader) readStrls() error {
 
 	if _, err := rdr.reader.Seek(rdr.seekStrls+7, 0); err != nil {
@@ -967,7 +1353,6 @@ func (rdr *StataReader) readStrls() error {
 	}
 
 	vo := make([]byte, voLength[rdr.FormatVersion])
-	vo8 := make([]byte, 8)
 	var t uint8
 	var length uint32
 
@@ -1000,22 +1385,15 @@ func (rdr *StataReader) readStrls() error {
 			return err
 		}
 
-		if voLength[rdr.FormatVersion] == 12 {
-			copy(vo8[0:2], vo[0:2])
-			copy(vo8[2:8], vo[4:10])
-		} else {
-			copy(vo8, vo)
-		}
+		ptr := rdr.strlKey(vo)
 
-		var ptr uint64
-		if err := binary.Read(bytes.NewReader(vo8), rdr.ByteOrder, &ptr); err != nil {
+		if err := rdr.limits.checkSize("strl", int64(length), rdr.fileSize); err != nil {
 			return err
 		}
-
 		if len(buf) < int(length) {
-			buf = make([]byte, 2*length)
+			buf = make([]byte, 2*int(length))
 		}
-		if _, err := rdr.reader.Read(buf[0:length]); err != nil {
+		if _, err := io.ReadFull(rdr.reader, buf[0:length]); err != nil {
 			return err
 		}
 
@@ -1034,6 +1412,28 @@ func (rdr *StataReader) readStrls() error {
 	return nil
 }
 
+// strlKey returns the key in Strls of the strl with the given (v,o)
+// identifier from the strls section.  This is the 8 byte reference to
+// the strl in the data, read as an integer.  The reference holds v
+// and o in strlVarLength and 8-strlVarLength bytes, which are fewer
+// bytes than in the strls section.
+func (rdr *StataReader) strlKey(vo []byte) uint64 {
+
+	v := uint64(rdr.ByteOrder.Uint32(vo[0:4]))
+	var o uint64
+	if len(vo) == 12 {
+		o = rdr.ByteOrder.Uint64(vo[4:12])
+	} else {
+		o = uint64(rdr.ByteOrder.Uint32(vo[4:8]))
+	}
+
+	n := uint(strlVarLength[rdr.FormatVersion])
+	if rdr.ByteOrder == binary.BigEndian {
+		return v<<(8*(8-n)) | o
+	}
+	return v | o<<(8*n)
+}
+
 func (rdr *StataReader) allocateCols(nval int) []interface{} {
 
 	data := make([]interface{}, rdr.Nvar)
@@ -1065,7 +1465,11 @@ func (rdr *StataReader) allocateCols(nval int) []interface{} {
 	return data
 }
 
-func (rdr *StataReader) doInsertCategoryLabels(data []interface{}, missing [][]bool, nval int) {
+// doInsertCategoryLabels replaces the values of the variables that
+// have value labels with the labels.  Extended missing values that
+// have labels are replaced by their labels, and remain missing with
+// their codes, so that they can still be told apart from the values.
+func (rdr *StataReader) doInsertCategoryLabels(data []interface{}, missing [][]bool, codes [][]byte, nval int) error {
 
 	for j := 0; j < rdr.Nvar; j++ {
 		labname := rdr.ValueLabelNames[j]
@@ -1076,7 +1480,7 @@ func (rdr *StataReader) doInsertCategoryLabels(data []interface{}, missing [][]b
 
 		idat, err := castToInt(data[j])
 		if err != nil {
-			panic(fmt.Sprintf("non-integer value label indices: %v", err))
+			return fmt.Errorf("non-integer value label indices: %v", err)
 		}
 
 		newdata := make([]string, nval)
@@ -1088,20 +1492,51 @@ func (rdr *StataReader) doInsertCategoryLabels(data []interface{}, missing [][]b
 				} else {
 					newdata[i] = fmt.Sprintf("%v", idat[i])
 				}
+			} else if codes[j] != nil && codes[j][i] != 0 {
+				// Extended missing values are labeled by their
+				// value as a long
+				if v, ok := mp[stataMissingInt32+int32(codes[j][i]-'a'+1)]; ok {
+					newdata[i] = v
+				}
 			}
 		}
 		data[j] = newdata
 	}
+
+	return nil
 }
 
-func (rdr *StataReader) readRow(i int, buf, buf8 []byte, data []interface{}, missing [][]bool) {
+// missingCode returns the code of a missing value, given the offset k
+// of its value from the system missing value ".".  The code is 'a' to
+// 'z' for the extended missing values .a to .z, which are present from
+// version 113, and zero for ".".
+func (rdr *StataReader) missingCode(k int64) byte {
+	if rdr.FormatVersion < 113 || k <= 0 || k > 26 {
+		return 0
+	}
+	return byte('a' + k - 1)
+}
+
+// setMissingCode records the code of the missing value in row i of
+// variable j, allocating the codes for the variable if needed.
+func setMissingCode(codes [][]byte, j, i int, code byte, nval int) {
+	if code == 0 {
+		return
+	}
+	if codes[j] == nil {
+		codes[j] = make([]byte, nval)
+	}
+	codes[j][i] = code
+}
+
+func (rdr *StataReader) readRow(i int, buf, buf8 []byte, data []interface{}, missing [][]bool, codes [][]byte) error {
 
 	for j := 0; j < rdr.Nvar; j++ {
 		switch t := rdr.varTypes[j]; {
 		case t <= 2045:
 			// strf
-			if _, err := rdr.reader.Read(buf[0:t]); err != nil {
-				panic(err)
+			if _, err := io.ReadFull(rdr.reader, buf[0:t]); err != nil {
+				return err
 			}
 			data[j].([]string)[i] = string(partition(buf[0:t]))
 		case t == StataStrlType:
@@ -1109,69 +1544,81 @@ func (rdr *StataReader) readRow(i int, buf, buf8 []byte, data []interface{}, mis
 				// The STRL pointer is 2 byte integer followed by 6 byte integer
 				// or 4 + 4 depending on the version
 				if err := binary.Read(rdr.reader, rdr.ByteOrder, buf8); err != nil {
-					panic(err)
+					return err
 				}
 				var ptr uint64
 				if err := binary.Read(bytes.NewReader(buf8), rdr.ByteOrder, &ptr); err != nil {
-					panic(err)
+					return err
 				}
 				data[j].([]string)[i] = rdr.Strls[ptr]
 			} else {
 				if err := binary.Read(rdr.reader, rdr.ByteOrder, &(data[j].([]uint64)[i])); err != nil {
-					panic(err)
+					return err
 				}
 			}
 		case t == StataFloat64Type:
 			var x float64
 			if err := binary.Read(rdr.reader, rdr.ByteOrder, &x); err != nil {
-				panic(err)
+				return err
 			}
 			data[j].([]float64)[i] = x
 			// Lower bound in dta spec is out of range.
 			if x > 8.988e307 || x < -8.988e307 {
 				missing[j][i] = true
+				if x > 0 {
+					k := int64((math.Float64bits(x) - stataMissingFloat64) >> 40)
+					setMissingCode(codes, j, i, rdr.missingCode(k), len(missing[j]))
+				}
 			}
 		case t == StataFloat32Type:
 			var x float32
 			if err := binary.Read(rdr.reader, rdr.ByteOrder, &x); err != nil {
-				panic(err)
+				return err
 			}
 			data[j].([]float32)[i] = x
 			if x > 1.701e38 || x < -1.701e38 {
 				missing[j][i] = true
+				if x > 0 {
+					k := int64((math.Float32bits(x) - stataMissingFloat32) >> 11)
+					setMissingCode(codes, j, i, rdr.missingCode(k), len(missing[j]))
+				}
 			}
 		case t == StataInt32Type:
 			var x int32
 			if err := binary.Read(rdr.reader, rdr.ByteOrder, &x); err != nil {
-				panic(err)
+				return err
 			}
 			data[j].([]int32)[i] = x
-			if x > 2147483620 || x < -2147483647 {
+			if x > rdr.maxInt32 || x < -2147483647 {
 				missing[j][i] = true
+				setMissingCode(codes, j, i, rdr.missingCode(int64(x)-stataMissingInt32), len(missing[j]))
 			}
 		case t == StataInt16Type:
 			var x int16
 			if err := binary.Read(rdr.reader, rdr.ByteOrder, &x); err != nil {
-				panic(err)
+				return err
 			}
 			data[j].([]int16)[i] = x
-			if x > 32740 || x < -32767 {
+			if x > rdr.maxInt16 || x < -32767 {
 				missing[j][i] = true
+				setMissingCode(codes, j, i, rdr.missingCode(int64(x)-stataMissingInt16), len(missing[j]))
 			}
 		case t == StataInt8Type:
 			var x int8
 			if err := binary.Read(rdr.reader, rdr.ByteOrder, &x); err != nil {
-				panic(err)
+				return err
 			}
-			if x < -127 || x > 100 {
+			if x < -127 || x > rdr.maxInt8 {
 				missing[j][i] = true
+				setMissingCode(codes, j, i, rdr.missingCode(int64(x)-stataMissingInt8), len(missing[j]))
 			}
 			data[j].([]int8)[i] = x
 		default:
-			msg := fmt.Sprintf("Unknown variable type")
-			panic(msg)
+			return fmt.Errorf("unknown variable type %d", t)
 		}
 	}
+
+	return nil
 }
 
 // Read returns the given number of rows of data from the Stata data
@@ -1180,24 +1627,30 @@ func (rdr *StataReader) readRow(i int, buf, buf8 []byte, data []interface{}, mis
 func (rdr *StataReader) Read(rows int) ([]*Series, error) {
 
 	// Compute number of values to read
-	nval := int(rdr.rowCount) - rdr.rowsRead
+	nval := rdr.endRow - rdr.firstRow - rdr.rowsRead
 	if rows >= 0 && rows < nval {
 		nval = rows
 	} else if nval <= 0 {
 		return nil, nil
 	}
+	if err := rdr.limits.checkAlloc("rows", int64(nval), 9*int64(rdr.Nvar)); err != nil {
+		return nil, err
+	}
 
 	data := rdr.allocateCols(nval)
 	missing := make([][]bool, rdr.Nvar)
+	codes := make([][]byte, rdr.Nvar)
 
 	for j := 0; j < int(rdr.Nvar); j++ {
 		missing[j] = make([]bool, nval)
 	}
 
-	if rdr.FormatVersion >= 117 && rdr.rowsRead == 0 {
-		if _, err := rdr.reader.Seek(rdr.seekData+6, 0); err != nil {
+	if !rdr.atData {
+		pos := rdr.dataStart + int64(rdr.firstRow+rdr.rowsRead)*rdr.rowLength
+		if _, err := rdr.reader.Seek(pos, 0); err != nil {
 			return nil, err
 		}
+		rdr.atData = true
 	}
 
 	buf := make([]byte, 2045)
@@ -1205,21 +1658,30 @@ func (rdr *StataReader) Read(rows int) ([]*Series, error) {
 	for i := 0; i < nval; i++ {
 
 		rdr.rowsRead += 1
-		if rdr.rowsRead > int(rdr.rowCount) {
+		if rdr.firstRow+rdr.rowsRead > rdr.endRow {
 			break
 		}
 
-		rdr.readRow(i, buf, buf8, data, missing)
+		if err := rdr.readRow(i, buf, buf8, data, missing, codes); err != nil {
+			return nil, err
+		}
 	}
+	rdr.recovery.RowsRecovered += nval
 
 	if rdr.InsertCategoryLabels {
-		rdr.doInsertCategoryLabels(data, missing, nval)
+		if err := rdr.doInsertCategoryLabels(data, missing, codes, nval); err != nil {
+			return nil, err
+		}
 	}
 
 	if rdr.ConvertDates {
 		for j := range data {
 			if rdr.isDate[j] {
-				data[j] = rdr.doConvertDates(data[j], rdr.Formats[j])
+				var err error
+				data[j], err = rdr.doConvertDates(data[j], rdr.Formats[j])
+				if err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
@@ -1232,35 +1694,40 @@ func (rdr *StataReader) Read(rows int) ([]*Series, error) {
 		if err != nil {
 			return nil, err
 		}
+		rdata[j].missingCodes = codes[j]
 	}
 
 	return rdata, nil
 }
 
-func (rdr *StataReader) doConvertDates(v interface{}, format string) interface{} {
+func (rdr *StataReader) doConvertDates(v interface{}, format string) (interface{}, error) {
 
 	vec, err := upcastNumeric(v)
 	if err != nil {
-		panic(fmt.Sprintf("unable to handle type %T in date vector", v))
+		return nil, fmt.Errorf("unable to handle type %T in date vector", v)
 	}
 
 	bt := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	rvec := make([]time.Time, len(vec))
 
-	var tq time.Duration
+	var days bool
 	if strings.Index(format, "%td") == 0 {
-		tq = time.Hour * 24
-	} else if strings.Index(format, "%tc") == 0 {
-		tq = time.Millisecond
-	} else {
-		panic("unable to handle format in date vector")
+		days = true
+	} else if strings.Index(format, "%tc") != 0 {
+		return nil, fmt.Errorf("unable to handle format in date vector")
 	}
 
+	// A time.Duration only spans about 292 years, so the times are
+	// found from their seconds since the Unix epoch
 	for j, v := range vec {
-		d := time.Duration(v) * tq
-		rvec[j] = bt.Add(d)
+		if days {
+			rvec[j] = bt.AddDate(0, 0, int(v))
+		} else {
+			s := math.Floor(v / 1000)
+			rvec[j] = time.Unix(bt.Unix()+int64(s), int64(1e6*(v-1000*s))).UTC()
+		}
 	}
 
-	return rvec
+	return rvec, nil
 }
@@ -1,7 +1,11 @@
 package datareader
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -121,3 +125,606 @@ func TestStata2(t *testing.T) {
 		}
 	}
 }
+
+func TestStataLimits(t *testing.T) {
+
+	b, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1_115.dta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A negative number of variables is always rejected
+	c := make([]byte, len(b))
+	copy(c, b)
+	binary.LittleEndian.PutUint16(c[4:], 0xffff)
+	if _, err := NewStataReader(bytes.NewReader(c)); err == nil {
+		t.Errorf("No error with a negative number of variables")
+	}
+
+	// A row count that is too large for the file
+	copy(c, b)
+	binary.LittleEndian.PutUint32(c[6:], 0x7fffffff)
+	if _, err := NewStataReaderWithLimits(bytes.NewReader(c), &ReadLimits{}); err == nil {
+		t.Errorf("No error with a row count larger than the file")
+	}
+
+	// A Read that needs more memory than allowed
+	stata, err := NewStataReaderWithLimits(bytes.NewReader(b), &ReadLimits{MaxAlloc: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stata.Read(-1); err == nil {
+		t.Errorf("No error reading all rows")
+	}
+	ds, err := stata.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 100 || ds[0].Length() != 1 {
+		t.Errorf("Read %d columns of %d rows", len(ds), ds[0].Length())
+	}
+}
+
+func TestStataRecovery(t *testing.T) {
+
+	for _, fname := range []string{"test1_115.dta", "test1_117.dta", "test1_118.dta"} {
+		b, err := ioutil.ReadFile(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stata, err := NewStataReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := stata.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nrow := stata.RowCount()
+		dataEnd := stata.dataStart + int64(nrow)*stata.rowLength
+
+		// Truncated in a row, and following the data
+		for _, cut := range []int64{stata.dataStart + int64(nrow/2)*stata.rowLength + 3, dataEnd} {
+			expected := nrow
+			if cut < dataEnd {
+				expected = nrow / 2
+			}
+
+			stata, err := NewStataReaderWithRecovery(bytes.NewReader(b[:cut]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ds, err := stata.Read(-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ds[0].Length() != expected {
+				t.Errorf("%s: recovered %d rows, expected %d", fname, ds[0].Length(), expected)
+			}
+			for j := range ds {
+				if stata.ColumnTypes()[j] == StataStrlType {
+					// The strls follow the data
+					continue
+				}
+				if f, i := ds[j].UpcastNumeric().AllEqual(sliceTestSeries(all[j].UpcastNumeric(), 0, expected)); !f {
+					t.Errorf("%s: column %d differs at row %d", fname, j, i)
+				}
+			}
+			if ds, err := stata.Read(-1); err != nil || ds != nil {
+				t.Errorf("%s: read past the end of the recovered rows", fname)
+			}
+
+			report := stata.Recovery()
+			if report.RowsRecovered != expected || report.RowCount != nrow {
+				t.Errorf("%s: %v", fname, report)
+			}
+			if cut < dataEnd && (len(report.Unreadable) != 1 || report.Unreadable[0].Start != cut-3) {
+				t.Errorf("%s: truncated at %d, unreadable ranges %v", fname, cut, report.Unreadable)
+			}
+			if (cut < dataEnd || stata.FormatVersion >= 117) && report.Unreadable[len(report.Unreadable)-1].End <= cut {
+				t.Errorf("%s: truncated at %d, unreadable ranges %v", fname, cut, report.Unreadable)
+			}
+		}
+
+		// Without recovery, a file truncated in the data is an
+		// error
+		stata, err = NewStataReader(bytes.NewReader(b[:dataEnd-5]))
+		if err == nil {
+			_, err = stata.Read(-1)
+		}
+		if err == nil {
+			t.Errorf("%s: no error with a truncated file", fname)
+		}
+
+		// An intact file is read completely
+		stata, err = NewStataReaderWithRecovery(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stata.Read(-1); err != nil {
+			t.Fatal(err)
+		}
+		if report := stata.Recovery(); report.RowsRecovered != nrow || len(report.Unreadable) != 0 {
+			t.Errorf("%s: intact file, %v", fname, report)
+		}
+
+		// Truncated in the closing </stata_dta> tag
+		if stata.FormatVersion < 117 {
+			continue
+		}
+		cut := int64(len(b)) - 3
+		stata, err = NewStataReaderWithRecovery(bytes.NewReader(b[:cut]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stata.Read(-1); err != nil {
+			t.Fatal(err)
+		}
+		report := stata.Recovery()
+		if report.RowsRecovered != nrow || len(report.Unreadable) != 1 ||
+			report.Unreadable[0] != (ByteRange{Start: cut, End: int64(len(b))}) {
+			t.Errorf("%s: truncated in the closing tag, %v", fname, report)
+		}
+	}
+}
+
+// writeTestDta returns a dta file in format 117, 118 or 119 with nvar
+// variables and nrow observations.  Variable 0 is a strl holding
+// "strl i" in observation i, variable 1 is a str8 holding "s i", and
+// the remaining variables are bytes holding (i+j)%100.
+func writeTestDta(version int, order binary.ByteOrder, nvar, nrow int) []byte {
+
+	var b bytes.Buffer
+	put := func(width int, x uint64) {
+		buf := make([]byte, 8)
+		order.PutUint64(buf, x)
+		if order == binary.BigEndian {
+			b.Write(buf[8-width:])
+		} else {
+			b.Write(buf[:width])
+		}
+	}
+	fixed := func(s string, width int) {
+		buf := make([]byte, width)
+		copy(buf, s)
+		b.Write(buf)
+	}
+
+	bo := "LSF"
+	if order == binary.BigEndian {
+		bo = "MSF"
+	}
+	b.WriteString(fmt.Sprintf("<stata_dta><header><release>%d</release><byteorder>%s</byteorder><K>", version, bo))
+	put(nvarLength[version], uint64(nvar))
+	b.WriteString("</K><N>")
+	put(rowCountLength[version], uint64(nrow))
+	b.WriteString("</N><label>")
+	put(datasetLabelLength[version], 4)
+	b.WriteString("wide</label><timestamp>")
+	put(1, 17)
+	b.WriteString("16 Oct 2026 12:00</timestamp></header>")
+
+	// The map is filled in once the positions are known
+	b.WriteString("<map>")
+	mapPos := b.Len()
+	b.Write(make([]byte, 14*8))
+	b.WriteString("</map>")
+	var seek []uint64
+	section := func(name string) {
+		seek = append(seek, uint64(b.Len()))
+		b.WriteString("<" + name + ">")
+	}
+
+	nameLen, fmtLen, labelLen := 129, 57, 321
+	if version == 117 {
+		nameLen, fmtLen, labelLen = 33, 49, 81
+	}
+	section("variable_types")
+	for j := 0; j < nvar; j++ {
+		switch j {
+		case 0:
+			put(2, uint64(StataStrlType))
+		case 1:
+			put(2, 8)
+		default:
+			put(2, uint64(StataInt8Type))
+		}
+	}
+	b.WriteString("</variable_types>")
+	section("varnames")
+	for j := 0; j < nvar; j++ {
+		fixed(fmt.Sprintf("v%d", j), nameLen)
+	}
+	b.WriteString("</varnames>")
+	section("sortlist")
+	sortWidth := 2
+	if version == 119 {
+		sortWidth = 4
+	}
+	b.Write(make([]byte, (nvar+1)*sortWidth))
+	b.WriteString("</sortlist>")
+	section("formats")
+	for j := 0; j < nvar; j++ {
+		fixed("%8.0g", fmtLen)
+	}
+	b.WriteString("</formats>")
+	section("value_label_names")
+	for j := 0; j < nvar; j++ {
+		fixed("", nameLen)
+	}
+	b.WriteString("</value_label_names>")
+	section("variable_labels")
+	for j := 0; j < nvar; j++ {
+		fixed(fmt.Sprintf("Variable %d", j), labelLen)
+	}
+	b.WriteString("</variable_labels>")
+	section("characteristics")
+	b.WriteString("</characteristics>")
+
+	section("data")
+	n := strlVarLength[version]
+	for i := 0; i < nrow; i++ {
+		put(n, 1)
+		put(8-n, uint64(i+1))
+		fixed(fmt.Sprintf("s %d", i), 8)
+		for j := 2; j < nvar; j++ {
+			put(1, uint64((i+j)%100))
+		}
+	}
+	b.WriteString("</data>")
+
+	section("strls")
+	for i := 0; i < nrow; i++ {
+		b.WriteString("GSO")
+		put(4, 1)
+		put(voLength[version]-4, uint64(i+1))
+		put(1, 130)
+		v := fmt.Sprintf("strl %d", i)
+		put(4, uint64(len(v)+1))
+		fixed(v, len(v)+1)
+	}
+	b.WriteString("</strls>")
+	section("value_labels")
+	b.WriteString("</value_labels>")
+	seek = append(seek, uint64(b.Len()))
+	b.WriteString("</stata_dta>")
+	seek = append(seek, uint64(b.Len()))
+
+	data := b.Bytes()
+	order.PutUint64(data[mapPos+8:], uint64(mapPos-len("<map>")))
+	for k, x := range seek {
+		order.PutUint64(data[mapPos+8*(k+2):], x)
+	}
+	return data
+}
+
+func TestStataWide(t *testing.T) {
+
+	for _, c := range []struct {
+		version int
+		order   binary.ByteOrder
+		nvar    int
+	}{
+		{119, binary.LittleEndian, 40000},
+		{119, binary.BigEndian, 40000},
+		{118, binary.LittleEndian, 10},
+		{118, binary.BigEndian, 10},
+		{117, binary.LittleEndian, 10},
+		{117, binary.BigEndian, 10},
+	} {
+		const nrow = 5
+		b := writeTestDta(c.version, c.order, c.nvar, nrow)
+		stata, err := NewStataReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("%d/%v", c.version, c.order)
+		if stata.FormatVersion != c.version || stata.Nvar != c.nvar || stata.RowCount() != nrow {
+			t.Fatalf("%s: version %d with %d variables and %d rows", name, stata.FormatVersion, stata.Nvar, stata.RowCount())
+		}
+		names := stata.ColumnNames()
+		if names[c.nvar-1] != fmt.Sprintf("v%d", c.nvar-1) || stata.ColumnNamesLong[c.nvar-1] != fmt.Sprintf("Variable %d", c.nvar-1) {
+			t.Errorf("%s: last variable is %s, %s", name, names[c.nvar-1], stata.ColumnNamesLong[c.nvar-1])
+		}
+		if stata.DatasetLabel != "wide" {
+			t.Errorf("%s: dataset label %q", name, stata.DatasetLabel)
+		}
+
+		ds, err := stata.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) != c.nvar {
+			t.Fatalf("%s: read %d columns", name, len(ds))
+		}
+		strl := ds[0].Data().([]string)
+		str := ds[1].Data().([]string)
+		for i := 0; i < nrow; i++ {
+			if strl[i] != fmt.Sprintf("strl %d", i) || str[i] != fmt.Sprintf("s %d", i) {
+				t.Errorf("%s: row %d has strings %q, %q", name, i, strl[i], str[i])
+			}
+			for _, j := range []int{2, c.nvar / 2, c.nvar - 1} {
+				if x := ds[j].Data().([]int8)[i]; int(x) != (i+j)%100 {
+					t.Errorf("%s: value %d in row %d, column %d", name, x, i, j)
+				}
+			}
+		}
+	}
+}
+
+// writeTestOldDta returns a dta file in a format before 117 with a
+// byte, int, long, float, double and str5 variable and four
+// observations.  Observation 2 holds values that are missing from
+// version 113 but valid before, and observation 3 holds the missing
+// values of earlier versions.  The byte variable has value labels for
+// 0 and 1.
+func writeTestOldDta(version int, order binary.ByteOrder) []byte {
+
+	var b bytes.Buffer
+	put := func(x interface{}) {
+		binary.Write(&b, order, x)
+	}
+	fixed := func(s string, width int) {
+		buf := make([]byte, width)
+		copy(buf, s)
+		b.Write(buf)
+	}
+
+	const nvar = 6
+	bo := byte(2)
+	if order == binary.BigEndian {
+		bo = 1
+	}
+	b.Write([]byte{byte(version), bo, 1, 0})
+	put(int16(nvar))
+	if version == 102 {
+		put(int16(4))
+	} else {
+		put(int32(4))
+	}
+	if version < 108 {
+		fixed("old", 32)
+	} else {
+		fixed("old", 81)
+	}
+	if version >= 105 {
+		fixed("16 Oct 2026 12:00", 18)
+	}
+
+	if version < 111 {
+		b.WriteString("bilfd")
+		b.WriteByte(127 + 5)
+	} else {
+		b.Write([]byte{251, 252, 253, 254, 255, 5})
+	}
+	nameLen, fmtLen, labelLen := 33, 49, 81
+	switch {
+	case version < 105:
+		nameLen, fmtLen, labelLen = 9, 7, 32
+	case version < 108:
+		nameLen, fmtLen, labelLen = 9, 12, 32
+	case version < 110:
+		nameLen, fmtLen = 9, 12
+	case version < 114:
+		fmtLen = 12
+	}
+	for j := 0; j < nvar; j++ {
+		fixed(fmt.Sprintf("v%d", j), nameLen)
+	}
+	b.Write(make([]byte, 2*(nvar+1)))
+	for j := 0; j < nvar; j++ {
+		fixed("%9.0g", fmtLen)
+	}
+	fixed("lab", nameLen)
+	for j := 1; j < nvar; j++ {
+		fixed("", nameLen)
+	}
+	for j := 0; j < nvar; j++ {
+		fixed(fmt.Sprintf("Variable %d", j), labelLen)
+	}
+	switch {
+	case version >= 110:
+		put(byte(0))
+		put(int32(0))
+	case version >= 105:
+		put(byte(0))
+		put(int16(0))
+	}
+
+	for i := 0; i < 2; i++ {
+		put(int8(i))
+		put(int16(100 * i))
+		put(int32(10000 * i))
+		put(float32(i) + 0.5)
+		put(float64(i) + 0.25)
+		fixed(fmt.Sprintf("s %d", i), 5)
+	}
+	put(int8(110))
+	put(int16(32750))
+	put(int32(2147483630))
+	put(float32(2))
+	put(float64(2))
+	fixed("s 2", 5)
+	put(int8(127))
+	put(int16(32767))
+	put(int32(2147483647))
+	put(math.Float32frombits(0x7f000000))
+	put(math.Float64frombits(0x7fe0000000000000))
+	fixed("", 5)
+
+	if version < 108 {
+		put(int16(2))
+		fixed("lab", nameLen+1)
+		put([]int16{0, 1})
+		fixed("zero", 8)
+		fixed("one", 8)
+	} else {
+		put(int32(8 + 2*8 + 9))
+		fixed("lab", nameLen+3)
+		put([]int32{2, 9, 0, 5, 0, 1})
+		b.WriteString("zero\x00one\x00")
+	}
+
+	return b.Bytes()
+}
+
+func TestStataOld(t *testing.T) {
+
+	for _, version := range []int{102, 103, 104, 105, 108, 110, 111, 112, 113, 114, 115} {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			name := fmt.Sprintf("%d/%v", version, order)
+			stata, err := NewStataReader(bytes.NewReader(writeTestOldDta(version, order)))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if stata.FormatVersion != version || stata.Nvar != 6 || stata.RowCount() != 4 {
+				t.Fatalf("%s: version %d with %d variables and %d rows", name, stata.FormatVersion, stata.Nvar, stata.RowCount())
+			}
+			if stata.DatasetLabel != "old" || stata.ColumnNames()[5] != "v5" || stata.ColumnNamesLong[5] != "Variable 5" || stata.Formats[5] != "%9.0g" {
+				t.Errorf("%s: label %q, name %q, long name %q, format %q", name, stata.DatasetLabel,
+					stata.ColumnNames()[5], stata.ColumnNamesLong[5], stata.Formats[5])
+			}
+			types := []ColumnTypeT{StataInt8Type, StataInt16Type, StataInt32Type, StataFloat32Type, StataFloat64Type, 5}
+			for j, ct := range stata.ColumnTypes() {
+				if ct != types[j] {
+					t.Errorf("%s: variable %d has type %d", name, j, ct)
+				}
+			}
+
+			ds, err := stata.Read(-1)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			x, _, err := ds[2].UpcastNumeric().AsFloat64Slice()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x[1] != 10000 || ds[3].Data().([]float32)[1] != 1.5 || ds[4].Data().([]float64)[1] != 1.25 {
+				t.Errorf("%s: row 1 has values %v, %v, %v", name, x[1], ds[3].Data().([]float32)[1], ds[4].Data().([]float64)[1])
+			}
+			if s := ds[5].Data().([]string); s[1] != "s 1" || s[2] != "s 2" {
+				t.Errorf("%s: strings %q", name, s)
+			}
+			if s := ds[0].Data().([]string); s[0] != "zero" || s[1] != "one" || len(stata.ValueLabels["lab"]) != 2 {
+				t.Errorf("%s: labels %q", name, s)
+			}
+			for j := 0; j < 5; j++ {
+				miss := ds[j].Missing()
+				high := j < 3 && version >= 113
+				if miss == nil || miss[0] || miss[1] || miss[2] != high || !miss[3] {
+					t.Errorf("%s: variable %d has missing values %v", name, j, miss)
+				}
+			}
+		}
+	}
+}
+
+func TestStataMissingCodes(t *testing.T) {
+
+	// Each variable holds the missing values ., .a, ..., .z
+	checkCodes := func(name string, ds []*Series) {
+		for _, s := range ds {
+			codes := s.MissingCodes()
+			if s.Length() != 27 || codes == nil {
+				t.Fatalf("%s: %s has %d values and codes %v", name, s.Name, s.Length(), codes)
+			}
+			for i, m := range s.Missing() {
+				expected := byte(0)
+				if i > 0 {
+					expected = byte('a' + i - 1)
+				}
+				if !m || codes[i] != expected {
+					t.Errorf("%s: %s has missing code %q in row %d", name, s.Name, codes[i], i)
+				}
+			}
+		}
+	}
+
+	for _, fname := range []string{"stata8_115.dta", "stata8_117.dta"} {
+		f, err := os.Open(filepath.Join("test_files", "data", fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		stata, err := NewStataReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds, err := stata.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCodes(fname, ds)
+
+		// The codes are kept by the writer
+		var buf bytes.Buffer
+		if err := NewStataWriter(&buf).Write(ds); err != nil {
+			t.Fatal(err)
+		}
+		stata, err = NewStataReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds, err = stata.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCodes(fname+"/written", ds)
+	}
+
+	// Value labels of extended missing values
+	x, _ := NewSeries("x", []int8{1, 0, 0, 2}, []bool{false, true, true, false})
+	x.missingCodes = []byte{0, 'a', 0, 0}
+	var buf bytes.Buffer
+	sw := NewStataWriter(&buf)
+	sw.ValueLabelNames = []string{"answer"}
+	sw.ValueLabels = map[string]map[int32]string{"answer": {1: "yes", 2147483622: "not applicable"}}
+	if err := sw.Write([]*Series{x}); err != nil {
+		t.Fatal(err)
+	}
+	stata, err := NewStataReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := stata.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := ds[0].Data().([]string)
+	miss := ds[0].Missing()
+	codes := ds[0].MissingCodes()
+	if labels[0] != "yes" || labels[1] != "not applicable" || labels[3] != "2" || !miss[1] || !miss[2] || miss[3] {
+		t.Errorf("labels %q, missing %v", labels, miss)
+	}
+	if codes[1] != 'a' || codes[2] != 0 {
+		t.Errorf("missing codes %q", codes)
+	}
+}
+
+func FuzzStata(f *testing.F) {
+
+	fnames, err := filepath.Glob(filepath.Join("test_files", "data", "*.dta"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fname := range fnames {
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		stata, err := NewStataReaderWithLimits(bytes.NewReader(b), &ReadLimits{MaxAlloc: 1 << 24})
+		if err != nil {
+			return
+		}
+		for {
+			ds, err := stata.Read(1000)
+			if err != nil || len(ds) == 0 || ds[0].Length() == 0 {
+				return
+			}
+		}
+	})
+}
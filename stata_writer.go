@@ -0,0 +1,711 @@
+package datareader
+
+// Write Stata dta files with go.
+//
+// The files are written in the xml-like layout of dta formats 117 and
+// 118, described at http://www.stata.com/help.cgi?dta.  As the
+// variable types are chosen from the data, all of the data are
+// written in a single call to Write.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// StataWriter writes data to a file in Stata dta format.  The
+// configuration fields must be set before calling Write.
+type StataWriter struct {
+
+	// The format version of the file, 117 (Stata 13) or 118 (Stata
+	// 14 and later), 118 if zero
+	FormatVersion int
+
+	// The byte order of the file, little endian if nil
+	ByteOrder binary.ByteOrder
+
+	// A short text label for the data set, at most 80 characters
+	DatasetLabel string
+
+	// The time stamp stored in the file, the current time if zero
+	TimeStamp time.Time
+
+	// The variable labels, at most 80 characters, in the order of
+	// the Series passed to Write.  May be nil.
+	ColumnNamesLong []string
+
+	// The display formats of the variables, in the order of the
+	// Series passed to Write.  May be nil, and an empty format is
+	// replaced by a default format for the type of the variable.
+	Formats []string
+
+	// The name of the value label set of each variable, in the
+	// order of the Series passed to Write, and the value label sets
+	// by name.  The extended missing values .a to .z are labeled
+	// with the keys 2147483622 to 2147483647.  May be nil.
+	ValueLabelNames []string
+	ValueLabels     map[string]map[int32]string
+
+	w       io.Writer
+	written bool
+}
+
+// The ranges of non-missing values that can be stored in the numeric
+// types.
+const (
+	stataMaxInt8    = 100
+	stataMaxInt16   = 32740
+	stataMaxInt32   = 2147483620
+	stataMaxFloat32 = 1.701e38
+	stataMaxFloat64 = 8.988e307
+
+	// The longest str# variable, longer strings are written as
+	// strLs
+	stataMaxStrLength = 2045
+)
+
+// stataColumn holds the values of a variable to be written.
+type stataColumn struct {
+	name   string
+	vtype  ColumnTypeT
+	format string
+
+	// The values of a numeric variable, the missing values, and
+	// the codes of the extended missing values (may be nil)
+	num   []float64
+	miss  []bool
+	codes []byte
+
+	// The values of a string variable, and the strL references
+	str  []string
+	refs []uint64
+}
+
+// NewStataWriter returns a writer that writes data to w in Stata dta
+// format.
+func NewStataWriter(w io.Writer) *StataWriter {
+	return &StataWriter{w: w}
+}
+
+func (sw *StataWriter) byteOrder() binary.ByteOrder {
+	if sw.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return sw.ByteOrder
+}
+
+// stataValidName returns an error if name is not a valid Stata
+// variable or value label name.  Names in version 117 files must be
+// ASCII.
+func stataValidName(kind, name string, version int) error {
+
+	if name == "" || utf8.RuneCountInString(name) > 32 {
+		return fmt.Errorf("%s name %q must have between 1 and 32 characters", kind, name)
+	}
+	for i, c := range name {
+		if c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		if version >= 118 && unicode.IsLetter(c) {
+			continue
+		}
+		return fmt.Errorf("%s name %q must contain only letters, digits and underscores, and not start with a digit", kind, name)
+	}
+	return nil
+}
+
+// stataCheckText returns an error if the text s is longer than 80
+// characters, or does not fit in a field of the given width.
+func stataCheckText(kind, s string, width int) error {
+	if utf8.RuneCountInString(s) > 80 {
+		return fmt.Errorf("%s %q is longer than 80 characters", kind, s)
+	}
+	if len(s) >= width {
+		return fmt.Errorf("%s %q is longer than %d bytes", kind, s, width-1)
+	}
+	return nil
+}
+
+// Write writes the data as a complete dta file, with one variable
+// for each Series, named by the Series name.  Write can only be
+// called once.
+//
+// Numeric Series are stored in the smallest of the Stata types byte,
+// int, long, float and double that holds all of their values exactly.
+// NaN values are written as missing values, and the codes 'a' to 'z'
+// from MissingCodes as the extended missing values .a to .z.
+// time.Time values are written as dates (%td) if they are all at
+// midnight UTC, and as datetimes (%tc) otherwise, unless a format is
+// given.  String Series are stored as str# if no value is longer than
+// 2045 bytes, and as strL otherwise.
+func (sw *StataWriter) Write(data []*Series) error {
+
+	if sw.written {
+		return fmt.Errorf("Write can only be called once on a StataWriter")
+	}
+	sw.written = true
+
+	version := sw.FormatVersion
+	if version == 0 {
+		version = 118
+	}
+	if version != 117 && version != 118 {
+		return fmt.Errorf("cannot write dta format version %d, only 117 and 118 are supported", version)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("no variables to write")
+	}
+	if len(data) > 32767 {
+		return fmt.Errorf("%d variables, a dta file can hold at most 32767", len(data))
+	}
+	for _, x := range []struct {
+		kind string
+		v    []string
+	}{{"variable labels", sw.ColumnNamesLong}, {"formats", sw.Formats}, {"value label names", sw.ValueLabelNames}} {
+		if x.v != nil && len(x.v) != len(data) {
+			return fmt.Errorf("%d %s for %d variables", len(x.v), x.kind, len(data))
+		}
+	}
+
+	nameLen, fmtLen, labelLen := 129, 57, 321
+	if version == 117 {
+		nameLen, fmtLen, labelLen = 33, 49, 81
+	}
+	if err := stataCheckText("dataset label", sw.DatasetLabel, 4*80+1); err != nil {
+		return err
+	}
+	if version == 117 && len(sw.DatasetLabel) > 80 {
+		return fmt.Errorf("dataset label %q is longer than 80 bytes", sw.DatasetLabel)
+	}
+
+	nrow := data[0].Length()
+	if version == 117 && nrow > math.MaxInt32 {
+		return fmt.Errorf("%d rows, a version 117 file can hold at most %d", nrow, math.MaxInt32)
+	}
+
+	// Prepare the values of each variable
+	names := make(map[string]bool)
+	cols := make([]*stataColumn, len(data))
+	var rowLength int
+	for j, s := range data {
+		if err := stataValidName("variable", s.Name, version); err != nil {
+			return fmt.Errorf("variable %d: %v", j, err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("variable %d: duplicate name %q", j, s.Name)
+		}
+		names[s.Name] = true
+		if s.Length() != nrow {
+			return fmt.Errorf("variable %s has length %d, expected %d", s.Name, s.Length(), nrow)
+		}
+		if sw.ColumnNamesLong != nil {
+			if err := stataCheckText("variable label", sw.ColumnNamesLong[j], labelLen); err != nil {
+				return fmt.Errorf("variable %s: %v", s.Name, err)
+			}
+		}
+
+		var format string
+		if sw.Formats != nil {
+			format = sw.Formats[j]
+			if len(format) >= fmtLen {
+				return fmt.Errorf("variable %s: format %q is longer than %d bytes", s.Name, format, fmtLen-1)
+			}
+		}
+		c, err := stataColumnValues(s, format)
+		if err != nil {
+			return err
+		}
+		cols[j] = c
+
+		if sw.ValueLabelNames != nil && sw.ValueLabelNames[j] != "" {
+			if c.num == nil {
+				return fmt.Errorf("variable %s: value labels can only be attached to numeric variables", s.Name)
+			}
+			if err := stataValidName("value label", sw.ValueLabelNames[j], version); err != nil {
+				return fmt.Errorf("variable %s: %v", s.Name, err)
+			}
+		}
+
+		switch t := c.vtype; {
+		case t <= stataMaxStrLength:
+			rowLength += int(t)
+		case t == StataStrlType, t == StataFloat64Type:
+			rowLength += 8
+		case t == StataFloat32Type, t == StataInt32Type:
+			rowLength += 4
+		case t == StataInt16Type:
+			rowLength += 2
+		default:
+			rowLength++
+		}
+	}
+
+	strls := sw.strls(cols, version)
+	labels, err := sw.valueLabels(version, nameLen)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	put := func(width int, x uint64) {
+		buf := make([]byte, 8)
+		if sw.byteOrder() == binary.BigEndian {
+			binary.BigEndian.PutUint64(buf, x)
+			b.Write(buf[8-width:])
+		} else {
+			binary.LittleEndian.PutUint64(buf, x)
+			b.Write(buf[:width])
+		}
+	}
+	fixed := func(s string, width int) {
+		buf := make([]byte, width)
+		copy(buf, s)
+		b.Write(buf)
+	}
+
+	// Header
+	bo := "LSF"
+	if sw.byteOrder() == binary.BigEndian {
+		bo = "MSF"
+	}
+	b.WriteString(fmt.Sprintf("<stata_dta><header><release>%d</release><byteorder>%s</byteorder><K>", version, bo))
+	put(nvarLength[version], uint64(len(data)))
+	b.WriteString("</K><N>")
+	put(rowCountLength[version], uint64(nrow))
+	b.WriteString("</N><label>")
+	put(datasetLabelLength[version], uint64(len(sw.DatasetLabel)))
+	b.WriteString(sw.DatasetLabel)
+	b.WriteString("</label><timestamp>")
+	ts := sw.TimeStamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	stamp := ts.Format("02 Jan 2006 15:04")
+	put(1, uint64(len(stamp)))
+	b.WriteString(stamp)
+	b.WriteString("</timestamp></header>")
+
+	// The map is filled in once the positions are known
+	b.WriteString("<map>")
+	mapPos := b.Len()
+	b.Write(make([]byte, 14*8))
+	b.WriteString("</map>")
+	seek := []int{0, mapPos - len("<map>")}
+	section := func(name string) {
+		seek = append(seek, b.Len())
+		b.WriteString("<" + name + ">")
+	}
+
+	section("variable_types")
+	for _, c := range cols {
+		put(2, uint64(c.vtype))
+	}
+	b.WriteString("</variable_types>")
+	section("varnames")
+	for _, c := range cols {
+		fixed(c.name, nameLen)
+	}
+	b.WriteString("</varnames>")
+	section("sortlist")
+	b.Write(make([]byte, 2*(len(cols)+1)))
+	b.WriteString("</sortlist>")
+	section("formats")
+	for _, c := range cols {
+		fixed(c.format, fmtLen)
+	}
+	b.WriteString("</formats>")
+	section("value_label_names")
+	for j := range cols {
+		var name string
+		if sw.ValueLabelNames != nil {
+			name = sw.ValueLabelNames[j]
+		}
+		fixed(name, nameLen)
+	}
+	b.WriteString("</value_label_names>")
+	section("variable_labels")
+	for j := range cols {
+		var label string
+		if sw.ColumnNamesLong != nil {
+			label = sw.ColumnNamesLong[j]
+		}
+		fixed(label, labelLen)
+	}
+	b.WriteString("</variable_labels>")
+	section("characteristics")
+	b.WriteString("</characteristics>")
+	section("data")
+
+	// The positions of the sections after the data
+	pos := b.Len() + nrow*rowLength + len("</data>")
+	seek = append(seek, pos)
+	pos += len(strls)
+	seek = append(seek, pos)
+	pos += len(labels)
+	seek = append(seek, pos)
+	pos += len("</stata_dta>")
+	seek = append(seek, pos)
+
+	meta := b.Bytes()
+	for k, x := range seek {
+		sw.byteOrder().PutUint64(meta[mapPos+8*k:], uint64(x))
+	}
+
+	bw := bufio.NewWriter(sw.w)
+	if _, err := bw.Write(meta); err != nil {
+		return err
+	}
+	row := make([]byte, rowLength)
+	for i := 0; i < nrow; i++ {
+		sw.putRow(row, cols, i)
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("</data>")
+	bw.Write(strls)
+	bw.Write(labels)
+	bw.WriteString("</stata_dta>")
+
+	return bw.Flush()
+}
+
+// missingOffset returns the offset from the system missing value of
+// the missing value in row i, which is k for the k'th extended missing
+// value.  The SAS special missing values .A to .Z are written as .a to
+// .z.
+func (c *stataColumn) missingOffset(i int) int {
+
+	if c.codes == nil {
+		return 0
+	}
+	switch code := c.codes[i]; {
+	case code >= 'a' && code <= 'z':
+		return int(code-'a') + 1
+	case code >= 'A' && code <= 'Z':
+		return int(code-'A') + 1
+	}
+	return 0
+}
+
+// putRow stores row i of the data in row.
+func (sw *StataWriter) putRow(row []byte, cols []*stataColumn, i int) {
+
+	bo := sw.byteOrder()
+	var pos int
+	for _, c := range cols {
+		var k int
+		if c.miss[i] {
+			k = c.missingOffset(i)
+		}
+		switch t := c.vtype; {
+		case t <= stataMaxStrLength:
+			b := row[pos : pos+int(t)]
+			var n int
+			if !c.miss[i] {
+				n = copy(b, c.str[i])
+			}
+			for k := n; k < len(b); k++ {
+				b[k] = 0
+			}
+			pos += int(t)
+		case t == StataStrlType:
+			bo.PutUint64(row[pos:], c.refs[i])
+			pos += 8
+		case t == StataFloat64Type:
+			x := math.Float64bits(c.num[i])
+			if c.miss[i] {
+				x = stataMissingFloat64 + uint64(k)<<40
+			}
+			bo.PutUint64(row[pos:], x)
+			pos += 8
+		case t == StataFloat32Type:
+			x := math.Float32bits(float32(c.num[i]))
+			if c.miss[i] {
+				x = stataMissingFloat32 + uint32(k)<<11
+			}
+			bo.PutUint32(row[pos:], x)
+			pos += 4
+		case t == StataInt32Type:
+			x := int32(c.num[i])
+			if c.miss[i] {
+				x = stataMissingInt32 + int32(k)
+			}
+			bo.PutUint32(row[pos:], uint32(x))
+			pos += 4
+		case t == StataInt16Type:
+			x := int16(c.num[i])
+			if c.miss[i] {
+				x = stataMissingInt16 + int16(k)
+			}
+			bo.PutUint16(row[pos:], uint16(x))
+			pos += 2
+		default:
+			x := int8(c.num[i])
+			if c.miss[i] {
+				x = stataMissingInt8 + int8(k)
+			}
+			row[pos] = byte(x)
+			pos++
+		}
+	}
+}
+
+// stataColumnValues returns the values of Series s, with the Stata
+// type that holds them and the given format, or the default format
+// for the type if format is empty.
+func stataColumnValues(s *Series, format string) (*stataColumn, error) {
+
+	c := &stataColumn{name: s.Name, format: format}
+	n := s.Length()
+
+	var str []string
+	switch v := s.Data().(type) {
+	case []string:
+		str = v
+	case [][]byte:
+		str = make([]string, n)
+		for i := range v {
+			str[i] = string(v[i])
+		}
+	case []float64, []float32, []int64, []int32, []int16, []int8:
+		c.num = s.UpcastNumeric().Data().([]float64)
+		if x, ok := v.([]int64); ok {
+			for i := range x {
+				if x[i] > 1<<53 || x[i] < -(1<<53) {
+					return nil, fmt.Errorf("variable %s: value %d in row %d cannot be stored exactly", s.Name, x[i], i)
+				}
+			}
+		}
+	case []time.Time:
+		days := true
+		if format == "" {
+			for _, t := range v {
+				if !t.Equal(t.UTC().Truncate(24 * time.Hour)) {
+					days = false
+					break
+				}
+			}
+			c.format = "%td"
+			if !days {
+				c.format = "%tc"
+			}
+		} else if strings.HasPrefix(format, "%tc") {
+			days = false
+		} else if !strings.HasPrefix(format, "%td") {
+			return nil, fmt.Errorf("variable %s: cannot write time values with format %q", s.Name, format)
+		}
+		// The times are found from their seconds since the Unix
+		// epoch, as a time.Duration only spans about 292 years
+		bt := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+		c.num = make([]float64, n)
+		for i, t := range v {
+			secs := t.Unix() - bt
+			if days {
+				c.num[i] = math.Floor(float64(secs) / 86400)
+			} else {
+				c.num[i] = float64(1000*secs + int64(t.Nanosecond()/1e6))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("variable %s: cannot write %T values", s.Name, v)
+	}
+
+	c.miss = make([]bool, n)
+	if m := s.Missing(); m != nil {
+		copy(c.miss, m)
+	}
+	c.codes = s.MissingCodes()
+
+	if str != nil {
+		c.str = str
+		var width int
+		for i := range str {
+			if !c.miss[i] && len(str[i]) > width {
+				width = len(str[i])
+			}
+		}
+		switch {
+		case width > stataMaxStrLength:
+			c.vtype = StataStrlType
+			if c.format == "" {
+				c.format = "%9s"
+			}
+		default:
+			if width == 0 {
+				width = 1
+			}
+			c.vtype = ColumnTypeT(width)
+			if c.format == "" {
+				c.format = fmt.Sprintf("%%%ds", width)
+			}
+		}
+		return c, nil
+	}
+
+	// Find the smallest type that holds all of the values
+	integer, single := true, true
+	var lo, hi float64
+	for i, x := range c.num {
+		if math.IsNaN(x) {
+			c.miss[i] = true
+		}
+		if c.miss[i] {
+			continue
+		}
+		if x > stataMaxFloat64 || math.IsInf(x, -1) {
+			return nil, fmt.Errorf("variable %s: value %v in row %d cannot be stored", s.Name, x, i)
+		}
+		if x != math.Trunc(x) {
+			integer = false
+		}
+		if float64(float32(x)) != x || math.Abs(x) > stataMaxFloat32 {
+			single = false
+		}
+		lo = math.Min(lo, x)
+		hi = math.Max(hi, x)
+	}
+
+	defaultFormat := "%8.0g"
+	switch {
+	case integer && lo >= -127 && hi <= stataMaxInt8:
+		c.vtype = StataInt8Type
+	case integer && lo >= -32767 && hi <= stataMaxInt16:
+		c.vtype = StataInt16Type
+	case integer && lo >= -2147483647 && hi <= stataMaxInt32:
+		c.vtype = StataInt32Type
+		defaultFormat = "%12.0g"
+	case single:
+		c.vtype = StataFloat32Type
+		defaultFormat = "%9.0g"
+	default:
+		c.vtype = StataFloat64Type
+		defaultFormat = "%10.0g"
+	}
+	if c.format == "" {
+		c.format = defaultFormat
+	}
+
+	return c, nil
+}
+
+// strls returns the strls section for the strL variables in cols,
+// and sets the references to the strLs in the data.  Identical values
+// of a variable are stored once.
+func (sw *StataWriter) strls(cols []*stataColumn, version int) []byte {
+
+	var b bytes.Buffer
+	b.WriteString("<strls>")
+
+	bo := sw.byteOrder()
+	n := uint(strlVarLength[version])
+	buf := make([]byte, 8)
+	for j, c := range cols {
+		if c.vtype != StataStrlType {
+			continue
+		}
+		c.refs = make([]uint64, len(c.str))
+		seen := make(map[string]uint64)
+		v := uint64(j + 1)
+		for i, s := range c.str {
+			if c.miss[i] || s == "" {
+				// (0,0) refers to the empty string
+				continue
+			}
+			if ref, ok := seen[s]; ok {
+				c.refs[i] = ref
+				continue
+			}
+			o := uint64(i + 1)
+			if bo == binary.BigEndian {
+				c.refs[i] = v<<(8*(8-n)) | o
+			} else {
+				c.refs[i] = v | o<<(8*n)
+			}
+			seen[s] = c.refs[i]
+
+			b.WriteString("GSO")
+			bo.PutUint32(buf, uint32(v))
+			b.Write(buf[0:4])
+			if version == 117 {
+				bo.PutUint32(buf, uint32(o))
+				b.Write(buf[0:4])
+			} else {
+				bo.PutUint64(buf, o)
+				b.Write(buf[0:8])
+			}
+			b.WriteByte(130)
+			bo.PutUint32(buf, uint32(len(s)+1))
+			b.Write(buf[0:4])
+			b.WriteString(s)
+			b.WriteByte(0)
+		}
+	}
+
+	b.WriteString("</strls>")
+	return b.Bytes()
+}
+
+// valueLabels returns the value_labels section, with the value label
+// sets in order of their names.
+func (sw *StataWriter) valueLabels(version, nameLen int) ([]byte, error) {
+
+	var names []string
+	for name := range sw.ValueLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	bo := sw.byteOrder()
+	put := func(x int) {
+		binary.Write(&b, bo, int32(x))
+	}
+	b.WriteString("<value_labels>")
+	for _, name := range names {
+		if err := stataValidName("value label", name, version); err != nil {
+			return nil, err
+		}
+		labels := sw.ValueLabels[name]
+		values := make([]int, 0, len(labels))
+		for v := range labels {
+			values = append(values, int(v))
+		}
+		sort.Ints(values)
+
+		var text bytes.Buffer
+		off := make([]int, len(values))
+		for k, v := range values {
+			off[k] = text.Len()
+			text.WriteString(labels[int32(v)])
+			text.WriteByte(0)
+		}
+
+		b.WriteString("<lbl>")
+		put(8 + 8*len(values) + text.Len())
+		buf := make([]byte, nameLen+3)
+		copy(buf, name)
+		b.Write(buf)
+		put(len(values))
+		put(text.Len())
+		for _, x := range off {
+			put(x)
+		}
+		for _, v := range values {
+			put(v)
+		}
+		b.Write(text.Bytes())
+		b.WriteString("</lbl>")
+	}
+	b.WriteString("</value_labels>")
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,287 @@
+package datareader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStataWriter(t *testing.T) {
+
+	const n = 23
+	bytev := make([]float64, n)
+	intv := make([]int64, n)
+	longv := make([]int32, n)
+	floatv := make([]float64, n)
+	doublev := make([]float64, n)
+	strs := make([]string, n)
+	longStrs := make([]string, n)
+	dates := make([]time.Time, n)
+	miss := make([]bool, n)
+	base := time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		bytev[i] = float64(i%5 - 2)
+		intv[i] = int64(1000 * i)
+		longv[i] = int32(100000 * i)
+		floatv[i] = float64(i) + 0.5
+		doublev[i] = float64(i) + 0.1
+		strs[i] = fmt.Sprintf("row %d", i)
+		longStrs[i] = strings.Repeat(fmt.Sprintf("%d", i%3), 3000)
+		dates[i] = base.AddDate(0, 0, i)
+		miss[i] = i%4 == 1
+	}
+	doublev[5] = math.NaN()
+	longStrs[7] = ""
+
+	series := func(name string, x interface{}, m []bool) *Series {
+		s, err := NewSeries(name, x, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	data := []*Series{
+		series("b", bytev, miss),
+		series("i", intv, nil),
+		series("l", longv, miss),
+		series("f", floatv, nil),
+		series("d", doublev, nil),
+		series("s", strs, miss),
+		series("strl", longStrs, nil),
+		series("date", dates, nil),
+	}
+	types := []ColumnTypeT{StataInt8Type, StataInt16Type, StataInt32Type, StataFloat32Type, StataFloat64Type,
+		6, StataStrlType, StataInt16Type}
+
+	for _, version := range []int{117, 118} {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			name := fmt.Sprintf("%d/%v", version, order)
+			var buf bytes.Buffer
+			sw := NewStataWriter(&buf)
+			sw.FormatVersion = version
+			sw.ByteOrder = order
+			sw.DatasetLabel = "Written by datareader"
+			sw.TimeStamp = time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+			sw.ColumnNamesLong = []string{"A byte", "", "", "", "", "Strings", "", ""}
+			sw.ValueLabelNames = []string{"sign", "", "", "", "", "", "", ""}
+			sw.ValueLabels = map[string]map[int32]string{"sign": {-2: "neg", 0: "zero", 2: "pos"}, "unused": {1: "one"}}
+			if err := sw.Write(data); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if err := sw.Write(data); err == nil {
+				t.Errorf("%s: no error writing twice", name)
+			}
+
+			rdr, err := NewStataReader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			rdr.InsertStrls = true
+			rdr.InsertCategoryLabels = false
+			if rdr.FormatVersion != version || rdr.ByteOrder != order || rdr.RowCount() != n {
+				t.Fatalf("%s: read version %d, %v, %d rows", name, rdr.FormatVersion, rdr.ByteOrder, rdr.RowCount())
+			}
+			if rdr.DatasetLabel != sw.DatasetLabel || rdr.TimeStamp != "16 Oct 2026 09:30" {
+				t.Errorf("%s: label %q, time stamp %q", name, rdr.DatasetLabel, rdr.TimeStamp)
+			}
+			for j, ct := range rdr.ColumnTypes() {
+				if ct != types[j] {
+					t.Errorf("%s: variable %d has type %d, expected %d", name, j, ct, types[j])
+				}
+				if rdr.ColumnNames()[j] != data[j].Name || rdr.ColumnNamesLong[j] != sw.ColumnNamesLong[j] {
+					t.Errorf("%s: variable %d is %q, %q", name, j, rdr.ColumnNames()[j], rdr.ColumnNamesLong[j])
+				}
+			}
+			if rdr.Formats[5] != "%6s" || rdr.Formats[7] != "%td" || rdr.ValueLabelNames[0] != "sign" {
+				t.Errorf("%s: formats %v, value label names %v", name, rdr.Formats, rdr.ValueLabelNames)
+			}
+			if len(rdr.ValueLabels) != 2 || rdr.ValueLabels["sign"][-2] != "neg" || rdr.ValueLabels["unused"][1] != "one" {
+				t.Errorf("%s: value labels %v", name, rdr.ValueLabels)
+			}
+
+			ds, err := rdr.Read(-1)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			for j := range data {
+				expected := data[j]
+				switch j {
+				case 4:
+					m := make([]bool, n)
+					m[5] = true
+					expected = series("d", doublev, m)
+				case 5:
+					s := make([]string, n)
+					for i := range s {
+						if !miss[i] {
+							s[i] = strs[i]
+						}
+					}
+					expected = series("s", s, nil)
+				}
+				if ok, i := ds[j].UpcastNumeric().AllEqual(expected.UpcastNumeric()); !ok {
+					t.Errorf("%s: variable %s differs at row %d", name, data[j].Name, i)
+				}
+			}
+		}
+	}
+}
+
+// TestStataWriterRoundTrip writes the data read from each dta test
+// file, and checks that the same data are read back.
+func TestStataWriterRoundTrip(t *testing.T) {
+
+	fnames, err := filepath.Glob(filepath.Join("test_files", "data", "*.dta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fname := range fnames {
+		f, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		rdr, err := NewStataReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr.InsertStrls = true
+		rdr.InsertCategoryLabels = false
+		rdr.ConvertDates = false
+		all, err := rdr.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+		sw := NewStataWriter(&buf)
+		sw.DatasetLabel = rdr.DatasetLabel
+		sw.ColumnNamesLong = rdr.ColumnNamesLong
+		sw.Formats = rdr.Formats
+		sw.ValueLabelNames = rdr.ValueLabelNames
+		sw.ValueLabels = rdr.ValueLabels
+		if err := sw.Write(all); err != nil {
+			t.Fatalf("%s: %v", fname, err)
+		}
+
+		rdr2, err := NewStataReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", fname, err)
+		}
+		rdr2.InsertStrls = true
+		rdr2.InsertCategoryLabels = false
+		rdr2.ConvertDates = false
+		ds, err := rdr2.Read(-1)
+		if err != nil {
+			t.Fatalf("%s: %v", fname, err)
+		}
+		for j := range all {
+			if ok, i := ds[j].UpcastNumeric().AllEqual(all[j].UpcastNumeric()); !ok {
+				t.Errorf("%s: variable %s differs at row %d", fname, all[j].Name, i)
+			}
+		}
+		if len(rdr2.ValueLabels) != len(rdr.ValueLabels) {
+			t.Errorf("%s: %d value label sets, expected %d", fname, len(rdr2.ValueLabels), len(rdr.ValueLabels))
+		}
+	}
+}
+
+// TestStataWriterDates writes dates and datetimes outside of the range
+// of a time.Duration from 1960.
+func TestStataWriterDates(t *testing.T) {
+
+	dates := []time.Time{
+		time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(1959, 12, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	times := []time.Time{
+		time.Date(1600, 1, 1, 12, 30, 15, 250e6, time.UTC),
+		time.Date(1959, 12, 31, 23, 59, 59, 500e6, time.UTC),
+		time.Date(2300, 1, 1, 6, 0, 0, 0, time.UTC),
+	}
+	d, _ := NewSeries("d", dates, nil)
+	tm, _ := NewSeries("t", times, nil)
+
+	var buf bytes.Buffer
+	if err := NewStataWriter(&buf).Write([]*Series{d, tm}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, convert := range []bool{true, false} {
+		rdr, err := NewStataReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr.ConvertDates = convert
+		ds, err := rdr.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rdr.Formats[0] != "%td" || rdr.Formats[1] != "%tc" {
+			t.Errorf("formats %v", rdr.Formats)
+		}
+		if !convert {
+			x := ds[0].UpcastNumeric().Data().([]float64)
+			y := ds[1].UpcastNumeric().Data().([]float64)
+			if x[0] != -131487 || x[1] != -1 || x[2] != 124183 || y[1] != -500 {
+				t.Errorf("dates %v, times %v", x, y)
+			}
+			continue
+		}
+		for j, expected := range [][]time.Time{dates, times} {
+			for i, v := range ds[j].Data().([]time.Time) {
+				if !v.Equal(expected[i]) {
+					t.Errorf("variable %d, row %d: read %v, expected %v", j, i, v, expected[i])
+				}
+			}
+		}
+	}
+}
+
+func TestStataWriterErrors(t *testing.T) {
+
+	x, _ := NewSeries("x", []float64{1, 2}, nil)
+	short, _ := NewSeries("y", []float64{1}, nil)
+	bad, _ := NewSeries("1x", []float64{1, 2}, nil)
+	big, _ := NewSeries("z", []int64{1, 1 << 60}, nil)
+	inf, _ := NewSeries("z", []float64{1, math.Inf(1)}, nil)
+	str, _ := NewSeries("s", []string{"a", "b"}, nil)
+	dur, _ := NewSeries("t", []time.Duration{1, 2}, nil)
+
+	for k, tc := range []struct {
+		data   []*Series
+		config func(sw *StataWriter)
+	}{
+		{nil, nil},
+		{[]*Series{x, short}, nil},
+		{[]*Series{x, x}, nil},
+		{[]*Series{bad}, nil},
+		{[]*Series{big}, nil},
+		{[]*Series{inf}, nil},
+		{[]*Series{dur}, nil},
+		{[]*Series{x}, func(sw *StataWriter) { sw.FormatVersion = 119 }},
+		{[]*Series{x}, func(sw *StataWriter) { sw.DatasetLabel = strings.Repeat("a", 81) }},
+		{[]*Series{x}, func(sw *StataWriter) { sw.ColumnNamesLong = []string{"a", "b"} }},
+		{[]*Series{str}, func(sw *StataWriter) { sw.ValueLabelNames = []string{"lab"} }},
+		{[]*Series{x}, func(sw *StataWriter) { sw.ValueLabels = map[string]map[int32]string{"a b": {1: "one"}} }},
+	} {
+		sw := NewStataWriter(&bytes.Buffer{})
+		if tc.config != nil {
+			tc.config(sw)
+		}
+		if err := sw.Write(tc.data); err == nil {
+			t.Errorf("case %d: no error", k)
+		}
+	}
+}
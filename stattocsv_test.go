@@ -21,6 +21,9 @@ func runStattocsv(filenames []string) map[string][16]byte {
 	for _, file := range filenames {
 		infile := filepath.Join("test_files", "data", file)
 		args := []string{infile}
+		if utf8TestFiles[file] {
+			args = []string{"-encoding", "utf-8", infile}
+		}
 		cmd := exec.Command(cmdName, args...)
 		cmd.Stderr = os.Stderr
 		rslt, err := cmd.Output()
@@ -0,0 +1,772 @@
+package datareader
+
+// Read SAS transport (XPORT) files with go.
+//
+// Both the version 5 format (as used by the XPORT engine and required
+// for FDA submissions) and the version 8 format (which allows long
+// names and labels) are supported.  The format is described in:
+//
+// https://support.sas.com/content/dam/SAS/support/en/technical-papers/record-layout-of-a-sas-version-5-or-6-data-set-in-sas-transport-xport-format.pdf
+// https://support.sas.com/content/dam/SAS/support/en/technical-papers/record-layout-of-a-sas-version-8-or-9-data-set-in-sas-transport-format.pdf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	xencoding "golang.org/x/text/encoding"
+)
+
+// XPORTReader reads a SAS transport (XPORT) file.  A transport file
+// may hold several data sets (members); the first member is read
+// unless another member is chosen with SelectMember.
+type XPORTReader struct {
+
+	// Formats for the columns of the current member
+	ColumnFormats []string
+
+	// If true, trim whitespace from the right of each string
+	// variable (transport string values are right-padded with
+	// spaces)
+	TrimStrings bool
+
+	// If true, converts some date formats to Go date values (does
+	// not work for all SAS date formats)
+	ConvertDates bool
+
+	// The transport format version, 5 or 8
+	Version int
+
+	// The name of the current member
+	Name string
+
+	// The label of the current member
+	Label string
+
+	// The type of the current member, usually empty or "DATA"
+	MemberType string
+
+	// The date the current member was created
+	DateCreated time.Time
+
+	// The date the current member was modified
+	DateModified time.Time
+
+	// The SAS release that created the file
+	SASRelease string
+
+	// The operating system that created the file
+	OSName string
+
+	// If not nil, TextDecoder is used to decode the string
+	// values, which are otherwise returned unchanged
+	TextDecoder *xencoding.Decoder
+
+	file    io.ReadSeeker
+	members []*xportMember
+	member  *xportMember
+
+	// The next row to read from the current member
+	currentRow int
+}
+
+// xportMember describes one data set in a transport file.
+type xportMember struct {
+	name         string
+	label        string
+	memberType   string
+	dateCreated  time.Time
+	dateModified time.Time
+	sasRelease   string
+	osName       string
+	columns      []*xportColumn
+	rowLength    int
+	rowCount     int
+
+	// The position in the file of the first observation
+	dataStart int64
+}
+
+// xportColumn describes one variable of a transport file member.
+type xportColumn struct {
+	name             string
+	label            string
+	format           string
+	formatWidth      int
+	formatDecimals   int
+	informat         string
+	informatWidth    int
+	informatDecimals int
+	ctype            ColumnTypeT
+	length           int
+	position         int
+}
+
+// The length of the records in a transport file.
+const xportRecordLength = 80
+
+// The start of each header record, through the record name
+const xportHeaderPrefix = "HEADER RECORD*******"
+
+// Header record names, padded to 8 characters
+const (
+	xportLibraryV5  = "LIBRARY "
+	xportLibraryV8  = "LIBV8   "
+	xportMemberV5   = "MEMBER  "
+	xportMemberV8   = "MEMBV8  "
+	xportDescV5     = "DSCRPTR "
+	xportDescV8     = "DSCPTV8 "
+	xportNamestrV5  = "NAMESTR "
+	xportNamestrV8  = "NAMSTV8 "
+	xportObsV5      = "OBS     "
+	xportObsV8      = "OBSV8   "
+	xportLabelV8    = "LABELV8 "
+	xportLabelV9    = "LABELV9 "
+	xportNamestrLen = 140
+)
+
+// The format of the date and time values in transport headers
+const xportDateFormat = "02Jan06:15:04:05"
+
+// NewXPORTReader returns a reader for the SAS transport file read
+// from r.  The file is scanned to locate the members, and the reader
+// is positioned at the first row of the first member.
+func NewXPORTReader(r io.ReadSeeker) (*XPORTReader, error) {
+
+	xp := &XPORTReader{file: r}
+
+	if err := xp.scan(); err != nil {
+		return nil, err
+	}
+	if len(xp.members) == 0 {
+		return nil, fmt.Errorf("SAS transport file has no members")
+	}
+	xp.setMember(xp.members[0])
+
+	return xp, nil
+}
+
+// xportHeaderName returns the name of a header record, or an empty
+// string if rec is not a header record.
+func xportHeaderName(rec []byte) string {
+	if len(rec) < xportRecordLength || !bytes.HasPrefix(rec, []byte(xportHeaderPrefix)) {
+		return ""
+	}
+	return string(rec[20:28])
+}
+
+// xportHeaderNumber returns the number at the start of positions
+// first through last-1 of a header record.
+func xportHeaderNumber(rec []byte, first, last int) (int, error) {
+	f := strings.TrimLeft(string(rec[first:last]), " ")
+	if i := strings.IndexFunc(f, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		f = f[0:i]
+	}
+	x, err := strconv.Atoi(f)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number in %s header record", strings.TrimSpace(xportHeaderName(rec)))
+	}
+	return x, nil
+}
+
+// xportTrim removes trailing blanks and null bytes.
+func xportTrim(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00 "))
+}
+
+// xportDate parses a date in a transport header, returning the zero
+// time if it cannot be parsed.
+func xportDate(b []byte) time.Time {
+	t, err := time.Parse(xportDateFormat, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// recordReader reads the 80 byte records of a transport file,
+// tracking the position in the file.
+type recordReader struct {
+	r   *bufio.Reader
+	pos int64
+	rec []byte
+}
+
+// next reads the next record.  At the end of the file, the partial
+// record and io.EOF are returned.
+func (rr *recordReader) next() ([]byte, error) {
+	n, err := io.ReadFull(rr.r, rr.rec)
+	rr.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return rr.rec[0:n], err
+}
+
+// read reads n bytes, rounded up to a whole number of records.
+func (rr *recordReader) read(n int) ([]byte, error) {
+	m := xportRecordLength * ((n + xportRecordLength - 1) / xportRecordLength)
+	b := make([]byte, m)
+	k, err := io.ReadFull(rr.r, b)
+	rr.pos += int64(k)
+	if err != nil {
+		return nil, fmt.Errorf("SAS transport file is truncated")
+	}
+	return b, nil
+}
+
+// expect reads a header record, and checks that it has one of the
+// given names.
+func (rr *recordReader) expect(names ...string) ([]byte, string, error) {
+	rec, err := rr.next()
+	if err != nil && len(rec) == 0 {
+		return nil, "", fmt.Errorf("SAS transport file is truncated")
+	}
+	name := xportHeaderName(rec)
+	for _, n := range names {
+		if name == n {
+			return rec, name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("expected %s header record in SAS transport file", strings.TrimSpace(names[0]))
+}
+
+// scan reads the headers of all the members in the file.
+func (xp *XPORTReader) scan() error {
+
+	if _, err := xp.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	rr := &recordReader{r: bufio.NewReader(xp.file), rec: make([]byte, xportRecordLength)}
+
+	rec, name, err := rr.expect(xportLibraryV5, xportLibraryV8)
+	if err != nil {
+		if bytes.Contains(rr.rec, []byte("COMPRESSED")) {
+			return fmt.Errorf("CPORT files are not supported")
+		}
+		return fmt.Errorf("not a SAS transport file")
+	}
+	xp.Version = 5
+	if name == xportLibraryV8 {
+		xp.Version = 8
+	}
+	memberName := xportMemberV5
+	if xp.Version == 8 {
+		memberName = xportMemberV8
+	}
+
+	// The next record gives the SAS release, operating system and
+	// creation date, and is followed by the modification date.
+	rec, err = rr.next()
+	if err != nil {
+		return fmt.Errorf("SAS transport file is truncated")
+	}
+	if !bytes.HasPrefix(rec, []byte("SAS     ")) {
+		return fmt.Errorf("not a SAS transport file")
+	}
+	xp.SASRelease = xportTrim(rec[24:32])
+	xp.OSName = xportTrim(rec[32:40])
+	if _, err = rr.next(); err != nil {
+		return fmt.Errorf("SAS transport file is truncated")
+	}
+
+	rec, err = rr.next()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for len(rec) > 0 {
+		if xportHeaderName(rec) != memberName {
+			return fmt.Errorf("expected member header record in SAS transport file")
+		}
+		var m *xportMember
+		m, err = xp.scanMember(rr, rec)
+		if err != nil {
+			return err
+		}
+		xp.members = append(xp.members, m)
+
+		// Find the end of the observations, which is either the
+		// end of the file or the next member header.
+		var dataLen int64
+		var last []byte
+		for {
+			rec, err = rr.next()
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if len(rec) == xportRecordLength && xportHeaderName(rec) == memberName &&
+				bytes.HasPrefix(rec[28:], []byte("HEADER RECORD!!!!!!!")) {
+				break
+			}
+			dataLen += int64(len(rec))
+			if len(rec) > 0 {
+				last = append(last[0:0], rec...)
+			}
+			if err == io.EOF {
+				rec = nil
+				break
+			}
+		}
+		m.setRowCount(dataLen, last)
+	}
+
+	return nil
+}
+
+// setRowCount determines the number of rows in a member holding
+// dataLen bytes of observations, ending with the bytes in last.  The
+// observations are padded with blanks to a whole number of records,
+// so any rows of blanks within the padding are not counted.
+func (m *xportMember) setRowCount(dataLen int64, last []byte) {
+
+	if m.rowLength == 0 {
+		return
+	}
+	n := dataLen / int64(m.rowLength)
+	lastStart := dataLen - int64(len(last))
+	for n > 0 {
+		start := (n - 1) * int64(m.rowLength)
+		if start <= dataLen-xportRecordLength || start < lastStart {
+			break
+		}
+		row := last[start-lastStart : start-lastStart+int64(m.rowLength)]
+		if len(bytes.TrimLeft(row, " ")) > 0 {
+			break
+		}
+		n--
+	}
+	m.rowCount = int(n)
+}
+
+// scanMember reads the header records of a member, starting with the
+// member header record in rec, through the observation header.
+func (xp *XPORTReader) scanMember(rr *recordReader, rec []byte) (*xportMember, error) {
+
+	v8 := xp.Version == 8
+	namestrLen, err := xportHeaderNumber(rec, 74, 78)
+	if err != nil {
+		return nil, err
+	}
+	if namestrLen != xportNamestrLen && namestrLen != 136 {
+		return nil, fmt.Errorf("unsupported NAMESTR length %d in SAS transport file", namestrLen)
+	}
+
+	descName := xportDescV5
+	if v8 {
+		descName = xportDescV8
+	}
+	if _, _, err := rr.expect(descName); err != nil {
+		return nil, err
+	}
+
+	m := new(xportMember)
+	rec, err = rr.next()
+	if err != nil {
+		return nil, fmt.Errorf("SAS transport file is truncated")
+	}
+	if v8 {
+		m.name = xportTrim(rec[8:40])
+		m.sasRelease = xportTrim(rec[48:56])
+		m.osName = xportTrim(rec[56:64])
+	} else {
+		m.name = xportTrim(rec[8:16])
+		m.sasRelease = xportTrim(rec[24:32])
+		m.osName = xportTrim(rec[32:40])
+	}
+	m.dateCreated = xportDate(rec[64:80])
+	rec, err = rr.next()
+	if err != nil {
+		return nil, fmt.Errorf("SAS transport file is truncated")
+	}
+	m.dateModified = xportDate(rec[0:16])
+	m.label = xportTrim(rec[32:72])
+	m.memberType = xportTrim(rec[72:80])
+
+	namestrName := xportNamestrV5
+	if v8 {
+		namestrName = xportNamestrV8
+	}
+	rec, _, err = rr.expect(namestrName)
+	if err != nil {
+		return nil, err
+	}
+	ncol, err := xportHeaderNumber(rec, 54, 58)
+	if v8 {
+		ncol, err = xportHeaderNumber(rec, 54, 60)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	namestrs, err := rr.read(ncol * namestrLen)
+	if err != nil {
+		return nil, err
+	}
+	for j := 0; j < ncol; j++ {
+		col, err := xp.parseNamestr(namestrs[j*namestrLen : (j+1)*namestrLen])
+		if err != nil {
+			return nil, err
+		}
+		if end := col.position + col.length; end > m.rowLength {
+			m.rowLength = end
+		}
+		m.columns = append(m.columns, col)
+	}
+
+	// Version 8 files may have long labels, and long format names,
+	// before the observations.
+	obsNames := []string{xportObsV5}
+	if v8 {
+		obsNames = []string{xportObsV8, xportLabelV8, xportLabelV9}
+	}
+	rec, name, err := rr.expect(obsNames...)
+	if err != nil {
+		return nil, err
+	}
+	if name == xportLabelV8 || name == xportLabelV9 {
+		count, err := xportHeaderNumber(rec, 48, 78)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.readLongLabels(rr, count, name == xportLabelV9); err != nil {
+			return nil, err
+		}
+		if _, _, err := rr.expect(xportObsV8); err != nil {
+			return nil, err
+		}
+	}
+	m.dataStart = rr.pos
+
+	return m, nil
+}
+
+// parseNamestr parses a NAMESTR record, which describes one
+// variable.
+func (xp *XPORTReader) parseNamestr(b []byte) (*xportColumn, error) {
+
+	bo := binary.BigEndian
+	col := &xportColumn{
+		ctype:            SASNumericType,
+		length:           int(bo.Uint16(b[4:6])),
+		name:             xportTrim(b[8:16]),
+		label:            xportTrim(b[16:56]),
+		format:           xportTrim(b[56:64]),
+		formatWidth:      int(bo.Uint16(b[64:66])),
+		formatDecimals:   int(bo.Uint16(b[66:68])),
+		informat:         xportTrim(b[72:80]),
+		informatWidth:    int(bo.Uint16(b[80:82])),
+		informatDecimals: int(bo.Uint16(b[82:84])),
+		position:         int(bo.Uint32(b[84:88])),
+	}
+	if bo.Uint16(b[0:2]) == 2 {
+		col.ctype = SASStringType
+	} else if col.length < 2 || col.length > 8 {
+		return nil, fmt.Errorf("invalid length %d for numeric variable %s", col.length, col.name)
+	}
+
+	if xp.Version == 8 && len(b) >= 120 {
+		if name := xportTrim(b[88:120]); name != "" {
+			col.name = name
+		}
+	}
+
+	return col, nil
+}
+
+// readLongLabels reads the LABELV8 or LABELV9 records holding the
+// labels (and for LABELV9, the format and informat names) that do
+// not fit in the NAMESTR records.
+func (m *xportMember) readLongLabels(rr *recordReader, count int, v9 bool) error {
+
+	bo := binary.BigEndian
+	var buf []byte
+	var pos int
+
+	// need returns the next n bytes, reading further records as
+	// needed.
+	need := func(n int) ([]byte, error) {
+		for len(buf)-pos < n {
+			rec, err := rr.next()
+			if len(rec) < xportRecordLength {
+				return nil, fmt.Errorf("SAS transport file is truncated")
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			buf = append(buf, rec...)
+		}
+		pos += n
+		return buf[pos-n : pos], nil
+	}
+
+	nlen := 6
+	if v9 {
+		nlen = 10
+	}
+	for i := 0; i < count; i++ {
+		h, err := need(nlen)
+		if err != nil {
+			return err
+		}
+		varnum := int(bo.Uint16(h[0:2]))
+		lens := []int{int(bo.Uint16(h[2:4])), int(bo.Uint16(h[4:6]))}
+		if v9 {
+			lens = append(lens, int(bo.Uint16(h[6:8])), int(bo.Uint16(h[8:10])))
+		}
+		var vals []string
+		for _, n := range lens {
+			b, err := need(n)
+			if err != nil {
+				return err
+			}
+			vals = append(vals, string(b))
+		}
+		if varnum < 1 || varnum > len(m.columns) {
+			return fmt.Errorf("invalid variable number %d in long label record", varnum)
+		}
+		col := m.columns[varnum-1]
+		col.label = vals[1]
+		if v9 {
+			if vals[2] != "" {
+				col.format = vals[2]
+			}
+			if vals[3] != "" {
+				col.informat = vals[3]
+			}
+		}
+	}
+
+	return nil
+}
+
+// setMember makes m the current member.
+func (xp *XPORTReader) setMember(m *xportMember) {
+
+	xp.member = m
+	xp.currentRow = 0
+	xp.Name = m.name
+	xp.Label = m.label
+	xp.MemberType = m.memberType
+	xp.DateCreated = m.dateCreated
+	xp.DateModified = m.dateModified
+	xp.ColumnFormats = make([]string, len(m.columns))
+	for j, c := range m.columns {
+		xp.ColumnFormats[j] = c.format
+	}
+}
+
+// Members returns the names of the members (data sets) in the file.
+func (xp *XPORTReader) Members() []string {
+	names := make([]string, len(xp.members))
+	for i, m := range xp.members {
+		names[i] = m.name
+	}
+	return names
+}
+
+// SelectMember selects the member with the given name (which is not
+// case sensitive) to be read.  The reader is positioned at the first
+// row of the member.
+func (xp *XPORTReader) SelectMember(name string) error {
+	for _, m := range xp.members {
+		if strings.EqualFold(m.name, name) {
+			xp.setMember(m)
+			return nil
+		}
+	}
+	return fmt.Errorf("member %s not found", name)
+}
+
+// RowCount returns the number of rows in the current member.
+func (xp *XPORTReader) RowCount() int {
+	return xp.member.rowCount
+}
+
+// ColumnNames returns the names of the columns in the current member.
+func (xp *XPORTReader) ColumnNames() []string {
+	names := make([]string, len(xp.member.columns))
+	for j, c := range xp.member.columns {
+		names[j] = c.name
+	}
+	return names
+}
+
+// ColumnLabels returns the column labels of the current member.
+func (xp *XPORTReader) ColumnLabels() []string {
+	labels := make([]string, len(xp.member.columns))
+	for j, c := range xp.member.columns {
+		labels[j] = c.label
+	}
+	return labels
+}
+
+// ColumnTypes returns integer codes for the column data types of the
+// current member.
+func (xp *XPORTReader) ColumnTypes() []ColumnTypeT {
+	types := make([]ColumnTypeT, len(xp.member.columns))
+	for j, c := range xp.member.columns {
+		types[j] = c.ctype
+	}
+	return types
+}
+
+// Columns returns the metadata for each column of the current member.
+func (xp *XPORTReader) Columns() []ColumnInfo {
+	info := make([]ColumnInfo, len(xp.member.columns))
+	for j, c := range xp.member.columns {
+		info[j] = ColumnInfo{
+			Index:            j,
+			Name:             c.name,
+			Label:            c.label,
+			Type:             c.ctype,
+			Format:           c.format,
+			FormatWidth:      c.formatWidth,
+			FormatDecimals:   c.formatDecimals,
+			Informat:         c.informat,
+			InformatWidth:    c.informatWidth,
+			InformatDecimals: c.informatDecimals,
+			Offset:           c.position,
+			Length:           c.length,
+		}
+	}
+	return info
+}
+
+// Read returns up to num_rows rows of data from the current member,
+// as an array of Series objects.  The Series data types are either
+// float64 or string (or time.Time and time.Duration for dates and
+// times if ConvertDates is set).  If num_rows is negative, the
+// remainder of the member is read.  Returns (nil, io.EOF) when no
+// rows remain.
+func (xp *XPORTReader) Read(num_rows int) ([]*Series, error) {
+
+	m := xp.member
+	if xp.currentRow >= m.rowCount {
+		return nil, io.EOF
+	}
+	if num_rows < 0 || num_rows > m.rowCount-xp.currentRow {
+		num_rows = m.rowCount - xp.currentRow
+	}
+
+	pos := m.dataStart + int64(xp.currentRow)*int64(m.rowLength)
+	if _, err := xp.file.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, num_rows*m.rowLength)
+	if _, err := io.ReadFull(xp.file, data); err != nil {
+		return nil, fmt.Errorf("SAS transport file is truncated")
+	}
+	xp.currentRow += num_rows
+
+	rslt := make([]*Series, len(m.columns))
+	for j, c := range m.columns {
+
+		miss := make([]bool, num_rows)
+		switch c.ctype {
+		case SASNumericType:
+			vec := make([]float64, num_rows)
+			var codes []byte
+			for i := range vec {
+				b := data[i*m.rowLength+c.position : i*m.rowLength+c.position+c.length]
+				if code, ok := ibmMissing(b); ok {
+					miss[i] = true
+					vec[i] = math.NaN()
+					if code != 0 {
+						if codes == nil {
+							codes = make([]byte, num_rows)
+						}
+						codes[i] = code
+					}
+					continue
+				}
+				vec[i] = ibmToFloat64(b)
+			}
+			var kind SASDateFormatKind
+			if xp.ConvertDates {
+				kind = sasDateFormatKind(c.format)
+			}
+			switch kind {
+			case SASDate:
+				rslt[j], _ = NewSeries(c.name, toDate(vec), miss)
+			case SASDateTime:
+				rslt[j], _ = NewSeries(c.name, toDateTime(vec), miss)
+			case SASTime:
+				rslt[j], _ = NewSeries(c.name, toDuration(vec), miss)
+			default:
+				rslt[j], _ = NewSeries(c.name, vec, miss)
+			}
+			rslt[j].missingCodes = codes
+		case SASStringType:
+			vec := make([]string, num_rows)
+			for i := range vec {
+				b := data[i*m.rowLength+c.position : i*m.rowLength+c.position+c.length]
+				if xp.TrimStrings {
+					b = bytes.TrimRight(b, "\x00 ")
+				}
+				if xp.TextDecoder != nil {
+					var err error
+					b, err = xp.TextDecoder.Bytes(b)
+					if err != nil {
+						return nil, err
+					}
+				}
+				vec[i] = string(b)
+			}
+			rslt[j], _ = NewSeries(c.name, vec, miss)
+		}
+	}
+
+	return rslt, nil
+}
+
+// ibmMissing determines whether the IBM floating point value in b is
+// a SAS missing value.  Missing values have a first byte of '.', '_'
+// or 'A' through 'Z', followed by zeros.  The code of special missing
+// values is returned, or zero for the standard missing value.
+func ibmMissing(b []byte) (byte, bool) {
+
+	c := b[0]
+	if c != '.' && c != '_' && (c < 'A' || c > 'Z') {
+		return 0, false
+	}
+	for _, x := range b[1:] {
+		if x != 0 {
+			return 0, false
+		}
+	}
+	if c == '.' {
+		return 0, true
+	}
+	return c, true
+}
+
+// ibmToFloat64 converts a big endian IBM floating point value, which
+// may be truncated to fewer than 8 bytes, to a float64.  IBM values
+// have a sign bit, a 7 bit base 16 exponent with bias 64, and a 56
+// bit fraction.
+func ibmToFloat64(b []byte) float64 {
+
+	var frac uint64
+	for i := 1; i < 8; i++ {
+		frac <<= 8
+		if i < len(b) {
+			frac |= uint64(b[i])
+		}
+	}
+	if frac == 0 {
+		return 0
+	}
+
+	exp := int(b[0] & 0x7f)
+	x := math.Ldexp(float64(frac), 4*(exp-64)-56)
+	if b[0]&0x80 != 0 {
+		x = -x
+	}
+	return x
+}
@@ -0,0 +1,425 @@
+package datareader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// xportTestMember holds a data set to be written to a transport file
+// by buildTestXPORT.  The values are float64 for numeric columns,
+// with NaN values written as the missing value with the code in
+// missing, and string for character columns.
+type xportTestMember struct {
+	name    string
+	label   string
+	columns []*xportColumn
+	values  [][]interface{}
+	missing [][]byte
+}
+
+// xportPad pads s with blanks to length n.
+func xportPad(s string, n int) string {
+	return s + strings.Repeat(" ", n-len(s))
+}
+
+// buildTestXPORT returns a transport file holding the given members.
+func buildTestXPORT(v8 bool, labelV9 bool, members []*xportTestMember) []byte {
+
+	var buf bytes.Buffer
+	header := func(name, digits string) {
+		buf.WriteString(xportPad(xportHeaderPrefix+name+"HEADER RECORD!!!!!!!"+digits, 80))
+	}
+	pad := func() {
+		for buf.Len()%80 != 0 {
+			buf.WriteByte(' ')
+		}
+	}
+	const zeros = "000000000000000000000000000000"
+	const date = "16OCT26:10:20:06"
+
+	lib, mem, dsc, nst, obs := xportLibraryV5, xportMemberV5, xportDescV5, xportNamestrV5, xportObsV5
+	if v8 {
+		lib, mem, dsc, nst, obs = xportLibraryV8, xportMemberV8, xportDescV8, xportNamestrV8, xportObsV8
+	}
+
+	header(lib, zeros)
+	buf.WriteString(xportPad("SAS     SAS     SASLIB  9.4     Linux", 64) + date)
+	buf.WriteString(xportPad(date, 80))
+
+	for _, m := range members {
+		header(mem, "000000000000000001600000000140")
+		header(dsc, zeros)
+		if v8 {
+			buf.WriteString("SAS     " + xportPad(m.name, 32) + "SASDATA 9.4     Linux   " + date)
+		} else {
+			buf.WriteString("SAS     " + xportPad(m.name, 8) + "SASDATA 9.4     Linux   " + strings.Repeat(" ", 24) + date)
+		}
+		buf.WriteString(date + strings.Repeat(" ", 16) + xportPad(m.label, 40) + "DATA    ")
+		if v8 {
+			header(nst, fmt.Sprintf("000000%06d000000000000000000", len(m.columns)))
+		} else {
+			header(nst, fmt.Sprintf("000000%04d00000000000000000000", len(m.columns)))
+		}
+
+		var pos int
+		var long []*xportColumn
+		var longNum []int
+		for j, c := range m.columns {
+			c.position = pos
+			pos += c.length
+			ns := make([]byte, 140)
+			ntype := 1
+			if c.ctype == SASStringType {
+				ntype = 2
+			}
+			binary.BigEndian.PutUint16(ns[0:], uint16(ntype))
+			binary.BigEndian.PutUint16(ns[4:], uint16(c.length))
+			binary.BigEndian.PutUint16(ns[6:], uint16(j+1))
+			name, label, format := c.name, c.label, c.format
+			if len(name) > 8 {
+				name = name[0:8]
+			}
+			if len(label) > 40 {
+				label = label[0:40]
+			}
+			if len(format) > 8 {
+				format = format[0:8]
+			}
+			copy(ns[8:], xportPad(name, 8))
+			copy(ns[16:], xportPad(label, 40))
+			copy(ns[56:], xportPad(format, 8))
+			binary.BigEndian.PutUint16(ns[64:], uint16(c.formatWidth))
+			binary.BigEndian.PutUint16(ns[66:], uint16(c.formatDecimals))
+			copy(ns[72:], xportPad("", 8))
+			binary.BigEndian.PutUint32(ns[84:], uint32(c.position))
+			if v8 {
+				copy(ns[88:], xportPad(c.name, 32))
+				binary.BigEndian.PutUint16(ns[120:], uint16(len(c.label)))
+				if len(c.label) > 40 || labelV9 {
+					long = append(long, c)
+					longNum = append(longNum, j+1)
+				}
+			}
+			buf.Write(ns)
+		}
+		pad()
+
+		if len(long) > 0 {
+			name := xportLabelV8
+			if labelV9 {
+				name = xportLabelV9
+			}
+			header(name, fmt.Sprintf("%-30d", len(long)))
+			for i, c := range long {
+				h := make([]byte, 6)
+				if labelV9 {
+					h = make([]byte, 10)
+					binary.BigEndian.PutUint16(h[6:], uint16(len(c.format)))
+				}
+				binary.BigEndian.PutUint16(h[0:], uint16(longNum[i]))
+				binary.BigEndian.PutUint16(h[2:], uint16(len(c.name)))
+				binary.BigEndian.PutUint16(h[4:], uint16(len(c.label)))
+				buf.Write(h)
+				buf.WriteString(c.name + c.label)
+				if labelV9 {
+					buf.WriteString(c.format)
+				}
+			}
+			pad()
+		}
+
+		header(obs, zeros)
+		for i, row := range m.values {
+			for j, c := range m.columns {
+				switch v := row[j].(type) {
+				case float64:
+					b := make([]byte, 8)
+					if !math.IsNaN(v) {
+						u, _ := float64ToIBM(v)
+						binary.BigEndian.PutUint64(b, u)
+					} else {
+						b[0] = '.'
+						if m.missing != nil && m.missing[i][j] != 0 {
+							b[0] = m.missing[i][j]
+						}
+					}
+					buf.Write(b[0:c.length])
+				case string:
+					buf.WriteString(xportPad(v, c.length))
+				}
+			}
+		}
+		pad()
+	}
+
+	return buf.Bytes()
+}
+
+// testXPORTMembers returns the members used to test the transport
+// file reader.
+func testXPORTMembers() []*xportTestMember {
+
+	nan := math.NaN()
+	return []*xportTestMember{
+		{
+			name:  "FIRST",
+			label: "The first member",
+			columns: []*xportColumn{
+				{name: "X", label: "A number", ctype: SASNumericType, length: 8},
+				{name: "NAME", label: "A name", ctype: SASStringType, length: 6},
+				{name: "SHORT", ctype: SASNumericType, length: 4},
+				{name: "WHEN", format: "DATE", formatWidth: 9, ctype: SASNumericType, length: 8},
+			},
+			values: [][]interface{}{
+				{1.0, "one", 3.0, 0.0},
+				{-118.625, "two", nan, 366.0},
+				{nan, "", 0.5, -1.0},
+				{1e-5, "three", 1024.0, nan},
+				{nan, "four", -7.0, 20000.0},
+			},
+			missing: [][]byte{
+				{0, 0, 0, 0},
+				{0, 0, 'Z', 0},
+				{0, 0, 0, 0},
+				{0, 0, 0, 0},
+				{'A', 0, 0, '_'},
+			},
+		},
+		{
+			name:  "SECOND",
+			label: "The second member",
+			columns: []*xportColumn{
+				{name: "S", ctype: SASStringType, length: 3},
+				{name: "Y", ctype: SASNumericType, length: 8},
+			},
+			values: [][]interface{}{
+				{"a", 0.1},
+				{"bb", 2.0},
+			},
+		},
+	}
+}
+
+func TestIBMToFloat64(t *testing.T) {
+
+	for _, tc := range []struct {
+		bits uint64
+		x    float64
+	}{
+		{0x4110000000000000, 1},
+		{0xC276A00000000000, -118.625},
+		{0x4019999999999999, 0.09999999999999999},
+		{0x0000000000000000, 0},
+		{0x4280000000000000, 128},
+		{0x3F10000000000000, 1.0 / 256},
+	} {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, tc.bits)
+		if x := ibmToFloat64(b); x != tc.x {
+			t.Errorf("%x converted to %v, expected %v", tc.bits, x, tc.x)
+		}
+	}
+
+	// Truncated values
+	if x := ibmToFloat64([]byte{0x42, 0x80, 0, 0}); x != 128 {
+		t.Errorf("Truncated value converted to %v, expected 128", x)
+	}
+
+	for _, tc := range []struct {
+		b    []byte
+		code byte
+		miss bool
+	}{
+		{[]byte{'.', 0, 0, 0, 0, 0, 0, 0}, 0, true},
+		{[]byte{'_', 0, 0}, '_', true},
+		{[]byte{'Q', 0, 0, 0, 0, 0, 0, 0}, 'Q', true},
+		{[]byte{'.', 0, 0, 0, 0, 0, 0, 1}, 0, false},
+		{[]byte{0x41, 0x10, 0, 0, 0, 0, 0, 0}, 0, false},
+	} {
+		code, miss := ibmMissing(tc.b)
+		if code != tc.code || miss != tc.miss {
+			t.Errorf("Missing value %v detected as %q, %v", tc.b, code, miss)
+		}
+	}
+}
+
+func TestXPORT(t *testing.T) {
+
+	for _, v8 := range []bool{false, true} {
+
+		members := testXPORTMembers()
+		raw := buildTestXPORT(v8, false, members)
+		xp, err := NewXPORTReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		xp.TrimStrings = true
+
+		version := 5
+		if v8 {
+			version = 8
+		}
+		if xp.Version != version || xp.SASRelease != "9.4" || xp.OSName != "Linux" {
+			t.Errorf("Incorrect library header: %d %q %q", xp.Version, xp.SASRelease, xp.OSName)
+		}
+		if names := xp.Members(); len(names) != 2 || names[0] != "FIRST" || names[1] != "SECOND" {
+			t.Fatalf("Incorrect members: %v", names)
+		}
+
+		for _, m := range members {
+			if err := xp.SelectMember(strings.ToLower(m.name)); err != nil {
+				t.Fatal(err)
+			}
+			if xp.Name != m.name || xp.Label != m.label || xp.MemberType != "DATA" {
+				t.Errorf("Incorrect member header: %q %q %q", xp.Name, xp.Label, xp.MemberType)
+			}
+			expectedDate := time.Date(2026, 10, 16, 10, 20, 6, 0, time.UTC)
+			if !xp.DateCreated.Equal(expectedDate) || !xp.DateModified.Equal(expectedDate) {
+				t.Errorf("Incorrect dates: %v %v", xp.DateCreated, xp.DateModified)
+			}
+			if xp.RowCount() != len(m.values) {
+				t.Fatalf("%s has %d rows, expected %d", m.name, xp.RowCount(), len(m.values))
+			}
+
+			names := xp.ColumnNames()
+			labels := xp.ColumnLabels()
+			types := xp.ColumnTypes()
+			for j, c := range m.columns {
+				if names[j] != c.name || labels[j] != c.label || types[j] != c.ctype || xp.ColumnFormats[j] != c.format {
+					t.Errorf("Column %d read incorrectly", j)
+				}
+			}
+
+			// Read the rows in chunks of two
+			var rows int
+			for {
+				ds, err := xp.Read(2)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				for j, c := range m.columns {
+					if ds[j].Name != c.name {
+						t.Errorf("Series has name %q, expected %q", ds[j].Name, c.name)
+					}
+					for i := 0; i < ds[j].Length(); i++ {
+						v := m.values[rows+i][j]
+						if c.ctype == SASStringType {
+							if s := ds[j].Data().([]string)[i]; s != v {
+								t.Errorf("Row %d column %d is %q, expected %q", rows+i, j, s, v)
+							}
+							continue
+						}
+						x := ds[j].Data().([]float64)[i]
+						miss := ds[j].Missing()[i]
+						var code byte
+						if codes := ds[j].MissingCodes(); codes != nil {
+							code = codes[i]
+						}
+						if math.IsNaN(v.(float64)) {
+							var expected byte
+							if m.missing != nil {
+								expected = m.missing[rows+i][j]
+							}
+							if !miss || code != expected {
+								t.Errorf("Row %d column %d should be missing with code %q", rows+i, j, expected)
+							}
+						} else if miss || x != v {
+							t.Errorf("Row %d column %d is %v, expected %v", rows+i, j, x, v)
+						}
+					}
+				}
+				rows += ds[0].Length()
+			}
+			if rows != len(m.values) {
+				t.Errorf("Read %d rows, expected %d", rows, len(m.values))
+			}
+		}
+
+		// Date conversion
+		if err := xp.SelectMember("FIRST"); err != nil {
+			t.Fatal(err)
+		}
+		xp.ConvertDates = true
+		ds, err := xp.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dates, ok := ds[3].Data().([]time.Time)
+		if !ok {
+			t.Fatalf("Date column has type %T", ds[3].Data())
+		}
+		if !dates[1].Equal(time.Date(1961, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Incorrect date %v", dates[1])
+		}
+		if _, err := xp.Read(1); err != io.EOF {
+			t.Errorf("Expected io.EOF at end of member")
+		}
+	}
+}
+
+func TestXPORTLongLabels(t *testing.T) {
+
+	for _, v9 := range []bool{false, true} {
+		members := []*xportTestMember{
+			{
+				name:  "A_LONG_MEMBER_NAME",
+				label: "Version 8 member",
+				columns: []*xportColumn{
+					{name: "a_long_variable_name", label: strings.Repeat("A long label. ", 10), ctype: SASNumericType, length: 8},
+					{name: "B", label: "short", format: "$CHAR", ctype: SASStringType, length: 100},
+				},
+				values: [][]interface{}{
+					{1.5, strings.Repeat("x", 100)},
+				},
+			},
+		}
+		if v9 {
+			members[0].columns[0].format = "A_LONG_FORMAT_NAME"
+		}
+		xp, err := NewXPORTReader(bytes.NewReader(buildTestXPORT(true, v9, members)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if xp.Name != members[0].name {
+			t.Errorf("Member name is %q, expected %q", xp.Name, members[0].name)
+		}
+		names := xp.ColumnNames()
+		labels := xp.ColumnLabels()
+		for j, c := range members[0].columns {
+			if names[j] != c.name || labels[j] != c.label || xp.ColumnFormats[j] != c.format {
+				t.Errorf("Column %d is %q %q %q", j, names[j], labels[j], xp.ColumnFormats[j])
+			}
+		}
+		ds, err := xp.Read(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds[0].Data().([]float64)[0] != 1.5 || ds[1].Data().([]string)[0] != strings.Repeat("x", 100) {
+			t.Errorf("Data read incorrectly")
+		}
+	}
+}
+
+func TestXPORTNotTransport(t *testing.T) {
+
+	raw, err := ioutil.ReadFile(filepath.Join("test_files", "data", "test1.sas7bdat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewXPORTReader(bytes.NewReader(raw)); err == nil {
+		t.Errorf("No error reading a SAS7BDAT file as a transport file")
+	}
+	if _, err := NewXPORTReader(bytes.NewReader(nil)); err == nil {
+		t.Errorf("No error reading an empty file")
+	}
+}
@@ -0,0 +1,354 @@
+package datareader
+
+// Write SAS transport (XPORT) version 5 files with go.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// XPORTColumn describes a column of a transport file written by an
+// XPORTWriter.
+type XPORTColumn struct {
+
+	// The column name, at most 8 characters (letters, digits and
+	// underscores, not starting with a digit)
+	Name string
+
+	// The column label, at most 40 bytes long
+	Label string
+
+	// The SAS format of the column, e.g. "DATE9." or "8.2", with a
+	// name of at most 8 characters, may be empty
+	Format string
+
+	// The data type, SASNumericType or SASStringType
+	Type ColumnTypeT
+
+	// The width in bytes of a string column, at most 200.  Numeric
+	// values are always stored in 8 bytes.
+	Length int
+}
+
+// XPORTWriter writes a single data set to a SAS transport file in
+// the version 5 format, which is the format required for regulatory
+// submissions.  The configuration fields must be set before the
+// first call to Write.
+type XPORTWriter struct {
+
+	// The name of the data set, at most 8 characters, "DATA" if
+	// empty
+	Name string
+
+	// The label of the data set, at most 40 bytes long
+	Label string
+
+	// The creation and modification time stored in the file
+	// headers, the current time if zero
+	DateCreated time.Time
+
+	w         io.Writer
+	columns   []XPORTColumn
+	rowLength int
+
+	// The number of bytes of observations written
+	written int64
+
+	rowCount int
+	started  bool
+	closed   bool
+}
+
+// The limits of the version 5 transport format
+const (
+	xportMaxNameLength   = 8
+	xportMaxLabelLength  = 40
+	xportMaxStringLength = 200
+)
+
+// xportValidName returns an error if name is not a valid name in a
+// version 5 transport file.
+func xportValidName(kind, name string) error {
+
+	if name == "" || len(name) > xportMaxNameLength {
+		return fmt.Errorf("%s name %q must have between 1 and %d characters", kind, name, xportMaxNameLength)
+	}
+	for i, c := range name {
+		if c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return fmt.Errorf("%s name %q must contain only letters, digits and underscores, and not start with a digit", kind, name)
+	}
+	return nil
+}
+
+// NewXPORTWriter returns a writer that writes data with the given
+// columns to w as a version 5 SAS transport file.  The data are
+// written with Write, then Close must be called to complete the file.
+// An error is returned if the columns do not satisfy the limits of
+// the version 5 format.
+func NewXPORTWriter(w io.Writer, columns []XPORTColumn) (*XPORTWriter, error) {
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns to write")
+	}
+	if len(columns) > 9999 {
+		return nil, fmt.Errorf("%d columns, a transport file can hold at most 9999", len(columns))
+	}
+
+	xw := &XPORTWriter{
+		w:       w,
+		columns: make([]XPORTColumn, len(columns)),
+	}
+	copy(xw.columns, columns)
+
+	names := make(map[string]bool)
+	for j, c := range xw.columns {
+		if err := xportValidName("column", c.Name); err != nil {
+			return nil, fmt.Errorf("column %d: %v", j, err)
+		}
+		uname := strings.ToUpper(c.Name)
+		if names[uname] {
+			return nil, fmt.Errorf("column %d: duplicate name %q", j, c.Name)
+		}
+		names[uname] = true
+		if len(c.Label) > xportMaxLabelLength {
+			return nil, fmt.Errorf("column %s: label is longer than %d bytes", c.Name, xportMaxLabelLength)
+		}
+		if name, _, _ := splitFormat(c.Format); len(name) > xportMaxNameLength {
+			return nil, fmt.Errorf("column %s: format name %q is longer than %d characters", c.Name, name, xportMaxNameLength)
+		}
+		switch c.Type {
+		case SASNumericType:
+			xw.columns[j].Length = 8
+		case SASStringType:
+			if c.Length < 1 || c.Length > xportMaxStringLength {
+				return nil, fmt.Errorf("column %s: string length %d is not between 1 and %d",
+					c.Name, c.Length, xportMaxStringLength)
+			}
+		default:
+			return nil, fmt.Errorf("column %s: unknown type %d", c.Name, c.Type)
+		}
+		xw.rowLength += xw.columns[j].Length
+	}
+
+	return xw, nil
+}
+
+// Write appends the rows in data to the file.  The Series must be in
+// the same order as the columns passed to NewXPORTWriter, and have the
+// same length.  The values are converted as described for
+// SAS7BDATWriter.Write, and numeric values are stored as IBM floating
+// point values.
+func (xw *XPORTWriter) Write(data []*Series) error {
+
+	if xw.closed {
+		return fmt.Errorf("write to closed XPORTWriter")
+	}
+	if len(data) != len(xw.columns) {
+		return fmt.Errorf("received %d columns, expected %d", len(data), len(xw.columns))
+	}
+
+	if !xw.started {
+		if err := xw.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	n := data[0].Length()
+	rows := make([]byte, n*xw.rowLength)
+	var pos int
+	for j, s := range data {
+		c := xw.columns[j]
+		if s.Length() != n {
+			return fmt.Errorf("column %s has length %d, expected %d", c.Name, s.Length(), n)
+		}
+		if c.Type == SASNumericType {
+			x, miss, codes, err := sasNumericValues(c.Name, c.Format, s)
+			if err != nil {
+				return err
+			}
+			for i := range x {
+				b := rows[i*xw.rowLength+pos : i*xw.rowLength+pos+8]
+				if miss[i] {
+					b[0] = '.'
+					if codes != nil {
+						if code := sasSpecialCode(codes[i]); code != 0 {
+							b[0] = code
+						}
+					}
+					continue
+				}
+				v, err := float64ToIBM(x[i])
+				if err != nil {
+					return fmt.Errorf("column %s: row %d: %v", c.Name, xw.rowCount+i, err)
+				}
+				binary.BigEndian.PutUint64(b, v)
+			}
+		} else {
+			x, err := sasStringValues(c.Name, c.Length, xw.rowCount, s)
+			if err != nil {
+				return err
+			}
+			for i := range x {
+				b := rows[i*xw.rowLength+pos : i*xw.rowLength+pos+c.Length]
+				copy(b, x[i])
+				for k := len(x[i]); k < len(b); k++ {
+					b[k] = ' '
+				}
+			}
+		}
+		pos += c.Length
+	}
+
+	if _, err := xw.w.Write(rows); err != nil {
+		return err
+	}
+	xw.written += int64(len(rows))
+	xw.rowCount += n
+
+	return nil
+}
+
+// Close pads the observations to a whole number of records.  It does
+// not close the underlying writer.
+func (xw *XPORTWriter) Close() error {
+
+	if xw.closed {
+		return nil
+	}
+	if !xw.started {
+		if err := xw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	xw.closed = true
+
+	if m := xw.written % xportRecordLength; m != 0 {
+		pad := strings.Repeat(" ", int(xportRecordLength-m))
+		if _, err := io.WriteString(xw.w, pad); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RowCount returns the number of rows written so far.
+func (xw *XPORTWriter) RowCount() int {
+	return xw.rowCount
+}
+
+// writeHeader writes the library header, the member header and the
+// NAMESTR records.
+func (xw *XPORTWriter) writeHeader() error {
+
+	xw.started = true
+
+	name := xw.Name
+	if name == "" {
+		name = "DATA"
+	}
+	if err := xportValidName("data set", name); err != nil {
+		return err
+	}
+	if len(xw.Label) > xportMaxLabelLength {
+		return fmt.Errorf("data set label is longer than %d bytes", xportMaxLabelLength)
+	}
+
+	created := xw.DateCreated
+	if created.IsZero() {
+		created = time.Now()
+	}
+	date := strings.ToUpper(created.Format(xportDateFormat))
+	osName := padRight(runtime.GOOS, 8)
+
+	const zeros = "000000000000000000000000000000"
+	var hdr []byte
+	record := func(s string) {
+		hdr = append(hdr, padRight(s, xportRecordLength)...)
+	}
+	header := func(name, digits string) {
+		record(xportHeaderPrefix + name + "HEADER RECORD!!!!!!!" + digits)
+	}
+
+	header(xportLibraryV5, zeros)
+	record("SAS     SAS     SASLIB  9.4     " + osName + strings.Repeat(" ", 24) + date)
+	record(date)
+	header(xportMemberV5, "000000000000000001600000000140")
+	header(xportDescV5, zeros)
+	record("SAS     " + padRight(name, 8) + "SASDATA 9.4     " + osName + strings.Repeat(" ", 24) + date)
+	record(date + strings.Repeat(" ", 16) + padRight(xw.Label, 40))
+	header(xportNamestrV5, fmt.Sprintf("000000%04d00000000000000000000", len(xw.columns)))
+
+	var pos int
+	for j, c := range xw.columns {
+		ns := make([]byte, xportNamestrLen)
+		bo := binary.BigEndian
+		ntype := 1
+		if c.Type == SASStringType {
+			ntype = 2
+		}
+		format, width, decimals := splitFormat(c.Format)
+		bo.PutUint16(ns[0:], uint16(ntype))
+		bo.PutUint16(ns[4:], uint16(c.Length))
+		bo.PutUint16(ns[6:], uint16(j+1))
+		copy(ns[8:16], padRight(c.Name, 8))
+		copy(ns[16:56], padRight(c.Label, 40))
+		copy(ns[56:64], padRight(format, 8))
+		bo.PutUint16(ns[64:], uint16(width))
+		bo.PutUint16(ns[66:], uint16(decimals))
+		copy(ns[72:80], padRight("", 8))
+		bo.PutUint32(ns[84:], uint32(pos))
+		hdr = append(hdr, ns...)
+		pos += c.Length
+	}
+	for len(hdr)%xportRecordLength != 0 {
+		hdr = append(hdr, ' ')
+	}
+	header(xportObsV5, zeros)
+
+	_, err := xw.w.Write(hdr)
+	return err
+}
+
+// float64ToIBM converts x to an 8 byte IBM floating point value,
+// returned as an integer to be stored in big endian order.  Every
+// float64 value within the range of IBM values is converted exactly,
+// since the IBM fraction has 56 bits.  Values too small to be
+// represented are converted to zero.
+func float64ToIBM(x float64) (uint64, error) {
+
+	if math.IsInf(x, 0) || math.IsNaN(x) {
+		return 0, fmt.Errorf("cannot convert %v to IBM floating point", x)
+	}
+	if x == 0 {
+		return 0, nil
+	}
+
+	var sign uint64
+	if x < 0 {
+		sign = 1 << 63
+		x = -x
+	}
+
+	// x = frac * 2^exp with frac in [1/2, 1), which is written as
+	// frac * 2^-r * 16^e with exp = 4e - r and r in 0..3.
+	frac, exp := math.Frexp(x)
+	e := (exp + 3) >> 2
+	r := 4*e - exp
+	if e+64 > 127 {
+		return 0, fmt.Errorf("%v is too large for IBM floating point", x)
+	}
+	if e+64 < 0 {
+		return 0, nil
+	}
+
+	mantissa := uint64(math.Ldexp(frac, 56-r))
+	return sign | uint64(e+64)<<56 | mantissa, nil
+}
@@ -0,0 +1,360 @@
+package datareader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFloat64ToIBM(t *testing.T) {
+
+	for _, tc := range []struct {
+		x    float64
+		bits uint64
+	}{
+		{1, 0x4110000000000000},
+		{-118.625, 0xC276A00000000000},
+		{128, 0x4280000000000000},
+		{1.0 / 256, 0x3F10000000000000},
+		{0, 0},
+	} {
+		bits, err := float64ToIBM(tc.x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bits != tc.bits {
+			t.Errorf("%v converted to %x, expected %x", tc.x, bits, tc.bits)
+		}
+	}
+
+	// All values in the IBM range are converted exactly
+	b := make([]byte, 8)
+	for _, x := range []float64{0.1, -1.0 / 3, math.Pi, 1e-70, 1e70, 123456789.123456789, math.MaxInt64} {
+		bits, err := float64ToIBM(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint64(b, bits)
+		if y := ibmToFloat64(b); y != x {
+			t.Errorf("%v converted to %v", x, y)
+		}
+	}
+
+	if bits, err := float64ToIBM(1e-300); err != nil || bits != 0 {
+		t.Errorf("Underflow should give zero")
+	}
+	for _, x := range []float64{1e300, math.Inf(1), math.NaN()} {
+		if _, err := float64ToIBM(x); err == nil {
+			t.Errorf("No error converting %v", x)
+		}
+	}
+}
+
+func TestXPORTWriter(t *testing.T) {
+
+	columns := []XPORTColumn{
+		{Name: "X", Label: "A number", Type: SASNumericType},
+		{Name: "name", Label: "The name of the row", Type: SASStringType, Length: 7},
+		{Name: "WHEN", Format: "DATE9.", Type: SASNumericType},
+		{Name: "N_2", Format: "8.2", Type: SASNumericType},
+		{Name: "LONGSTR", Type: SASStringType, Length: 200},
+	}
+
+	const n = 37
+	x := make([]float64, n)
+	xmiss := make([]bool, n)
+	xcodes := make([]byte, n)
+	names := make([]string, n)
+	dates := make([]time.Time, n)
+	ints := make([]int64, n)
+	long := make([]string, n)
+	base := time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		x[i] = float64(i) * 1.1
+		switch i % 7 {
+		case 2:
+			xmiss[i] = true
+		case 4:
+			xmiss[i] = true
+			xcodes[i] = 'C'
+		}
+		names[i] = strings.Repeat("abc", i%3)
+		dates[i] = base.AddDate(0, 0, i*10)
+		ints[i] = int64(i * i)
+		long[i] = strings.Repeat("y", 5*i)
+	}
+	xs, _ := NewSeries("X", x, xmiss)
+	xs.missingCodes = xcodes
+	data := []*Series{xs}
+	for _, v := range []interface{}{names, dates, ints, long} {
+		s, err := NewSeries("", v, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, s)
+	}
+
+	var buf bytes.Buffer
+	xw, err := NewXPORTWriter(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Name = "WRITTEN"
+	xw.Label = "A written data set"
+	xw.DateCreated = time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)
+	for i := 0; i < n; i += 10 {
+		j := i + 10
+		if j > n {
+			j = n
+		}
+		chunk := []*Series{sliceTestSeries(data[0], i, j)}
+		for _, v := range []interface{}{names[i:j], dates[i:j], ints[i:j], long[i:j]} {
+			s, _ := NewSeries("", v, nil)
+			chunk = append(chunk, s)
+		}
+		if err := xw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%80 != 0 {
+		t.Errorf("File length %d is not a multiple of 80", buf.Len())
+	}
+
+	xp, err := NewXPORTReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xp.Version != 5 || xp.Name != "WRITTEN" || xp.Label != "A written data set" {
+		t.Errorf("Incorrect header: %d %q %q", xp.Version, xp.Name, xp.Label)
+	}
+	if !xp.DateCreated.Equal(xw.DateCreated) {
+		t.Errorf("Created date is %v, expected %v", xp.DateCreated, xw.DateCreated)
+	}
+	if xp.RowCount() != n {
+		t.Fatalf("Row count is %d, expected %d", xp.RowCount(), n)
+	}
+	colNames := xp.ColumnNames()
+	labels := xp.ColumnLabels()
+	for j, c := range columns {
+		format, _, _ := splitFormat(c.Format)
+		if colNames[j] != c.Name || labels[j] != c.Label || xp.ColumnFormats[j] != format {
+			t.Errorf("Column %d is %q %q %q", j, colNames[j], labels[j], xp.ColumnFormats[j])
+		}
+		if c := xp.Columns()[j]; j == 3 && (c.FormatWidth != 8 || c.FormatDecimals != 2) {
+			t.Errorf("Format width and decimals are %d, %d", c.FormatWidth, c.FormatDecimals)
+		}
+	}
+
+	xp.TrimStrings = true
+	xp.ConvertDates = true
+	ds, err := xp.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, r := ds[0].AllEqual(data[0]); !f {
+		t.Errorf("Column 0 differs in row %d", r)
+	}
+	codes := ds[0].MissingCodes()
+	for i := range xcodes {
+		if codes[i] != xcodes[i] {
+			t.Errorf("Missing code in row %d is %q, expected %q", i, codes[i], xcodes[i])
+		}
+	}
+	for j, expected := range []*Series{data[1], data[2], data[3].UpcastNumeric(), data[4]} {
+		if f, r := ds[j+1].AllEqual(expected); !f {
+			t.Errorf("Column %d differs in row %d", j+1, r)
+		}
+	}
+	if _, err := xp.Read(1); err != io.EOF {
+		t.Errorf("Expected io.EOF after reading all rows")
+	}
+}
+
+func TestXPORTWriterLimits(t *testing.T) {
+
+	for _, columns := range [][]XPORTColumn{
+		nil,
+		{{Name: "TOOLONGNAME", Type: SASNumericType}},
+		{{Name: "1X", Type: SASNumericType}},
+		{{Name: "A B", Type: SASNumericType}},
+		{{Name: "X", Type: SASNumericType}, {Name: "x", Type: SASNumericType}},
+		{{Name: "X", Label: strings.Repeat("l", 41), Type: SASNumericType}},
+		{{Name: "X", Format: "LONGFORMAT9.", Type: SASNumericType}},
+		{{Name: "S", Type: SASStringType, Length: 201}},
+		{{Name: "S", Type: SASStringType}},
+	} {
+		if _, err := NewXPORTWriter(nil, columns); err == nil {
+			t.Errorf("No error creating writer with columns %v", columns)
+		}
+	}
+
+	var buf bytes.Buffer
+	xw, err := NewXPORTWriter(&buf, []XPORTColumn{{Name: "S", Type: SASStringType, Length: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Name = "NOT VALID"
+	s, _ := NewSeries("S", []string{"ab"}, nil)
+	if err := xw.Write([]*Series{s}); err == nil {
+		t.Errorf("No error writing with an invalid data set name")
+	}
+
+	buf.Reset()
+	xw, err = NewXPORTWriter(&buf, []XPORTColumn{{Name: "S", Type: SASStringType, Length: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ = NewSeries("S", []string{"abc"}, nil)
+	if err := xw.Write([]*Series{s}); err == nil {
+		t.Errorf("No error writing a string that is too long")
+	}
+
+	xw, err = NewXPORTWriter(&buf, []XPORTColumn{{Name: "X", Type: SASNumericType}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ = NewSeries("X", []float64{1e300}, nil)
+	if err := xw.Write([]*Series{s}); err == nil {
+		t.Errorf("No error writing a value that is too large")
+	}
+}
+
+// TestXPORTWriterMissingCodes checks that a missing value is written as
+// a missing value whatever its code.
+func TestXPORTWriterMissingCodes(t *testing.T) {
+
+	x := make([]float64, 256)
+	miss := make([]bool, 256)
+	codes := make([]byte, 256)
+	for i := range x {
+		x[i] = 1
+		miss[i] = true
+		codes[i] = byte(i)
+	}
+	s, _ := NewSeries("X", x, miss)
+	s.missingCodes = codes
+
+	var buf bytes.Buffer
+	xw, err := NewXPORTWriter(&buf, []XPORTColumn{{Name: "X", Type: SASNumericType}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Write([]*Series{s}); err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	xp, err := NewXPORTReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := xp.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcodes := ds[0].MissingCodes()
+	for i, v := range ds[0].Data().([]float64) {
+		var c byte
+		switch {
+		case i == '_', i >= 'A' && i <= 'Z':
+			c = byte(i)
+		case i >= 'a' && i <= 'z':
+			c = byte(i - 'a' + 'A')
+		}
+		if !ds[0].Missing()[i] || !math.IsNaN(v) || rcodes[i] != c {
+			t.Errorf("Code %d read as %v, missing code %q, expected %q", i, v, rcodes[i], c)
+		}
+		if !math.IsNaN(sasMissingValue(byte(i))) {
+			t.Errorf("SAS7BDAT missing value with code %d is not NaN", i)
+		}
+	}
+}
+
+// TestSASWritersStataMissing writes the extended missing values .a to
+// .z read from a Stata file to XPORT and SAS7BDAT files, and checks
+// that they are read back as the special missing values .A to .Z.
+func TestSASWritersStataMissing(t *testing.T) {
+
+	f, err := os.Open(filepath.Join("test_files", "data", "stata8_117.dta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stata, err := NewStataReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := stata.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var xcols []XPORTColumn
+	var scols []SAS7BDATColumn
+	var upcast []*Series
+	for _, s := range data {
+		xcols = append(xcols, XPORTColumn{Name: s.Name, Type: SASNumericType})
+		scols = append(scols, SAS7BDATColumn{Name: s.Name, Type: SASNumericType})
+		upcast = append(upcast, s.UpcastNumeric())
+	}
+
+	var buf bytes.Buffer
+	xw, err := NewXPORTWriter(&buf, xcols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	xp, err := NewXPORTReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xds, err := xp.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf := writeTestSAS(t, scols, upcast, 10, func(*SAS7BDATWriter) {})
+	defer sf.Close()
+	sas, err := NewSAS7BDATReader(sf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sds, err := sas.Read(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, ds := range [][]*Series{xds, sds} {
+		for _, s := range ds {
+			codes := s.MissingCodes()
+			if s.Length() != 27 || codes == nil {
+				t.Fatalf("File %d: %s has %d values and codes %v", k, s.Name, s.Length(), codes)
+			}
+			for i, m := range s.Missing() {
+				expected := byte(0)
+				if i > 0 {
+					expected = byte('A' + i - 1)
+				}
+				if !m || codes[i] != expected {
+					t.Errorf("File %d: %s has missing code %q in row %d, expected %q", k, s.Name, codes[i], i, expected)
+				}
+			}
+		}
+	}
+}